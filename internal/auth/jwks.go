@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/zensos/microservice-project/internal/common"
+)
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func NewJWK(kid string, key *rsa.PublicKey) JWK {
+	return JWK{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		Alg: "RS256",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func (k JWK) PublicKey() (*rsa.PublicKey, error) {
+	if k.Kty != "RSA" {
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus: %w", err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exponent: %w", err)
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+type KeySource interface {
+	PublicKey(kid string) (*rsa.PublicKey, error)
+}
+
+type RemoteKeySet struct {
+	resolveURL func() (string, error)
+	client     *http.Client
+
+	mu          sync.RWMutex
+	keys        map[string]*rsa.PublicKey
+	lastFetched time.Time
+	// lastAttempt counts failed refreshes too, so an unreachable endpoint
+	// isn't hit on every request.
+	lastAttempt time.Time
+}
+
+func NewRemoteKeySet(resolveURL func() (string, error)) *RemoteKeySet {
+	return &RemoteKeySet{
+		resolveURL: resolveURL,
+		client:     &http.Client{Timeout: 5 * time.Second},
+		keys:       map[string]*rsa.PublicKey{},
+	}
+}
+
+// MemberJWKS returns a key set backed by the member service's JWKS endpoint,
+// found through JWKS_URL or, failing that, Consul.
+func MemberJWKS(client *consul.Client) *RemoteKeySet {
+	if url := os.Getenv("JWKS_URL"); url != "" {
+		return NewRemoteKeySet(func() (string, error) { return url, nil })
+	}
+	return NewRemoteKeySet(memberURL(client, "/.well-known/jwks.json"))
+}
+
+func memberURL(client *consul.Client, path string) func() (string, error) {
+	return func() (string, error) {
+		if client == nil {
+			return "", errors.New("service discovery is not available")
+		}
+		addr, err := common.DiscoverService(client, "member")
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("http://%s%s", addr, path), nil
+	}
+}
+
+func (s *RemoteKeySet) PublicKey(kid string) (*rsa.PublicKey, error) {
+	s.mu.RLock()
+	key, ok := s.keys[kid]
+	stale := time.Since(s.lastFetched) > 10*time.Minute
+	recent := time.Since(s.lastAttempt) < 30*time.Second
+	s.mu.RUnlock()
+
+	if ok && (!stale || recent) {
+		return key, nil
+	}
+	if !ok && recent {
+		return nil, ErrUnknownKey
+	}
+
+	if err := s.refresh(); err != nil {
+		if ok {
+			return key, nil
+		}
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if key, ok := s.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+func (s *RemoteKeySet) refresh() error {
+	s.mu.Lock()
+	s.lastAttempt = time.Now()
+	s.mu.Unlock()
+
+	url, err := s.resolveURL()
+	if err != nil {
+		return fmt.Errorf("couldn't resolve jwks url: %w", err)
+	}
+
+	resp, err := s.client.Get(url)
+	if err != nil {
+		return fmt.Errorf("couldn't fetch jwks: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("jwks endpoint returned %d", resp.StatusCode)
+	}
+
+	var set JWKS
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("couldn't decode jwks: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		pub, err := k.PublicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.lastFetched = time.Now()
+	s.mu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// jwksServer serves the given key until failing is set, and counts requests.
+func jwksServer(t *testing.T, kid string, key *rsa.PublicKey) (*httptest.Server, *atomic.Int32, *atomic.Bool) {
+	t.Helper()
+	var hits atomic.Int32
+	var failing atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(JWKS{Keys: []JWK{NewJWK(kid, key)}})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits, &failing
+}
+
+func TestRemoteKeySetRateLimitsRefreshes(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("failed refresh", func(t *testing.T) {
+		srv, hits, failing := jwksServer(t, "k1", &key.PublicKey)
+		failing.Store(true)
+		keys := NewRemoteKeySet(func() (string, error) { return srv.URL, nil })
+
+		if _, err := keys.PublicKey("k1"); err == nil {
+			t.Fatal("expected an error from a failing endpoint")
+		}
+		if _, err := keys.PublicKey("k1"); !errors.Is(err, ErrUnknownKey) {
+			t.Fatalf("second lookup: got %v, want ErrUnknownKey", err)
+		}
+		if got := hits.Load(); got != 1 {
+			t.Errorf("endpoint hit %d times, want 1", got)
+		}
+	})
+
+	t.Run("unknown kid", func(t *testing.T) {
+		srv, hits, _ := jwksServer(t, "k1", &key.PublicKey)
+		keys := NewRemoteKeySet(func() (string, error) { return srv.URL, nil })
+
+		if _, err := keys.PublicKey("k1"); err != nil {
+			t.Fatal(err)
+		}
+		for range 3 {
+			if _, err := keys.PublicKey("other"); !errors.Is(err, ErrUnknownKey) {
+				t.Fatalf("got %v, want ErrUnknownKey", err)
+			}
+		}
+		if got := hits.Load(); got != 1 {
+			t.Errorf("endpoint hit %d times, want 1", got)
+		}
+	})
+
+	t.Run("stale key with failing endpoint", func(t *testing.T) {
+		srv, hits, failing := jwksServer(t, "k1", &key.PublicKey)
+		keys := NewRemoteKeySet(func() (string, error) { return srv.URL, nil })
+
+		if _, err := keys.PublicKey("k1"); err != nil {
+			t.Fatal(err)
+		}
+		failing.Store(true)
+		keys.mu.Lock()
+		keys.lastFetched = time.Now().Add(-time.Hour)
+		keys.lastAttempt = keys.lastFetched
+		keys.mu.Unlock()
+
+		for range 3 {
+			if _, err := keys.PublicKey("k1"); err != nil {
+				t.Fatalf("stale key should still be served: %v", err)
+			}
+		}
+		if got := hits.Load(); got != 2 {
+			t.Errorf("endpoint hit %d times, want 2", got)
+		}
+	})
+}
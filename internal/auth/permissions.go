@@ -0,0 +1,95 @@
+package auth
+
+type Role string
+
+const (
+	RoleAdmin     Role = "admin"
+	RoleOrganizer Role = "organizer"
+	RoleMember    Role = "member"
+	RoleService   Role = "service"
+)
+
+type Permission string
+
+const (
+	PermEventsCreate    Permission = "events:create"
+	PermEventsManage    Permission = "events:manage"
+	PermEventsManageAny Permission = "events:manage_any"
+
+	PermBookingsCreate    Permission = "bookings:create"
+	PermBookingsReadAny   Permission = "bookings:read_any"
+	PermBookingsCancelAny Permission = "bookings:cancel_any"
+
+	PermWalletsTopUp    Permission = "wallets:top_up"
+	PermWalletsTransfer Permission = "wallets:transfer"
+	PermWalletsWithdraw Permission = "wallets:withdraw"
+	PermWalletsReadAny  Permission = "wallets:read_any"
+
+	PermWithdrawalsApprove Permission = "withdrawals:approve"
+
+	PermPaymentsCreate  Permission = "payments:create"
+	PermPaymentsRefund  Permission = "payments:refund"
+	PermPaymentsReadAny Permission = "payments:read_any"
+	PermPaymentsActAny  Permission = "payments:act_any"
+
+	PermLedgerReconcile Permission = "ledger:reconcile"
+	PermWebhooksReplay  Permission = "webhooks:replay"
+
+	PermMembersReadAny     Permission = "members:read_any"
+	PermMembersManage      Permission = "members:manage"
+	PermMembersManageRoles Permission = "members:manage_roles"
+)
+
+// Members pay and get refunds through booking, which calls payment with a
+// service token, so they can't charge, refund or void payments themselves.
+var memberPermissions = []Permission{
+	PermBookingsCreate,
+	PermWalletsTopUp,
+	PermWalletsTransfer,
+	PermWalletsWithdraw,
+}
+
+var RolePermissions = map[Role][]Permission{
+	RoleMember:    memberPermissions,
+	RoleOrganizer: append([]Permission{PermEventsCreate, PermEventsManage}, memberPermissions...),
+	RoleAdmin: append([]Permission{
+		PermEventsCreate,
+		PermEventsManage,
+		PermEventsManageAny,
+		PermBookingsReadAny,
+		PermBookingsCancelAny,
+		PermWalletsReadAny,
+		PermWithdrawalsApprove,
+		PermPaymentsCreate,
+		PermPaymentsRefund,
+		PermPaymentsReadAny,
+		PermPaymentsActAny,
+		PermLedgerReconcile,
+		PermWebhooksReplay,
+		PermMembersReadAny,
+		PermMembersManage,
+		PermMembersManageRoles,
+	}, memberPermissions...),
+	RoleService: {
+		PermBookingsReadAny,
+		PermPaymentsCreate,
+		PermPaymentsRefund,
+		PermPaymentsReadAny,
+		PermPaymentsActAny,
+		PermMembersReadAny,
+	},
+}
+
+func (r Role) Valid() bool {
+	_, ok := RolePermissions[r]
+	return ok
+}
+
+func (r Role) Can(perm Permission) bool {
+	for _, p := range RolePermissions[r] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
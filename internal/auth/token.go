@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const Issuer = "member"
+
+type Claims struct {
+	Email string `json:"email,omitempty"`
+	Role  Role   `json:"role,omitempty"`
+	jwt.RegisteredClaims
+}
+
+func (c *Claims) Can(perm Permission) bool {
+	return c.Role.Can(perm)
+}
+
+type Verifier struct {
+	keys KeySource
+}
+
+func NewVerifier(keys KeySource) *Verifier {
+	return &Verifier{keys: keys}
+}
+
+func (v *Verifier) Verify(raw string) (*Claims, error) {
+	claims := &Claims{}
+
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		if kid == "" {
+			return nil, errors.New("token has no kid")
+		}
+		return v.keys.PublicKey(kid)
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
+		jwt.WithIssuer(Issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30*time.Second),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+
+	return claims, nil
+}
+
+func Sign(kid string, key *rsa.PrivateKey, claims *Claims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		return "", fmt.Errorf("couldn't sign token: %w", err)
+	}
+	return signed, nil
+}
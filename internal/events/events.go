@@ -0,0 +1,71 @@
+// Package events defines the domain events services publish to RabbitMQ.
+//
+// Every message is an Envelope whose data is the payload for its type. The
+// queue a message goes to is named after its type. Each type has a JSON
+// Schema per version in schemas/<type>.v<version>.json.
+//
+// Adding an optional field doesn't change the version. Removing, renaming
+// or changing the meaning of a field does, and consumers refuse versions
+// they don't know, so both have to be rolled out together.
+package events
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrUnsupported = errors.New("unsupported event")
+
+type Envelope struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	Version    int             `json:"version"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// versions holds the current schema version of each type.
+var versions = map[string]int{
+	TypePaymentConfirmed: 1,
+	TypePaymentRefunded:  1,
+	TypeWalletToppedUp:   1,
+	TypeWalletLowBalance: 1,
+}
+
+// Marshal wraps data in an envelope of the current version of eventType.
+func Marshal(eventType string, data any) ([]byte, error) {
+	version, ok := versions[eventType]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupported, eventType)
+	}
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return json.Marshal(Envelope{
+		ID:         "evt_" + rand.Text(),
+		Type:       eventType,
+		Version:    version,
+		OccurredAt: now,
+		Data:       payload,
+	})
+}
+
+// Decode unwraps a message of eventType into data. Messages of another type
+// or version are refused with ErrUnsupported.
+func Decode(body []byte, eventType string, data any) (Envelope, error) {
+	var envelope Envelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return envelope, err
+	}
+	if envelope.Type != eventType || envelope.Version != versions[eventType] {
+		return envelope, fmt.Errorf("%w: %s v%d", ErrUnsupported, envelope.Type, envelope.Version)
+	}
+	return envelope, json.Unmarshal(envelope.Data, data)
+}
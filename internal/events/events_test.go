@@ -0,0 +1,68 @@
+package events
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/zensos/microservice-project/internal/money"
+)
+
+func TestMarshalDecode(t *testing.T) {
+	in := PaymentConfirmed{PaymentID: "pay_1", BookingID: "bk_1", MemberID: "m1", Amount: money.New(15025, "THB")}
+	body, err := Marshal(TypePaymentConfirmed, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out PaymentConfirmed
+	envelope, err := Decode(body, TypePaymentConfirmed, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != in {
+		t.Errorf("decoded %+v, want %+v", out, in)
+	}
+	if envelope.Version != 1 || envelope.ID == "" {
+		t.Errorf("unexpected envelope %+v", envelope)
+	}
+}
+
+func TestMarshalUniqueIDs(t *testing.T) {
+	seen := map[string]bool{}
+	for range 1000 {
+		body, err := Marshal(TypeWalletLowBalance, WalletLowBalance{MemberID: "m1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var data WalletLowBalance
+		envelope, err := Decode(body, TypeWalletLowBalance, &data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[envelope.ID] {
+			t.Fatalf("id %s was handed out twice", envelope.ID)
+		}
+		seen[envelope.ID] = true
+	}
+}
+
+func TestDecodeUnsupported(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"other type", `{"type":"wallet.topped_up","version":1,"data":{}}`},
+		{"unknown version", `{"type":"payment.confirmed","version":2,"data":{}}`},
+	}
+
+	for _, tt := range tests {
+		var data PaymentConfirmed
+		if _, err := Decode([]byte(tt.body), TypePaymentConfirmed, &data); !errors.Is(err, ErrUnsupported) {
+			t.Errorf("%s: got %v, want ErrUnsupported", tt.name, err)
+		}
+	}
+
+	if _, err := Marshal("booking.unknown", nil); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Marshal of an unknown type: got %v, want ErrUnsupported", err)
+	}
+}
@@ -0,0 +1,59 @@
+package events
+
+import "github.com/zensos/microservice-project/internal/money"
+
+const (
+	TypePaymentConfirmed = "payment.confirmed"
+	TypePaymentRefunded  = "payment.refunded"
+	TypeWalletToppedUp   = "wallet.topped_up"
+	TypeWalletLowBalance = "wallet.low_balance"
+)
+
+// MemberEmail is set on the payloads below when the request behind them said
+// where to reach the member: members acting for themselves, or a service
+// passing their address along.
+
+// PaymentConfirmed is published when a booking's payment is taken, either
+// directly or by capturing a hold.
+type PaymentConfirmed struct {
+	PaymentID   string      `json:"payment_id"`
+	BookingID   string      `json:"booking_id"`
+	MemberID    string      `json:"member_id"`
+	MemberEmail string      `json:"member_email,omitempty"`
+	Amount      money.Money `json:"amount"`
+}
+
+// PaymentRefunded is published for every refund, full or partial.
+// TotalRefunded is what has been refunded on the payment so far, including
+// this refund.
+type PaymentRefunded struct {
+	RefundID      string      `json:"refund_id"`
+	PaymentID     string      `json:"payment_id"`
+	BookingID     string      `json:"booking_id"`
+	MemberID      string      `json:"member_id"`
+	MemberEmail   string      `json:"member_email,omitempty"`
+	Amount        money.Money `json:"amount"`
+	TotalRefunded money.Money `json:"total_refunded"`
+	FullyRefunded bool        `json:"fully_refunded"`
+	Reason        string      `json:"reason,omitempty"`
+	BalanceAfter  money.Money `json:"balance_after"`
+}
+
+// WalletToppedUp is published when a top-up is credited to the wallet.
+type WalletToppedUp struct {
+	IntentID     string      `json:"intent_id"`
+	MemberID     string      `json:"member_id"`
+	MemberEmail  string      `json:"member_email,omitempty"`
+	Method       string      `json:"method"`
+	Amount       money.Money `json:"amount"`
+	BalanceAfter money.Money `json:"balance_after"`
+}
+
+// WalletLowBalance is published when a debit takes the available balance
+// from at or above Threshold to below it.
+type WalletLowBalance struct {
+	MemberID    string      `json:"member_id"`
+	MemberEmail string      `json:"member_email,omitempty"`
+	Balance     money.Money `json:"balance"`
+	Threshold   money.Money `json:"threshold"`
+}
@@ -0,0 +1,131 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/zensos/microservice-project/internal/auth"
+)
+
+const claimsKey = "auth.claims"
+
+func Authenticate(v *auth.Verifier) fiber.Handler {
+	return authenticate(v, false)
+}
+
+// OptionalAuthenticate lets requests without a token through anonymously,
+// for public routes that show more to some callers. A token that is sent
+// still has to be valid.
+func OptionalAuthenticate(v *auth.Verifier) fiber.Handler {
+	return authenticate(v, true)
+}
+
+func authenticate(v *auth.Verifier, optional bool) fiber.Handler {
+	return func(c fiber.Ctx) error {
+		header := c.Get(fiber.HeaderAuthorization)
+		if header == "" && optional {
+			return c.Next()
+		}
+		raw, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok || raw == "" {
+			return c.Status(401).JSON(fiber.Map{"error": "missing bearer token"})
+		}
+
+		claims, err := v.Verify(raw)
+		if err != nil {
+			return c.Status(401).JSON(fiber.Map{"error": "invalid or expired token"})
+		}
+
+		c.Locals(claimsKey, claims)
+		return c.Next()
+	}
+}
+
+func Claims(c fiber.Ctx) *auth.Claims {
+	claims, _ := c.Locals(claimsKey).(*auth.Claims)
+	return claims
+}
+
+func Subject(c fiber.Ctx) string {
+	if claims := Claims(c); claims != nil {
+		return claims.Subject
+	}
+	return ""
+}
+
+func Can(c fiber.Ctx, perm auth.Permission) bool {
+	claims := Claims(c)
+	return claims != nil && claims.Can(perm)
+}
+
+func Authorize(perm auth.Permission) fiber.Handler {
+	return func(c fiber.Ctx) error {
+		if !Can(c, perm) {
+			return c.Status(403).JSON(fiber.Map{"error": fmt.Sprintf("missing permission %s", perm)})
+		}
+		return c.Next()
+	}
+}
+
+func canAny(c fiber.Ctx, perms []auth.Permission) bool {
+	for _, perm := range perms {
+		if Can(c, perm) {
+			return true
+		}
+	}
+	return false
+}
+
+func BindParam(name string, override ...auth.Permission) fiber.Handler {
+	return func(c fiber.Ctx) error {
+		if canAny(c, override) {
+			return c.Next()
+		}
+		if c.Params(name) != Subject(c) {
+			return forbidden(c, name)
+		}
+		return c.Next()
+	}
+}
+
+// BindBody requires the body's field to be the authenticated member. Handlers
+// bind with encoding/json, which matches keys case-insensitively and keeps
+// the last of repeated keys, so every key that would bind to the field has
+// to match, and a body without one is refused.
+func BindBody(field string, override ...auth.Permission) fiber.Handler {
+	return func(c fiber.Ctx) error {
+		if canAny(c, override) {
+			return c.Next()
+		}
+
+		var body map[string]json.RawMessage
+		if err := json.Unmarshal(c.Body(), &body); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "invalid json body"})
+		}
+
+		found := false
+		for key, raw := range body {
+			if !strings.EqualFold(key, field) {
+				continue
+			}
+			var value string
+			if err := json.Unmarshal(raw, &value); err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("%s must be a string", field)})
+			}
+			if value != Subject(c) {
+				return forbidden(c, field)
+			}
+			found = true
+		}
+		if !found {
+			return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("%s is required", field)})
+		}
+		return c.Next()
+	}
+}
+
+func forbidden(c fiber.Ctx, field string) error {
+	return c.Status(403).JSON(fiber.Map{"error": fmt.Sprintf("%s does not match the authenticated member", field)})
+}
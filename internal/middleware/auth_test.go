@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/zensos/microservice-project/internal/auth"
+)
+
+func testApp(role auth.Role, subject string, handlers ...any) *fiber.App {
+	app := fiber.New()
+	app.Use(func(c fiber.Ctx) error {
+		c.Locals(claimsKey, &auth.Claims{
+			Role:             role,
+			RegisteredClaims: jwt.RegisteredClaims{Subject: subject},
+		})
+		return c.Next()
+	})
+	app.Post("/", handlers[0], handlers[1:]...)
+	return app
+}
+
+func ok(c fiber.Ctx) error {
+	return c.SendStatus(200)
+}
+
+func TestBindBody(t *testing.T) {
+	tests := []struct {
+		name string
+		role auth.Role
+		body string
+		want int
+	}{
+		{"own member_id", auth.RoleMember, `{"member_id":"me"}`, 200},
+		{"other member_id", auth.RoleMember, `{"member_id":"victim"}`, 403},
+		{"case variant key", auth.RoleMember, `{"Member_ID":"victim"}`, 403},
+		{"own key then case variant", auth.RoleMember, `{"member_id":"me","MEMBER_ID":"victim"}`, 403},
+		{"repeated key", auth.RoleMember, `{"member_id":"me","member_id":"victim"}`, 403},
+		{"lookalike key", auth.RoleMember, `{"member_id":"me","member_ıd":"victim"}`, 200},
+		{"missing", auth.RoleMember, `{"to_member_id":"victim"}`, 400},
+		{"empty", auth.RoleMember, `{"member_id":""}`, 403},
+		{"not a string", auth.RoleMember, `{"member_id":123}`, 400},
+		{"invalid json", auth.RoleMember, `{`, 400},
+		{"override", auth.RoleService, `{"member_id":"victim"}`, 200},
+		{"override without field", auth.RoleService, `{}`, 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := testApp(tt.role, "me", BindBody("member_id", auth.PermPaymentsActAny), ok)
+
+			req := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+// TestBindBodyMatchesDecoder checks that every body BindBody lets through
+// binds to the authenticated member, whatever the handler's decoder makes
+// of the keys.
+func TestBindBodyMatchesDecoder(t *testing.T) {
+	bodies := []string{
+		`{"member_id":"me"}`,
+		`{"Member_ID":"me"}`,
+		`{"member_id":"me","MEMBER_ID":"victim"}`,
+		`{"MEMBER_ID":"victim","member_id":"me"}`,
+		`{"member_id":"victim","member_id":"me"}`,
+		`{"member_id":"me","member_ıd":"victim"}`,
+	}
+
+	for _, body := range bodies {
+		var bound struct {
+			MemberID string `json:"member_id"`
+		}
+		app := testApp(auth.RoleMember, "me", BindBody("member_id"), func(c fiber.Ctx) error {
+			if err := c.Bind().JSON(&bound); err != nil {
+				return err
+			}
+			return c.SendStatus(200)
+		})
+
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode == 200 && bound.MemberID != "me" {
+			t.Errorf("%s: let through a body that binds to %q", body, bound.MemberID)
+		}
+	}
+}
+
+func TestBindParam(t *testing.T) {
+	tests := []struct {
+		name string
+		role auth.Role
+		path string
+		want int
+	}{
+		{"own", auth.RoleMember, "/wallets/me", 200},
+		{"other", auth.RoleMember, "/wallets/victim", 403},
+		{"override", auth.RoleAdmin, "/wallets/victim", 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Use(func(c fiber.Ctx) error {
+				c.Locals(claimsKey, &auth.Claims{Role: tt.role, RegisteredClaims: jwt.RegisteredClaims{Subject: "me"}})
+				return c.Next()
+			})
+			app.Get("/wallets/:member_id", BindParam("member_id", auth.PermWalletsReadAny), ok)
+
+			resp, err := app.Test(httptest.NewRequest("GET", tt.path, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
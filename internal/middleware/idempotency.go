@@ -0,0 +1,159 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	IdempotencyHeader = "Idempotency-Key"
+
+	idempotencyInProgress = "in_progress"
+	idempotencyCompleted  = "completed"
+)
+
+type IdempotencyRecord struct {
+	ID             uint   `gorm:"primaryKey"`
+	IdempotencyKey string `gorm:"uniqueIndex:idx_idempotency_scope_key"`
+	Scope          string `gorm:"uniqueIndex:idx_idempotency_scope_key"`
+	Fingerprint    string
+	Status         string
+	ResponseStatus int
+	ResponseBody   []byte
+	ContentType    string
+	ExpiresAt      time.Time `gorm:"index"`
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+type IdempotencyConfig struct {
+	DB         *gorm.DB
+	TTL        time.Duration
+	StaleAfter time.Duration
+}
+
+// Idempotency replays the stored response when a request is retried with the
+// same Idempotency-Key header. Keys are scoped to the route and the caller,
+// and reusing one with a different body is rejected with 422. Server errors
+// aren't stored so the client can retry them, and neither are 202 responses,
+// which only say the work is still in flight.
+func Idempotency(cfg IdempotencyConfig) fiber.Handler {
+	if cfg.TTL == 0 {
+		cfg.TTL = 24 * time.Hour
+	}
+	if cfg.StaleAfter == 0 {
+		cfg.StaleAfter = 5 * time.Minute
+	}
+
+	go func() {
+		for {
+			time.Sleep(time.Hour)
+			if err := cfg.DB.Where("expires_at < ?", time.Now()).Delete(&IdempotencyRecord{}).Error; err != nil {
+				log.Printf("couldn't purge idempotency records: %v", err)
+			}
+		}
+	}()
+
+	return func(c fiber.Ctx) error {
+		key := c.Get(IdempotencyHeader)
+		if key == "" {
+			return c.Next()
+		}
+		if len(key) > 255 {
+			return c.Status(400).JSON(fiber.Map{"error": "Idempotency-Key must be at most 255 characters"})
+		}
+
+		scope := c.Method() + " " + c.Path() + " " + Subject(c)
+		sum := sha256.Sum256(append([]byte(c.Method()+" "+c.Path()+"\n"), c.Body()...))
+		fingerprint := hex.EncodeToString(sum[:])
+
+		record, owned, err := claimIdempotencyKey(cfg, key, scope, fingerprint)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "failed to check Idempotency-Key"})
+		}
+
+		if !owned {
+			if record.Fingerprint != fingerprint {
+				return c.Status(422).JSON(fiber.Map{"error": "Idempotency-Key was already used with a different request"})
+			}
+			if record.Status != idempotencyCompleted {
+				return c.Status(409).JSON(fiber.Map{"error": "a request with this Idempotency-Key is still being processed"})
+			}
+
+			c.Set("Idempotent-Replayed", "true")
+			if record.ContentType != "" {
+				c.Set(fiber.HeaderContentType, record.ContentType)
+			}
+			return c.Status(record.ResponseStatus).Send(record.ResponseBody)
+		}
+
+		if err := c.Next(); err != nil {
+			cfg.DB.Delete(&record)
+			return err
+		}
+
+		status := c.Response().StatusCode()
+		if status >= 500 || status == fiber.StatusAccepted {
+			cfg.DB.Delete(&record)
+			return nil
+		}
+
+		if err := cfg.DB.Model(&record).Updates(map[string]any{
+			"status":          idempotencyCompleted,
+			"response_status": status,
+			"response_body":   append([]byte(nil), c.Response().Body()...),
+			"content_type":    string(c.Response().Header.ContentType()),
+		}).Error; err != nil {
+			log.Printf("couldn't store response for Idempotency-Key %s: %v", key, err)
+		}
+
+		return nil
+	}
+}
+
+// claimIdempotencyKey inserts an in-progress record for the key, or returns
+// the existing one. Expired records and in-progress records abandoned by a
+// crashed request are taken over.
+func claimIdempotencyKey(cfg IdempotencyConfig, key, scope, fingerprint string) (IdempotencyRecord, bool, error) {
+	for range 2 {
+		record := IdempotencyRecord{
+			IdempotencyKey: key,
+			Scope:          scope,
+			Fingerprint:    fingerprint,
+			Status:         idempotencyInProgress,
+			ExpiresAt:      time.Now().Add(cfg.TTL),
+		}
+
+		result := cfg.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+		if result.Error != nil {
+			return record, false, result.Error
+		}
+		if result.RowsAffected == 1 {
+			return record, true, nil
+		}
+
+		var existing IdempotencyRecord
+		if err := cfg.DB.Where("idempotency_key = ? AND scope = ?", key, scope).First(&existing).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				continue
+			}
+			return existing, false, err
+		}
+
+		abandoned := existing.Status == idempotencyInProgress && time.Since(existing.UpdatedAt) > cfg.StaleAfter
+		if !time.Now().After(existing.ExpiresAt) && !abandoned {
+			return existing, false, nil
+		}
+
+		cfg.DB.Where("id = ? AND updated_at = ?", existing.ID, existing.UpdatedAt).Delete(&IdempotencyRecord{})
+	}
+
+	return IdempotencyRecord{}, false, errors.New("couldn't claim Idempotency-Key")
+}
@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/gofiber/fiber/v3"
+	"github.com/zensos/microservice-project/internal/auth"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestIdempotencyStoredResponses(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		wantCalls  int
+		wantReplay bool
+	}{
+		{"created is replayed", 201, 1, true},
+		{"client error is replayed", 400, 1, true},
+		{"accepted runs again", 202, 2, false},
+		{"server error runs again", 500, 2, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: logger.Discard})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.AutoMigrate(&IdempotencyRecord{}); err != nil {
+				t.Fatal(err)
+			}
+
+			calls := 0
+			app := testApp(auth.RoleMember, "me", Idempotency(IdempotencyConfig{DB: db}), func(c fiber.Ctx) error {
+				calls++
+				return c.SendStatus(tt.status)
+			})
+
+			var replayed string
+			for range 2 {
+				req := httptest.NewRequest("POST", "/", strings.NewReader(`{}`))
+				req.Header.Set(IdempotencyHeader, "key-1")
+				resp, err := app.Test(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if resp.StatusCode != tt.status {
+					t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+				}
+				replayed = resp.Header.Get("Idempotent-Replayed")
+			}
+
+			if calls != tt.wantCalls {
+				t.Errorf("handler ran %d times, want %d", calls, tt.wantCalls)
+			}
+			if (replayed == "true") != tt.wantReplay {
+				t.Errorf("Idempotent-Replayed = %q, want replay %v", replayed, tt.wantReplay)
+			}
+		})
+	}
+}
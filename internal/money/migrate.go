@@ -0,0 +1,36 @@
+package money
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// MigrateFloatColumn moves a legacy float column into the <column>_minor and
+// <column>_currency columns of an embedded Money field, then drops it. It
+// goes through numeric so values like 150.1 become exactly 15010. Run it
+// after AutoMigrate has added the new columns; it is a no-op once the old
+// column is gone.
+func MigrateFloatColumn(db *gorm.DB, table, column, currency string) error {
+	if !db.Migrator().HasColumn(table, column) {
+		return nil
+	}
+
+	currency = normalize(currency)
+	scale := 1
+	for range Exponent(currency) {
+		scale *= 10
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec(fmt.Sprintf(
+			`UPDATE %q SET %q = ROUND(%q::numeric * %d)::bigint, %q = ? WHERE %q IS NOT NULL`,
+			table, column+"_minor", column, scale, column+"_currency", column,
+		), currency).Error
+		if err != nil {
+			return fmt.Errorf("couldn't convert %s.%s: %w", table, column, err)
+		}
+
+		return tx.Migrator().DropColumn(table, column)
+	})
+}
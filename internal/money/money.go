@@ -0,0 +1,275 @@
+package money
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+const DefaultCurrency = "THB"
+
+var (
+	ErrInvalidAmount    = errors.New("invalid money amount")
+	ErrInvalidCurrency  = errors.New("currency must be a 3 letter ISO 4217 code")
+	ErrCurrencyMismatch = errors.New("currency mismatch")
+)
+
+var exponents = map[string]int{
+	"THB": 2,
+	"USD": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"SGD": 2,
+	"JPY": 0,
+	"KRW": 0,
+	"VND": 0,
+}
+
+// Money is an exact amount in the currency's minor unit (satang for THB).
+// Embed it in models with an embeddedPrefix so it maps to <prefix>minor and
+// <prefix>currency columns.
+type Money struct {
+	Minor    int64  `gorm:"not null;default:0"`
+	Currency string `gorm:"size:3;not null;default:THB"`
+}
+
+func New(minor int64, currency string) Money {
+	return Money{Minor: minor, Currency: normalize(currency)}
+}
+
+func Zero(currency string) Money {
+	return New(0, currency)
+}
+
+func Exponent(currency string) int {
+	if exp, ok := exponents[normalize(currency)]; ok {
+		return exp
+	}
+	return 2
+}
+
+func normalize(currency string) string {
+	if currency == "" {
+		return DefaultCurrency
+	}
+	return strings.ToUpper(currency)
+}
+
+// validCurrency reports whether a normalized currency looks like an ISO
+// 4217 code, which is all the currency columns can hold.
+func validCurrency(currency string) bool {
+	if len(currency) != 3 {
+		return false
+	}
+	for i := 0; i < len(currency); i++ {
+		if currency[i] < 'A' || currency[i] > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse reads a decimal string such as "150.25" without going through
+// float64. More fractional digits than the currency allows is an error.
+func Parse(amount, currency string) (Money, error) {
+	currency = normalize(currency)
+	if !validCurrency(currency) {
+		return Money{}, ErrInvalidCurrency
+	}
+	exp := Exponent(currency)
+
+	amount = strings.TrimSpace(amount)
+	neg := strings.HasPrefix(amount, "-")
+	amount = strings.TrimPrefix(strings.TrimPrefix(amount, "-"), "+")
+
+	whole, frac, _ := strings.Cut(amount, ".")
+	if whole == "" && frac == "" {
+		return Money{}, ErrInvalidAmount
+	}
+	frac = strings.TrimRight(frac, "0")
+	if len(frac) > exp {
+		return Money{}, fmt.Errorf("%w: %s allows %d decimal places", ErrInvalidAmount, currency, exp)
+	}
+	frac += strings.Repeat("0", exp-len(frac))
+
+	digits := whole + frac
+	if digits == "" {
+		digits = "0"
+	}
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return Money{}, ErrInvalidAmount
+		}
+	}
+
+	minor, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return Money{}, ErrInvalidAmount
+	}
+	if neg {
+		minor = -minor
+	}
+
+	return Money{Minor: minor, Currency: currency}, nil
+}
+
+func (m Money) String() string {
+	exp := Exponent(m.Currency)
+	minor := m.Minor
+
+	sign := ""
+	if minor < 0 {
+		sign = "-"
+		minor = -minor
+	}
+
+	digits := strconv.FormatInt(minor, 10)
+	if exp == 0 {
+		return sign + digits
+	}
+	if len(digits) <= exp {
+		digits = strings.Repeat("0", exp-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-exp] + "." + digits[len(digits)-exp:]
+}
+
+func (m Money) SameCurrency(o Money) bool {
+	return normalize(m.Currency) == normalize(o.Currency)
+}
+
+func (m Money) mustMatch(o Money) {
+	if !m.SameCurrency(o) {
+		panic(fmt.Sprintf("money: %s and %s can't be combined", normalize(m.Currency), normalize(o.Currency)))
+	}
+}
+
+// Add and Sub panic on mismatched currencies; inputs are checked with
+// SameCurrency where they enter the system.
+func (m Money) Add(o Money) Money {
+	m.mustMatch(o)
+	return Money{Minor: m.Minor + o.Minor, Currency: normalize(m.Currency)}
+}
+
+func (m Money) Sub(o Money) Money {
+	m.mustMatch(o)
+	return Money{Minor: m.Minor - o.Minor, Currency: normalize(m.Currency)}
+}
+
+func (m Money) Mul(n int64) Money {
+	return Money{Minor: m.Minor * n, Currency: normalize(m.Currency)}
+}
+
+func (m Money) Neg() Money {
+	return Money{Minor: -m.Minor, Currency: normalize(m.Currency)}
+}
+
+func (m Money) Cmp(o Money) int {
+	m.mustMatch(o)
+	switch {
+	case m.Minor < o.Minor:
+		return -1
+	case m.Minor > o.Minor:
+		return 1
+	}
+	return 0
+}
+
+func (m Money) IsZero() bool     { return m.Minor == 0 }
+func (m Money) IsPositive() bool { return m.Minor > 0 }
+func (m Money) IsNegative() bool { return m.Minor < 0 }
+
+// Allocate splits m in proportion to weights without losing a minor unit:
+// leftovers from rounding go to the first shares.
+func (m Money) Allocate(weights ...int64) []Money {
+	var total int64
+	for _, w := range weights {
+		total += w
+	}
+
+	shares := make([]Money, len(weights))
+	if total == 0 {
+		for i := range shares {
+			shares[i] = Zero(m.Currency)
+		}
+		return shares
+	}
+
+	remainder := m.Minor
+	for i, w := range weights {
+		share := new(big.Int).Mul(big.NewInt(m.Minor), big.NewInt(w))
+		share.Quo(share, big.NewInt(total))
+		shares[i] = Money{Minor: share.Int64(), Currency: normalize(m.Currency)}
+		remainder -= share.Int64()
+	}
+
+	step := int64(1)
+	if remainder < 0 {
+		step = -1
+	}
+	for i := 0; remainder != 0; i = (i + 1) % len(shares) {
+		if weights[i] == 0 {
+			continue
+		}
+		shares[i].Minor += step
+		remainder -= step
+	}
+
+	return shares
+}
+
+type jsonMoney struct {
+	Amount   json.Number `json:"amount"`
+	Currency string      `json:"currency"`
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Amount   string `json:"amount"`
+		Currency string `json:"currency"`
+	}{m.String(), normalize(m.Currency)})
+}
+
+// UnmarshalJSON accepts {"amount": "150.00", "currency": "THB"} as well as a
+// bare number or string, which is read in the default currency.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		*m = Money{}
+		return nil
+	}
+
+	var v jsonMoney
+	if len(data) > 0 && data[0] == '{' {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			return err
+		}
+	} else {
+		var raw any
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		switch r := raw.(type) {
+		case json.Number:
+			v.Amount = r
+		case string:
+			v.Amount = json.Number(r)
+		default:
+			return ErrInvalidAmount
+		}
+	}
+
+	parsed, err := Parse(v.Amount.String(), v.Currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
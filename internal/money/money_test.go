@@ -0,0 +1,180 @@
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		amount, currency string
+		want             Money
+		err              error
+	}{
+		{"150.25", "THB", New(15025, "THB"), nil},
+		{"150", "", New(15000, "THB"), nil},
+		{"0.5", "thb", New(50, "THB"), nil},
+		{".5", "THB", New(50, "THB"), nil},
+		{"5.", "THB", New(500, "THB"), nil},
+		{"-1.01", "USD", New(-101, "USD"), nil},
+		{"+1", "USD", New(100, "USD"), nil},
+		{"1.2300", "THB", New(123, "THB"), nil},
+		{" 7 ", "JPY", New(7, "JPY"), nil},
+		{"1.5", "JPY", Money{}, ErrInvalidAmount},
+		{"1.001", "THB", Money{}, ErrInvalidAmount},
+		{"", "THB", Money{}, ErrInvalidAmount},
+		{".", "THB", Money{}, ErrInvalidAmount},
+		{"1e3", "THB", Money{}, ErrInvalidAmount},
+		{"1.2.3", "THB", Money{}, ErrInvalidAmount},
+		{"--1", "THB", Money{}, ErrInvalidAmount},
+		{"99999999999999999999", "THB", Money{}, ErrInvalidAmount},
+		{"1", "BAHT", Money{}, ErrInvalidCurrency},
+		{"1", "TH", Money{}, ErrInvalidCurrency},
+		{"1", "T1B", Money{}, ErrInvalidCurrency},
+		{"1", "฿฿฿", Money{}, ErrInvalidCurrency},
+	}
+
+	for _, tt := range tests {
+		got, err := Parse(tt.amount, tt.currency)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("Parse(%q, %q) error = %v, want %v", tt.amount, tt.currency, err, tt.err)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("Parse(%q, %q) = %+v, want %+v", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{New(15025, "THB"), "150.25"},
+		{New(5, "THB"), "0.05"},
+		{New(-5, "THB"), "-0.05"},
+		{New(0, "THB"), "0.00"},
+		{New(-12000, "USD"), "-120.00"},
+		{New(1500, "JPY"), "1500"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.m.String(); got != tt.want {
+			t.Errorf("%+v.String() = %q, want %q", tt.m, got, tt.want)
+		}
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	a, b := New(1050, "THB"), New(250, "thb")
+
+	if got := a.Add(b); got != New(1300, "THB") {
+		t.Errorf("Add = %+v", got)
+	}
+	if got := a.Sub(b); got != New(800, "THB") {
+		t.Errorf("Sub = %+v", got)
+	}
+	if got := b.Mul(3); got != New(750, "THB") {
+		t.Errorf("Mul = %+v", got)
+	}
+	if got := a.Neg(); got != New(-1050, "THB") {
+		t.Errorf("Neg = %+v", got)
+	}
+	if a.Cmp(b) != 1 || b.Cmp(a) != -1 || a.Cmp(a) != 0 {
+		t.Error("Cmp is wrong")
+	}
+	if !Zero("").SameCurrency(New(1, "THB")) {
+		t.Error("an empty currency should be the default currency")
+	}
+}
+
+func TestMismatchedCurrenciesPanic(t *testing.T) {
+	ops := map[string]func(a, b Money){
+		"Add": func(a, b Money) { a.Add(b) },
+		"Sub": func(a, b Money) { a.Sub(b) },
+		"Cmp": func(a, b Money) { a.Cmp(b) },
+	}
+
+	for name, op := range ops {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s didn't panic on THB and USD", name)
+				}
+			}()
+			op(New(1, "THB"), New(1, "USD"))
+		})
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		m       Money
+		weights []int64
+		want    []int64
+	}{
+		{New(100, "THB"), []int64{1, 1, 1}, []int64{34, 33, 33}},
+		{New(-100, "THB"), []int64{1, 1, 1}, []int64{-34, -33, -33}},
+		{New(1000, "THB"), []int64{1, 3}, []int64{250, 750}},
+		{New(5, "THB"), []int64{0, 1, 1}, []int64{0, 3, 2}},
+		{New(100, "THB"), []int64{0, 0}, []int64{0, 0}},
+		{New(1, "JPY"), []int64{1, 1}, []int64{1, 0}},
+	}
+
+	for _, tt := range tests {
+		shares := tt.m.Allocate(tt.weights...)
+		sum := Zero(tt.m.Currency)
+		for i, share := range shares {
+			if share.Minor != tt.want[i] {
+				t.Errorf("%s.Allocate(%v) = %v, want %v", tt.m, tt.weights, shares, tt.want)
+				break
+			}
+			sum = sum.Add(share)
+		}
+		if slices.ContainsFunc(tt.weights, func(w int64) bool { return w > 0 }) && sum != tt.m {
+			t.Errorf("%s.Allocate(%v) adds up to %s", tt.m, tt.weights, sum)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Money
+		err  bool
+	}{
+		{`{"amount":"150.25","currency":"THB"}`, New(15025, "THB"), false},
+		{`{"amount":150.25,"currency":"usd"}`, New(15025, "USD"), false},
+		{`{"amount":"1"}`, New(100, "THB"), false},
+		{`"99.99"`, New(9999, "THB"), false},
+		{`12`, New(1200, "THB"), false},
+		{`null`, Money{}, false},
+		{`{"amount":"1","currency":"THBX"}`, Money{}, true},
+		{`{"amount":"1","currency":"12"}`, Money{}, true},
+		{`{"amount":"0.001","currency":"THB"}`, Money{}, true},
+		{`true`, Money{}, true},
+	}
+
+	for _, tt := range tests {
+		var got Money
+		err := json.Unmarshal([]byte(tt.in), &got)
+		if (err != nil) != tt.err {
+			t.Errorf("Unmarshal(%s) error = %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Unmarshal(%s) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+
+	out, err := json.Marshal(New(-15025, "thb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != `{"amount":"-150.25","currency":"THB"}` {
+		t.Errorf("Marshal = %s", out)
+	}
+}
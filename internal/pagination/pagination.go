@@ -0,0 +1,259 @@
+package pagination
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultLimit = 20
+	MaxLimit     = 100
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+type KeyType int
+
+const (
+	KeyString KeyType = iota
+	KeyInt
+	KeyTime
+)
+
+// Sort is one way a list can be ordered. Column is the SQL expression the
+// keyset is built on; ties are broken by IDColumn so every row has a stable
+// position.
+type Sort struct {
+	Name     string
+	Column   string
+	IDColumn string
+	Type     KeyType
+	Desc     bool
+}
+
+// Sorts maps the values of the ?sort= parameter, e.g. "date" and "-date", to
+// their Sort.
+type Sorts map[string]Sort
+
+// Add registers name for ascending order and -name for descending order.
+func (s Sorts) Add(name, column string, keyType KeyType) Sorts {
+	s[name] = Sort{Name: name, Column: column, IDColumn: "id", Type: keyType}
+	s["-"+name] = Sort{Name: "-" + name, Column: column, IDColumn: "id", Type: keyType, Desc: true}
+	return s
+}
+
+type Cursor struct {
+	Sort  string `json:"s"`
+	Value any    `json:"v"`
+	ID    uint   `json:"id"`
+}
+
+type Params struct {
+	Limit  int
+	Sort   Sort
+	Cursor *Cursor
+}
+
+type PageInfo struct {
+	Limit      int    `json:"limit"`
+	Sort       string `json:"sort"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	HasMore    bool   `json:"has_more"`
+}
+
+// Page is the response envelope shared by list endpoints.
+type Page[T any] struct {
+	Data []T      `json:"data"`
+	Page PageInfo `json:"page"`
+}
+
+// Parse reads ?limit=, ?sort= and ?cursor=. A cursor only continues the sort
+// it was issued for.
+func Parse(c fiber.Ctx, sorts Sorts, defaultSort string) (Params, error) {
+	p := Params{Limit: DefaultLimit}
+
+	if raw := c.Query("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 {
+			return p, errors.New("limit must be a positive number")
+		}
+		p.Limit = min(limit, MaxLimit)
+	}
+
+	name := c.Query("sort", defaultSort)
+	sort, ok := sorts[name]
+	if !ok {
+		return p, fmt.Errorf("sort must be one of: %s", strings.Join(sortNames(sorts), ", "))
+	}
+	p.Sort = sort
+
+	if raw := c.Query("cursor"); raw != "" {
+		cursor, err := decodeCursor(raw, sort)
+		if err != nil {
+			return p, err
+		}
+		p.Cursor = &cursor
+	}
+
+	return p, nil
+}
+
+func sortNames(sorts Sorts) []string {
+	names := make([]string, 0, len(sorts))
+	for name := range sorts {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Apply orders the query and, when continuing from a cursor, skips to the
+// rows after it. It fetches one row more than the limit so NewPage can tell
+// whether there is another page.
+func Apply(query *gorm.DB, p Params) *gorm.DB {
+	dir, cmp := "ASC", ">"
+	if p.Sort.Desc {
+		dir, cmp = "DESC", "<"
+	}
+
+	if p.Cursor != nil {
+		query = query.Where(fmt.Sprintf("(%s, %s) %s (?, ?)", p.Sort.Column, p.Sort.IDColumn, cmp), p.Cursor.Value, p.Cursor.ID)
+	}
+
+	return query.
+		Order(fmt.Sprintf("%s %s, %s %s", p.Sort.Column, dir, p.Sort.IDColumn, dir)).
+		Limit(p.Limit + 1)
+}
+
+// NewPage trims the extra row fetched by Apply and builds the cursor for the
+// next page from the last row that is returned. key returns a row's sort
+// value and ID.
+func NewPage[T any](rows []T, p Params, key func(T) (any, uint)) Page[T] {
+	page := Page[T]{
+		Data: rows,
+		Page: PageInfo{Limit: p.Limit, Sort: p.Sort.Name},
+	}
+	if page.Data == nil {
+		page.Data = []T{}
+	}
+
+	if len(rows) > p.Limit {
+		page.Data = rows[:p.Limit]
+		value, id := key(page.Data[p.Limit-1])
+		page.Page.HasMore = true
+		page.Page.NextCursor = encodeCursor(Cursor{Sort: p.Sort.Name, Value: value, ID: id})
+	}
+
+	return page
+}
+
+func encodeCursor(cursor Cursor) string {
+	if t, ok := cursor.Value.(time.Time); ok {
+		cursor.Value = t.UTC().Format(time.RFC3339Nano)
+	}
+	raw, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(raw string, sort Sort) (Cursor, error) {
+	var cursor Cursor
+
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return cursor, ErrInvalidCursor
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&cursor); err != nil {
+		return cursor, ErrInvalidCursor
+	}
+	if cursor.Sort != sort.Name {
+		return cursor, fmt.Errorf("%w: it belongs to sort %q", ErrInvalidCursor, cursor.Sort)
+	}
+
+	switch sort.Type {
+	case KeyInt:
+		n, ok := cursor.Value.(json.Number)
+		if !ok {
+			return cursor, ErrInvalidCursor
+		}
+		v, err := n.Int64()
+		if err != nil {
+			return cursor, ErrInvalidCursor
+		}
+		cursor.Value = v
+	case KeyTime:
+		s, ok := cursor.Value.(string)
+		if !ok {
+			return cursor, ErrInvalidCursor
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return cursor, ErrInvalidCursor
+		}
+		cursor.Value = t
+	default:
+		if _, ok := cursor.Value.(string); !ok {
+			return cursor, ErrInvalidCursor
+		}
+	}
+
+	return cursor, nil
+}
+
+// TimeRange is a ?from=&to= filter. To is exclusive.
+type TimeRange struct {
+	From *time.Time
+	To   *time.Time
+}
+
+// ParseTimeRange accepts RFC 3339 times or plain dates. A plain ?to= date
+// includes the whole day.
+func ParseTimeRange(c fiber.Ctx) (TimeRange, error) {
+	var r TimeRange
+	for _, param := range []string{"from", "to"} {
+		raw := c.Query(param)
+		if raw == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			if t, err = time.Parse(time.DateOnly, raw); err != nil {
+				return r, fmt.Errorf("%s must be a date (2006-01-02) or RFC 3339 time", param)
+			}
+			if param == "to" {
+				t = t.AddDate(0, 0, 1)
+			}
+		}
+		if param == "from" {
+			r.From = &t
+		} else {
+			r.To = &t
+		}
+	}
+	if r.From != nil && r.To != nil && !r.From.Before(*r.To) {
+		return r, errors.New("from must be before to")
+	}
+	return r, nil
+}
+
+// Where limits query to column values within the range.
+func (r TimeRange) Where(query *gorm.DB, column string) *gorm.DB {
+	if r.From != nil {
+		query = query.Where(column+" >= ?", *r.From)
+	}
+	if r.To != nil {
+		query = query.Where(column+" < ?", *r.To)
+	}
+	return query
+}
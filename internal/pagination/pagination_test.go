@@ -0,0 +1,289 @@
+package pagination
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/gofiber/fiber/v3"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+type item struct {
+	ID        uint `gorm:"primaryKey"`
+	Name      string
+	Score     int
+	CreatedAt time.Time
+}
+
+var testSorts = Sorts{}.
+	Add("name", "name", KeyString).
+	Add("score", "score", KeyInt).
+	Add("created", "created_at", KeyTime)
+
+func itemKey(sort string) func(item) (any, uint) {
+	return func(it item) (any, uint) {
+		switch sort {
+		case "score", "-score":
+			return it.Score, it.ID
+		case "created", "-created":
+			return it.CreatedAt, it.ID
+		}
+		return it.Name, it.ID
+	}
+}
+
+// parse runs Parse against a request with the given query string.
+func parse(t *testing.T, query string) (Params, error) {
+	t.Helper()
+	var p Params
+	var perr error
+	app := fiber.New()
+	app.Get("/", func(c fiber.Ctx) error {
+		p, perr = Parse(c, testSorts, "name")
+		return nil
+	})
+	if _, err := app.Test(httptest.NewRequest("GET", "/?"+query, nil)); err != nil {
+		t.Fatal(err)
+	}
+	return p, perr
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	at := time.Date(2026, 3, 1, 12, 30, 0, 123456789, time.FixedZone("ICT", 7*3600))
+
+	tests := []struct {
+		name  string
+		sort  string
+		value any
+		want  any
+	}{
+		{"string", "name", "b", "b"},
+		{"int", "-score", 42, int64(42)},
+		{"large int", "score", int64(1) << 53, int64(1) << 53},
+		{"time", "created", at, at.UTC()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := encodeCursor(Cursor{Sort: tt.sort, Value: tt.value, ID: 7})
+			cursor, err := decodeCursor(raw, testSorts[tt.sort])
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if cursor.ID != 7 {
+				t.Errorf("ID = %d, want 7", cursor.ID)
+			}
+			if want, ok := tt.want.(time.Time); ok {
+				if got, _ := cursor.Value.(time.Time); !got.Equal(want) {
+					t.Errorf("Value = %v, want %v", cursor.Value, want)
+				}
+				return
+			}
+			if cursor.Value != tt.want {
+				t.Errorf("Value = %#v, want %#v", cursor.Value, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCursorRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		sort string
+	}{
+		{"not base64", "!!!", "name"},
+		{"not json", base64.RawURLEncoding.EncodeToString([]byte("nope")), "name"},
+		{"other sort", encodeCursor(Cursor{Sort: "name", Value: "a", ID: 1}), "-name"},
+		{"int cursor for string sort", encodeCursor(Cursor{Sort: "name", Value: 3, ID: 1}), "name"},
+		{"string cursor for int sort", encodeCursor(Cursor{Sort: "score", Value: "3", ID: 1}), "score"},
+		{"fractional int", encodeCursor(Cursor{Sort: "score", Value: 1.5, ID: 1}), "score"},
+		{"bad time", encodeCursor(Cursor{Sort: "created", Value: "yesterday", ID: 1}), "created"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeCursor(tt.raw, testSorts[tt.sort]); !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("got %v, want ErrInvalidCursor", err)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		wantLimit int
+		wantSort  string
+		wantErr   bool
+	}{
+		{"defaults", "", DefaultLimit, "name", false},
+		{"limit capped", "limit=1000", MaxLimit, "name", false},
+		{"zero limit", "limit=0", 0, "", true},
+		{"bad limit", "limit=ten", 0, "", true},
+		{"descending", "sort=-score", DefaultLimit, "-score", false},
+		{"unknown sort", "sort=price", 0, "", true},
+		{"cursor for its sort", "sort=score&cursor=" + encodeCursor(Cursor{Sort: "score", Value: 1, ID: 1}), DefaultLimit, "score", false},
+		{"cursor for another sort", "sort=-score&cursor=" + encodeCursor(Cursor{Sort: "score", Value: 1, ID: 1}), 0, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := parse(t, tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if p.Limit != tt.wantLimit || p.Sort.Name != tt.wantSort {
+				t.Errorf("Parse() = limit %d sort %q, want limit %d sort %q", p.Limit, p.Sort.Name, tt.wantLimit, tt.wantSort)
+			}
+		})
+	}
+}
+
+// TestApply walks every sort page by page. Several rows share a sort value,
+// so pages only line up when ties are broken by ID.
+func TestApply(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&item{}); err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	items := []item{
+		{Name: "b", Score: 2, CreatedAt: base},
+		{Name: "a", Score: 1, CreatedAt: base.Add(time.Hour)},
+		{Name: "b", Score: 2, CreatedAt: base},
+		{Name: "c", Score: 1, CreatedAt: base.Add(time.Hour)},
+		{Name: "a", Score: 3, CreatedAt: base.Add(2 * time.Hour)},
+		{Name: "b", Score: 2, CreatedAt: base},
+		{Name: "c", Score: 3, CreatedAt: base.Add(time.Hour)},
+	}
+	if err := db.Create(&items).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		sort    string
+		wantIDs []uint
+	}{
+		{"name", []uint{2, 5, 1, 3, 6, 4, 7}},
+		{"-name", []uint{7, 4, 6, 3, 1, 5, 2}},
+		{"score", []uint{2, 4, 1, 3, 6, 5, 7}},
+		{"-score", []uint{7, 5, 6, 3, 1, 4, 2}},
+		{"created", []uint{1, 3, 6, 2, 4, 7, 5}},
+		{"-created", []uint{5, 7, 4, 2, 6, 3, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sort, func(t *testing.T) {
+			p := Params{Limit: 2, Sort: testSorts[tt.sort]}
+			var got []uint
+			for pages := 0; ; pages++ {
+				if pages > len(items) {
+					t.Fatal("pagination didn't finish")
+				}
+				var rows []item
+				if err := Apply(db.Model(&item{}), p).Find(&rows).Error; err != nil {
+					t.Fatal(err)
+				}
+				page := NewPage(rows, p, itemKey(tt.sort))
+				for _, row := range page.Data {
+					got = append(got, row.ID)
+				}
+				if !page.Page.HasMore {
+					break
+				}
+				cursor, err := decodeCursor(page.Page.NextCursor, p.Sort)
+				if err != nil {
+					t.Fatalf("decode next cursor: %v", err)
+				}
+				p.Cursor = &cursor
+			}
+
+			if len(got) != len(tt.wantIDs) {
+				t.Fatalf("got ids %v, want %v", got, tt.wantIDs)
+			}
+			for i := range got {
+				if got[i] != tt.wantIDs[i] {
+					t.Fatalf("got ids %v, want %v", got, tt.wantIDs)
+				}
+			}
+		})
+	}
+}
+
+func TestNewPageEmpty(t *testing.T) {
+	page := NewPage[item](nil, Params{Limit: 2, Sort: testSorts["name"]}, itemKey("name"))
+	if page.Data == nil || len(page.Data) != 0 || page.Page.HasMore || page.Page.NextCursor != "" {
+		t.Errorf("empty page = %+v", page)
+	}
+}
+
+func TestParseTimeRange(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 5, d, 0, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name     string
+		query    string
+		wantFrom *time.Time
+		wantTo   *time.Time
+		wantErr  bool
+	}{
+		{"none", "", nil, nil, false},
+		{"plain dates", "from=2026-05-01&to=2026-05-03", ptr(day(1)), ptr(day(4)), false},
+		{"plain to covers the whole day", "to=2026-05-01", nil, ptr(day(2)), false},
+		{"same plain day", "from=2026-05-01&to=2026-05-01", ptr(day(1)), ptr(day(2)), false},
+		{"rfc 3339 to is exact", "to=2026-05-01T00:00:00Z", nil, ptr(day(1)), false},
+		{"rfc 3339 range", "from=2026-05-01T10:00:00Z&to=2026-05-01T12:00:00Z", ptr(day(1).Add(10 * time.Hour)), ptr(day(1).Add(12 * time.Hour)), false},
+		{"from after to", "from=2026-05-03&to=2026-05-01", nil, nil, true},
+		{"equal rfc 3339 times", "from=2026-05-01T00:00:00Z&to=2026-05-01T00:00:00Z", nil, nil, true},
+		{"bad from", "from=yesterday", nil, nil, true},
+		{"bad to", "to=05/01/2026", nil, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r TimeRange
+			var rerr error
+			app := fiber.New()
+			app.Get("/", func(c fiber.Ctx) error {
+				r, rerr = ParseTimeRange(c)
+				return nil
+			})
+			if _, err := app.Test(httptest.NewRequest("GET", "/?"+tt.query, nil)); err != nil {
+				t.Fatal(err)
+			}
+
+			if (rerr != nil) != tt.wantErr {
+				t.Fatalf("ParseTimeRange() error = %v, wantErr %v", rerr, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !sameTime(r.From, tt.wantFrom) || !sameTime(r.To, tt.wantTo) {
+				t.Errorf("ParseTimeRange() = %v..%v, want %v..%v", r.From, r.To, tt.wantFrom, tt.wantTo)
+			}
+		})
+	}
+}
+
+func ptr(t time.Time) *time.Time { return &t }
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
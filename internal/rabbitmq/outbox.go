@@ -0,0 +1,177 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	OutboxPending = "pending"
+	OutboxSent    = "sent"
+)
+
+type OutboxMessage struct {
+	ID        uint   `gorm:"primaryKey"`
+	Queue     string `gorm:"index"`
+	Payload   []byte `gorm:"type:jsonb"`
+	Status    string `gorm:"index"`
+	Attempts  int
+	LastError string
+	CreatedAt time.Time
+	SentAt    *time.Time
+}
+
+// Enqueue records a message to be published once tx commits. Writing it in
+// the same transaction as the state change it describes means the message
+// is sent if and only if that change is persisted.
+func Enqueue(tx *gorm.DB, queue string, body []byte) error {
+	return tx.Create(&OutboxMessage{
+		Queue:   queue,
+		Payload: body,
+		Status:  OutboxPending,
+	}).Error
+}
+
+type RelayConfig struct {
+	Interval  time.Duration
+	BatchSize int
+	Timeout   time.Duration
+}
+
+// StartRelay publishes pending outbox rows with publisher confirms and marks
+// them sent once the broker acknowledges them. Rows are claimed with SKIP
+// LOCKED so several replicas can relay from the same table.
+func StartRelay(db *gorm.DB, conn *amqp.Connection, cfg RelayConfig) {
+	if cfg.Interval == 0 {
+		cfg.Interval = time.Second
+	}
+	if cfg.BatchSize == 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+
+	go func() {
+		var ch *amqp.Channel
+		declared := map[string]bool{}
+
+		for {
+			if ch == nil || ch.IsClosed() {
+				var err error
+				if ch, err = openConfirmChannel(conn); err != nil {
+					log.Printf("outbox relay couldn't open channel: %v", err)
+					time.Sleep(cfg.Interval)
+					continue
+				}
+				declared = map[string]bool{}
+			}
+
+			sent, err := relayBatch(db, ch, declared, cfg)
+			if err != nil {
+				log.Printf("outbox relay failed: %v", err)
+			}
+			if sent < cfg.BatchSize {
+				time.Sleep(cfg.Interval)
+			}
+		}
+	}()
+}
+
+func openConfirmChannel(conn *amqp.Connection) (*amqp.Channel, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("couldn't enable publisher confirms: %w", err)
+	}
+	return ch, nil
+}
+
+func relayBatch(db *gorm.DB, ch *amqp.Channel, declared map[string]bool, cfg RelayConfig) (int, error) {
+	sent := 0
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var messages []OutboxMessage
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ?", OutboxPending).
+			Order("id").Limit(cfg.BatchSize).Find(&messages).Error; err != nil {
+			return err
+		}
+
+		for _, msg := range messages {
+			err := publishConfirmed(ch, declared, msg, cfg.Timeout)
+			if err != nil {
+				tx.Model(&msg).Updates(map[string]any{
+					"attempts":   msg.Attempts + 1,
+					"last_error": err.Error(),
+				})
+				if ch.IsClosed() {
+					return nil
+				}
+				continue
+			}
+
+			now := time.Now()
+			if err := tx.Model(&msg).Updates(map[string]any{
+				"status":   OutboxSent,
+				"attempts": msg.Attempts + 1,
+				"sent_at":  now,
+			}).Error; err != nil {
+				return err
+			}
+			sent++
+		}
+
+		return nil
+	})
+
+	return sent, err
+}
+
+func publishConfirmed(ch *amqp.Channel, declared map[string]bool, msg OutboxMessage, timeout time.Duration) error {
+	if !declared[msg.Queue] {
+		if _, err := DeclareQueue(ch, msg.Queue); err != nil {
+			return err
+		}
+		declared[msg.Queue] = true
+	}
+
+	confirm, err := ch.PublishWithDeferredConfirm(
+		"",
+		msg.Queue,
+		false,
+		false,
+		amqp.Publishing{
+			ContentType:  "application/json",
+			Body:         msg.Payload,
+			DeliveryMode: amqp.Persistent,
+			Timestamp:    msg.CreatedAt,
+			MessageId:    fmt.Sprintf("outbox-%d", msg.ID),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("no confirm from broker: %w", err)
+	}
+	if !acked {
+		return errors.New("broker nacked the message")
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/zensos/microservice-project/internal/money"
+)
+
+// respondSagaError maps the outcome of a saga that didn't complete. A saga
+// that is still retrying is reported as accepted so the caller can poll it.
+func respondSagaError(c fiber.Ctx, saga *Saga, bookingID string, err error) error {
+	if errors.Is(err, errSagaPending) {
+		return c.Status(202).JSON(fiber.Map{
+			"booking_id": bookingID,
+			"saga_id":    saga.SagaID,
+			"status":     "PENDING",
+			"message":    "booking is still being processed",
+		})
+	}
+	if saga == nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to start booking saga"})
+	}
+	return respondError(c, err)
+}
+
+func createBooking(c fiber.Ctx) error {
+	var req CreateBookingRequest
+	if err := c.Bind().Body(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid json body"})
+	}
+
+	data, eventData, err := prepareBooking(req, c.Get("Authorization"))
+	if err != nil {
+		return respondError(c, err)
+	}
+
+	saga, err := startSaga(SagaCreateBooking, data)
+	if err != nil {
+		return respondSagaError(c, saga, data.BookingID, err)
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"booking_id":   data.BookingID,
+		"event":        eventData,
+		"member_id":    req.MemberID,
+		"seat_ids":     req.SeatIDs,
+		"total_amount": data.TotalAmount,
+		"status":       StatusConfirmed,
+	})
+}
+
+func cancelBookingHandler(c fiber.Ctx) error {
+	booking, err := loadOwnedBooking(c, c.Params("booking_id"))
+	if err != nil {
+		return respondError(c, err)
+	}
+
+	if booking.Status != StatusConfirmed {
+		return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("booking is %s and can't be cancelled", booking.Status)})
+	}
+
+	data := sagaData{
+		BookingID:   booking.BookingID,
+		EventID:     booking.EventID,
+		MemberID:    booking.MemberID,
+		TotalAmount: booking.TotalAmount,
+	}
+	data.addMember(c.Get("Authorization"))
+
+	saga, err := startSaga(SagaCancelBooking, data)
+	if err != nil {
+		return respondSagaError(c, saga, booking.BookingID, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"message":    "booking cancelled and refunded",
+		"booking_id": booking.BookingID,
+		"refunded":   booking.TotalAmount,
+	})
+}
+
+// seatRefund works out what the given seats are worth from the price each
+// was booked at.
+func seatRefund(booking Booking, seatIDs []string) (money.Money, error) {
+	cancel := make(map[string]bool, len(seatIDs))
+	for _, seatID := range seatIDs {
+		if seatID == "" {
+			return money.Money{}, newAPIError(400, "seat_ids must not contain empty values")
+		}
+		if cancel[seatID] {
+			return money.Money{}, newAPIError(400, "duplicate seat_id: %s", seatID)
+		}
+		cancel[seatID] = true
+	}
+
+	// Seats booked before prices were kept per seat get an even share.
+	shares := make([]money.Money, len(booking.Seats))
+	priced := money.Zero(booking.TotalAmount.Currency)
+	legacy := false
+	for i, seat := range booking.Seats {
+		shares[i] = seat.Price
+		if !seat.Price.SameCurrency(priced) {
+			legacy = true
+			continue
+		}
+		priced = priced.Add(seat.Price)
+	}
+	if legacy || (priced.IsZero() && booking.TotalAmount.IsPositive()) {
+		weights := make([]int64, len(booking.Seats))
+		for i := range booking.Seats {
+			weights[i] = 1
+		}
+		shares = booking.TotalAmount.Allocate(weights...)
+	}
+
+	refund := money.Zero(booking.TotalAmount.Currency)
+	for i, seat := range booking.Seats {
+		if cancel[seat.SeatID] {
+			refund = refund.Add(shares[i])
+			delete(cancel, seat.SeatID)
+		}
+	}
+	for seatID := range cancel {
+		return money.Money{}, newAPIError(400, "seat %s is not part of this booking", seatID)
+	}
+
+	return refund, nil
+}
+
+func cancelSeatsHandler(c fiber.Ctx) error {
+	var req CancelSeatsRequest
+	if err := c.Bind().Body(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid json body"})
+	}
+	if len(req.SeatIDs) == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "seat_ids is required"})
+	}
+
+	booking, err := loadOwnedBooking(c, c.Params("booking_id"))
+	if err != nil {
+		return respondError(c, err)
+	}
+
+	if booking.Status != StatusConfirmed {
+		return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("booking is %s and can't be cancelled", booking.Status)})
+	}
+
+	sort.Slice(booking.Seats, func(i, j int) bool { return booking.Seats[i].ID < booking.Seats[j].ID })
+	refund, err := seatRefund(booking, req.SeatIDs)
+	if err != nil {
+		return respondError(c, err)
+	}
+
+	data := sagaData{
+		BookingID:    booking.BookingID,
+		EventID:      booking.EventID,
+		MemberID:     booking.MemberID,
+		SeatIDs:      req.SeatIDs,
+		TotalAmount:  booking.TotalAmount,
+		RefundAmount: refund,
+		RefundKey:    fmt.Sprintf("refund-%s-%d", booking.BookingID, time.Now().UnixNano()),
+	}
+	data.addMember(c.Get("Authorization"))
+
+	saga, err := startSaga(SagaCancelSeats, data)
+	if err != nil {
+		return respondSagaError(c, saga, booking.BookingID, err)
+	}
+
+	if err := db.Preload("Seats").Where("booking_id = ?", booking.BookingID).First(&booking).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to load booking"})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":            "seats cancelled and refunded",
+		"booking_id":         booking.BookingID,
+		"cancelled_seat_ids": req.SeatIDs,
+		"refunded":           refund,
+		"total_amount":       booking.TotalAmount,
+		"status":             booking.Status,
+		"seats":              booking.Seats,
+	})
+}
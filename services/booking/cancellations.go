@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/zensos/microservice-project/internal/rabbitmq"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const cancellationBatchSize = 50
+
+type eventCancelledMessage struct {
+	EventID   uint   `json:"event_id"`
+	EventName string `json:"event_name"`
+	Reason    string `json:"reason"`
+}
+
+// consumeEventCancellations records each event.cancelled message; the work
+// itself is done by processEventCancellations so it survives restarts.
+func consumeEventCancellations(conn *amqp.Connection) {
+	ch, err := conn.Channel()
+	if err != nil {
+		log.Printf("couldn't open channel for event.cancelled: %v", err)
+		return
+	}
+
+	if _, err := rabbitmq.DeclareQueue(ch, "event.cancelled"); err != nil {
+		log.Printf("couldn't declare event.cancelled: %v", err)
+		return
+	}
+	msgs, err := rabbitmq.Consume(ch, "event.cancelled")
+	if err != nil {
+		log.Printf("couldn't consume event.cancelled: %v", err)
+		return
+	}
+
+	for msg := range msgs {
+		var event eventCancelledMessage
+		if err := json.Unmarshal(msg.Body, &event); err != nil || event.EventID == 0 {
+			log.Printf("dropping malformed event.cancelled message: %s", msg.Body)
+			msg.Nack(false, false)
+			continue
+		}
+
+		if err := startEventCancellation(event); err != nil {
+			log.Printf("couldn't start cancelling bookings of event %d: %v", event.EventID, err)
+			msg.Nack(false, true)
+			continue
+		}
+		msg.Ack(false)
+	}
+}
+
+// cancellableStatuses are the booking statuses an event cancellation still
+// has to deal with.
+var cancellableStatuses = []string{StatusHeld, StatusConfirmed, StatusCancelling}
+
+func countCancellable(eventID uint) (int64, error) {
+	var total int64
+	err := db.Model(&Booking{}).
+		Where("event_id = ? AND status IN ?", eventID, cancellableStatuses).
+		Count(&total).Error
+	return total, err
+}
+
+func startEventCancellation(event eventCancelledMessage) error {
+	total, err := countCancellable(event.EventID)
+	if err != nil {
+		return err
+	}
+
+	// Redelivered messages hit the unique event_id and are ignored.
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&EventCancellation{
+		EventID:   event.EventID,
+		EventName: event.EventName,
+		Reason:    event.Reason,
+		Status:    CancellationRunning,
+		Total:     int(total),
+	}).Error
+}
+
+func processEventCancellations(every time.Duration) {
+	for {
+		var running []EventCancellation
+		if err := db.Where("status = ? AND (locked_until IS NULL OR locked_until < ?)", CancellationRunning, time.Now()).
+			Order("id").Find(&running).Error; err != nil {
+			log.Printf("couldn't load event cancellations: %v", err)
+		}
+
+		for i := range running {
+			ec := &running[i]
+			if !claimEventCancellation(ec.ID) {
+				continue
+			}
+			for {
+				done, err := cancelEventBatch(ec)
+				if err != nil {
+					ec.LastError = err.Error()
+					log.Printf("cancelling bookings of event %d: %v", ec.EventID, err)
+				}
+				db.Model(ec).Select("Released", "Refunding", "Failed", "LastBookingID", "LastError", "Status", "CompletedAt").Updates(ec)
+				if done || err != nil {
+					break
+				}
+				db.Model(ec).Update("locked_until", time.Now().Add(sagaLease))
+			}
+			db.Model(ec).Update("locked_until", nil)
+		}
+
+		time.Sleep(every)
+	}
+}
+
+func claimEventCancellation(id uint) bool {
+	now := time.Now()
+	result := db.Model(&EventCancellation{}).
+		Where("id = ? AND (locked_until IS NULL OR locked_until < ?)", id, now).
+		Update("locked_until", now.Add(sagaLease))
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+// cancelEventBatch cancels the next batch of bookings: holds are released
+// straight away and confirmed bookings go through the cancel saga, which
+// refunds the member. It reports true once every booking has been visited,
+// or when it has to wait for a booking that is already being cancelled; the
+// walk then carries on from that booking on the next run.
+func cancelEventBatch(ec *EventCancellation) (bool, error) {
+	var bookings []Booking
+	if err := db.Where("event_id = ? AND id > ? AND status IN ?", ec.EventID, ec.LastBookingID, cancellableStatuses).
+		Order("id").Limit(cancellationBatchSize).Find(&bookings).Error; err != nil {
+		return false, err
+	}
+
+	if len(bookings) == 0 {
+		now := time.Now()
+		ec.Status = CancellationCompleted
+		ec.CompletedAt = &now
+		return true, nil
+	}
+
+	header, err := serviceAuthHeader()
+	if err != nil {
+		return false, err
+	}
+
+	for _, booking := range bookings {
+		if booking.Status == StatusCancelling {
+			// A member cancelling some seats puts the booking back to
+			// CONFIRMED afterwards, so walking past it would leave it
+			// booked. Wait for that saga to finish.
+			if active, err := sagaInFlight(booking.BookingID); err != nil || active {
+				return true, err
+			}
+			// Nothing is driving it any more; start over from CONFIRMED.
+			if err := db.Model(&Booking{}).
+				Where("booking_id = ? AND status = ?", booking.BookingID, StatusCancelling).
+				Update("status", StatusConfirmed).Error; err != nil {
+				return false, err
+			}
+			booking.Status = StatusConfirmed
+		}
+
+		data := sagaData{
+			BookingID:    booking.BookingID,
+			EventID:      booking.EventID,
+			MemberID:     booking.MemberID,
+			TotalAmount:  booking.TotalAmount,
+			EventName:    ec.EventName,
+			CancelReason: "event cancelled",
+		}
+		if ec.Reason != "" {
+			data.CancelReason = ec.Reason
+		}
+
+		data.addMember(header)
+
+		switch booking.Status {
+		case StatusHeld:
+			err = db.Transaction(func(tx *gorm.DB) error {
+				released, err := releaseSeats(tx, booking.BookingID, StatusCancelled)
+				if err != nil || !released {
+					return err
+				}
+				return enqueueCancellationNotice(tx, &data, false)
+			})
+			if err == nil {
+				ec.Released++
+			}
+		case StatusConfirmed:
+			_, err = startSaga(SagaCancelBooking, data)
+			if err == nil || errors.Is(err, errSagaPending) {
+				err = nil
+				ec.Refunding++
+			}
+		}
+
+		if err != nil {
+			ec.Failed++
+			ec.LastError = booking.BookingID + ": " + err.Error()
+			log.Printf("couldn't cancel booking %s of event %d: %v", booking.BookingID, ec.EventID, err)
+		}
+		ec.LastBookingID = booking.ID
+	}
+
+	return false, nil
+}
+
+func sagaInFlight(bookingID string) (bool, error) {
+	var active int64
+	err := db.Model(&Saga{}).
+		Where("booking_id = ? AND status IN ?", bookingID, []string{SagaRunning, SagaCompensating}).
+		Count(&active).Error
+	return active > 0, err
+}
+
+func eventCancellationProgress(ec EventCancellation) (fiber.Map, error) {
+	var rows []struct {
+		Status string
+		Count  int
+	}
+	if err := db.Model(&Booking{}).Select("status, count(*) AS count").
+		Where("event_id = ?", ec.EventID).Group("status").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	bookings := fiber.Map{}
+	for _, row := range rows {
+		bookings[row.Status] = row.Count
+	}
+
+	return fiber.Map{
+		"cancellation": ec,
+		"bookings":     bookings,
+	}, nil
+}
+
+func listEventCancellations(c fiber.Ctx) error {
+	var cancellations []EventCancellation
+	if err := db.Order("created_at desc").Limit(100).Find(&cancellations).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to load event cancellations"})
+	}
+	return c.JSON(fiber.Map{"cancellations": cancellations})
+}
+
+func getEventCancellation(c fiber.Ctx) error {
+	eventID, err := strconv.Atoi(c.Params("event_id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid event id"})
+	}
+
+	var ec EventCancellation
+	if err := db.Where("event_id = ?", eventID).First(&ec).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "no cancellation found for this event"})
+	}
+
+	progress, err := eventCancellationProgress(ec)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to load booking counts"})
+	}
+	return c.JSON(progress)
+}
+
+// retryEventCancellation walks the event's bookings again, picking up the
+// ones whose cancellation failed. The counters start over for the new walk,
+// which only visits the bookings that are still left.
+func retryEventCancellation(c fiber.Ctx) error {
+	eventID, err := strconv.Atoi(c.Params("event_id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid event id"})
+	}
+
+	total, err := countCancellable(uint(eventID))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to restart the cancellation"})
+	}
+
+	result := db.Model(&EventCancellation{}).
+		Where("event_id = ? AND status = ?", eventID, CancellationCompleted).
+		Updates(map[string]any{
+			"status":          CancellationRunning,
+			"last_booking_id": 0,
+			"total":           total,
+			"released":        0,
+			"refunding":       0,
+			"failed":          0,
+			"last_error":      "",
+			"completed_at":    nil,
+		})
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to restart the cancellation"})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(409).JSON(fiber.Map{"error": "no completed cancellation found for this event"})
+	}
+
+	return c.Status(202).JSON(fiber.Map{"message": "cancellation restarted", "event_id": eventID})
+}
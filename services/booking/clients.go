@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/sony/gobreaker/v2"
+	"github.com/zensos/microservice-project/internal/circuitbreaker"
+	"github.com/zensos/microservice-project/internal/common"
+	"github.com/zensos/microservice-project/internal/middleware"
+	"github.com/zensos/microservice-project/internal/money"
+)
+
+type apiError struct {
+	Status  int
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func newAPIError(status int, format string, args ...any) *apiError {
+	return &apiError{Status: status, Message: fmt.Sprintf(format, args...)}
+}
+
+func respondError(c fiber.Ctx, err error) error {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return c.Status(apiErr.Status).JSON(fiber.Map{"error": apiErr.Message})
+	}
+	return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+}
+
+type memberInfo struct {
+	Email string
+	Name  string
+}
+
+type callOptions struct {
+	authHeader     string
+	idempotencyKey string
+}
+
+func callService(cb *gobreaker.CircuitBreaker[circuitbreaker.BreakerResponse], service, method, path string, opts callOptions, body any) (circuitbreaker.BreakerResponse, error) {
+	if consulClient == nil {
+		return circuitbreaker.BreakerResponse{}, newAPIError(503, "service discovery is not available right now")
+	}
+
+	addr, err := common.DiscoverService(consulClient, service)
+	if err != nil {
+		return circuitbreaker.BreakerResponse{}, newAPIError(502, "couldn't find the %s service: %v", service, err)
+	}
+
+	var payload []byte
+	if body != nil {
+		payload, _ = json.Marshal(body)
+	}
+
+	req, _ := http.NewRequest(method, fmt.Sprintf("http://%s%s", addr, path), bytes.NewReader(payload))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if opts.authHeader != "" {
+		req.Header.Set("Authorization", opts.authHeader)
+	}
+	if opts.idempotencyKey != "" {
+		req.Header.Set(middleware.IdempotencyHeader, opts.idempotencyKey)
+	}
+
+	resp, err := circuitbreaker.Do(cb, req)
+	if err != nil {
+		if errors.Is(err, gobreaker.ErrOpenState) {
+			return resp, newAPIError(503, "%s service is temporarily unavailable", service)
+		}
+		return resp, newAPIError(502, "couldn't reach the %s service: %v", service, err)
+	}
+
+	return resp, nil
+}
+
+func upstreamError(resp circuitbreaker.BreakerResponse, fallback string) *apiError {
+	var body map[string]any
+	json.Unmarshal(resp.Body, &body)
+
+	msg := fallback
+	if m, ok := body["error"].(string); ok {
+		msg = m
+	}
+	return &apiError{Status: resp.StatusCode, Message: msg}
+}
+
+func fetchEvent(eventID uint, authHeader string) (map[string]any, error) {
+	resp, err := callService(eventCB, "event", "GET", fmt.Sprintf("/events/%d", eventID), callOptions{authHeader: authHeader}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == 404 {
+		return nil, newAPIError(404, "event not found")
+	}
+	if resp.StatusCode != 200 {
+		return nil, newAPIError(502, "event service error")
+	}
+
+	var eventData map[string]any
+	if err := json.Unmarshal(resp.Body, &eventData); err != nil {
+		return nil, newAPIError(502, "got a bad response from the event service")
+	}
+
+	return eventData, nil
+}
+
+// fetchSeatPrices prices every seat on the event's seat map. Seats in a
+// section without a ticket tier cost the event price.
+func fetchSeatPrices(eventID uint, authHeader string) (map[string]seatQuote, error) {
+	resp, err := callService(eventCB, "event", "GET", fmt.Sprintf("/events/%d/seats?availability=false", eventID), callOptions{authHeader: authHeader}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, upstreamError(resp, "couldn't load the event seat map")
+	}
+
+	var seatMap struct {
+		Price    money.Money `json:"price"`
+		Sections []struct {
+			Tier *struct {
+				ID    uint        `json:"id"`
+				Name  string      `json:"name"`
+				Price money.Money `json:"price"`
+				Quota int         `json:"quota"`
+			} `json:"tier"`
+			Rows []struct {
+				Seats []struct {
+					SeatID string `json:"seat_id"`
+				} `json:"seats"`
+			} `json:"rows"`
+		} `json:"sections"`
+	}
+	if err := json.Unmarshal(resp.Body, &seatMap); err != nil {
+		return nil, newAPIError(502, "got a bad seat map from the event service")
+	}
+
+	quotes := map[string]seatQuote{}
+	for _, section := range seatMap.Sections {
+		quote := seatQuote{Price: seatMap.Price}
+		if section.Tier != nil {
+			quote = seatQuote{
+				TierID: section.Tier.ID,
+				Tier:   section.Tier.Name,
+				Price:  section.Tier.Price,
+				Quota:  section.Tier.Quota,
+			}
+		}
+		for _, row := range section.Rows {
+			for _, seat := range row.Seats {
+				quote.SeatID = seat.SeatID
+				quotes[seat.SeatID] = quote
+			}
+		}
+	}
+	return quotes, nil
+}
+
+func fetchMember(memberID, authHeader string) (memberInfo, error) {
+	resp, err := callService(memberCB, "member", "GET", "/members/"+memberID, callOptions{authHeader: authHeader}, nil)
+	if err != nil {
+		return memberInfo{}, err
+	}
+
+	if resp.StatusCode == 404 {
+		return memberInfo{}, newAPIError(404, "user not found")
+	}
+	if resp.StatusCode != 200 {
+		return memberInfo{}, newAPIError(502, "member service error")
+	}
+
+	var memberData map[string]any
+	json.Unmarshal(resp.Body, &memberData)
+
+	email, _ := memberData["email"].(string)
+	firstName, _ := memberData["first_name"].(string)
+	lastName, _ := memberData["last_name"].(string)
+
+	return memberInfo{
+		Email: email,
+		Name:  strings.TrimSpace(firstName + " " + lastName),
+	}, nil
+}
+
+// addMember fills in where to reach the member. The saga still runs without
+// it; the mails about it are just skipped.
+func (data *sagaData) addMember(authHeader string) {
+	member, err := fetchMember(data.MemberID, authHeader)
+	if err != nil {
+		log.Printf("couldn't look up member %s for booking %s: %v", data.MemberID, data.BookingID, err)
+		return
+	}
+	data.MemberEmail = member.Email
+	data.MemberName = member.Name
+}
+
+// The payment calls below pass the member's email along, since payment
+// sends the receipts but doesn't know members' addresses.
+
+func chargePayment(bookingID, memberID, memberEmail string, amount money.Money, authHeader string) error {
+	resp, err := callService(paymentCB, "payment", "POST", "/payments", callOptions{
+		authHeader:     authHeader,
+		idempotencyKey: "charge-" + bookingID,
+	}, map[string]any{
+		"booking_id":   bookingID,
+		"member_id":    memberID,
+		"member_email": memberEmail,
+		"amount":       amount,
+	})
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != 201 {
+		return upstreamError(resp, "payment failed")
+	}
+	return nil
+}
+
+// authorizePayment holds the amount in the member's wallet until the
+// booking is confirmed.
+func authorizePayment(bookingID, memberID, memberEmail string, amount money.Money, authHeader string) error {
+	resp, err := callService(paymentCB, "payment", "POST", "/payments/authorize", callOptions{
+		authHeader:     authHeader,
+		idempotencyKey: "authorize-" + bookingID,
+	}, map[string]any{
+		"booking_id":   bookingID,
+		"member_id":    memberID,
+		"member_email": memberEmail,
+		"amount":       amount,
+	})
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != 201 {
+		return upstreamError(resp, "payment authorization failed")
+	}
+	return nil
+}
+
+func capturePayment(bookingID, memberID, memberEmail, authHeader string) error {
+	return settlePayment("capture", bookingID, memberID, memberEmail, authHeader)
+}
+
+func voidPayment(bookingID, memberID, authHeader string) error {
+	return settlePayment("void", bookingID, memberID, "", authHeader)
+}
+
+func settlePayment(action, bookingID, memberID, memberEmail, authHeader string) error {
+	resp, err := callService(paymentCB, "payment", "POST", "/payments/"+action, callOptions{
+		authHeader:     authHeader,
+		idempotencyKey: action + "-" + bookingID,
+	}, map[string]any{
+		"booking_id":   bookingID,
+		"member_id":    memberID,
+		"member_email": memberEmail,
+	})
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != 200 {
+		return upstreamError(resp, "payment "+action+" failed")
+	}
+	return nil
+}
+
+func refundPayment(bookingID, memberID, memberEmail string, amount money.Money, idempotencyKey, authHeader string) error {
+	resp, err := callService(paymentCB, "payment", "POST", "/payments/refund", callOptions{
+		authHeader:     authHeader,
+		idempotencyKey: idempotencyKey,
+	}, map[string]any{
+		"booking_id":   bookingID,
+		"member_id":    memberID,
+		"member_email": memberEmail,
+		"amount":       amount,
+	})
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != 200 {
+		return upstreamError(resp, "refund failed")
+	}
+	return nil
+}
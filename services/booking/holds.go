@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/zensos/microservice-project/internal/auth"
+	"github.com/zensos/microservice-project/internal/middleware"
+	"github.com/zensos/microservice-project/internal/money"
+	"gorm.io/gorm"
+)
+
+var (
+	holdTTL    = time.Duration(envInt("BOOKING_HOLD_TTL_MINUTES", 10)) * time.Minute
+	maxHoldTTL = 30 * time.Minute
+)
+
+func validateBookingRequest(req CreateBookingRequest) error {
+	if req.EventID <= 0 {
+		return newAPIError(400, "event_id must be > 0")
+	}
+	if req.MemberID == "" {
+		return newAPIError(400, "member_id is required")
+	}
+	if len(req.SeatIDs) == 0 {
+		return newAPIError(400, "seat_ids must not be empty")
+	}
+	if req.HoldMinutes < 0 || time.Duration(req.HoldMinutes)*time.Minute > maxHoldTTL {
+		return newAPIError(400, "hold_minutes must be between 1 and %d", int(maxHoldTTL.Minutes()))
+	}
+
+	seen := map[string]bool{}
+	for _, seat := range req.SeatIDs {
+		if seat == "" {
+			return newAPIError(400, "seat_id must not be empty")
+		}
+		if seen[seat] {
+			return newAPIError(400, "seat_ids must not contain duplicates")
+		}
+		seen[seat] = true
+	}
+
+	return nil
+}
+
+// prepareBooking validates the request and collects everything a booking
+// saga needs from the event and member services, using the caller's token.
+func prepareBooking(req CreateBookingRequest, authHeader string) (sagaData, map[string]any, error) {
+	if err := validateBookingRequest(req); err != nil {
+		return sagaData{}, nil, err
+	}
+
+	eventData, err := fetchEvent(req.EventID, authHeader)
+	if err != nil {
+		return sagaData{}, nil, err
+	}
+	if status, _ := eventData["status"].(string); status != "on_sale" {
+		return sagaData{}, nil, newAPIError(409, "event is not on sale")
+	}
+
+	member, err := fetchMember(req.MemberID, authHeader)
+	if err != nil {
+		return sagaData{}, nil, err
+	}
+
+	seats, total, err := quoteSeats(req, eventData, authHeader)
+	if err != nil {
+		return sagaData{}, nil, err
+	}
+	eventName, _ := eventData["name"].(string)
+
+	return sagaData{
+		BookingID:   fmt.Sprintf("book_%d", time.Now().UnixNano()),
+		EventID:     req.EventID,
+		MemberID:    req.MemberID,
+		SeatIDs:     req.SeatIDs,
+		TotalAmount: total,
+		HoldMinutes: req.HoldMinutes,
+		EventName:   eventName,
+		MemberEmail: member.Email,
+		MemberName:  member.Name,
+		Seats:       seats,
+	}, eventData, nil
+}
+
+// quoteSeats prices the requested seats from the event's seat map and ticket
+// tiers. Events created before seat maps existed take free-form seat IDs at
+// the event price.
+func quoteSeats(req CreateBookingRequest, eventData map[string]any, authHeader string) ([]seatQuote, money.Money, error) {
+	var price money.Money
+	if raw, err := json.Marshal(eventData["price"]); err != nil || json.Unmarshal(raw, &price) != nil {
+		return nil, money.Money{}, newAPIError(502, "got a bad event price from the event service")
+	}
+
+	var available map[string]seatQuote
+	if eventData["venue_id"] != nil {
+		var err error
+		if available, err = fetchSeatPrices(req.EventID, authHeader); err != nil {
+			return nil, money.Money{}, err
+		}
+	}
+
+	total := money.Zero(price.Currency)
+	quotes := make([]seatQuote, 0, len(req.SeatIDs))
+	for _, seatID := range req.SeatIDs {
+		quote := seatQuote{SeatID: seatID, Price: price}
+		if available != nil {
+			var ok bool
+			if quote, ok = available[seatID]; !ok {
+				return nil, money.Money{}, newAPIError(400, "seat %s does not exist for this event", seatID)
+			}
+		}
+		if !quote.Price.SameCurrency(total) {
+			return nil, money.Money{}, newAPIError(502, "seats of this event are priced in different currencies")
+		}
+
+		total = total.Add(quote.Price)
+		quotes = append(quotes, quote)
+	}
+
+	return quotes, total, nil
+}
+
+func releaseSeats(tx *gorm.DB, bookingID, status string) (bool, error) {
+	result := tx.Model(&Booking{}).
+		Where("booking_id = ? AND status = ?", bookingID, StatusHeld).
+		Updates(map[string]any{"status": status, "hold_expires_at": nil})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+
+	return true, tx.Where("booking_id = ?", bookingID).Delete(&BookingSeat{}).Error
+}
+
+func loadOwnedBooking(c fiber.Ctx, bookingID string) (Booking, error) {
+	var booking Booking
+	if err := db.Preload("Seats").Where("booking_id = ?", bookingID).First(&booking).Error; err != nil {
+		return booking, newAPIError(404, "booking not found")
+	}
+
+	if booking.MemberID != middleware.Subject(c) && !middleware.Can(c, auth.PermBookingsCancelAny) {
+		return booking, newAPIError(403, "booking does not belong to the authenticated member")
+	}
+	return booking, nil
+}
+
+func createHold(c fiber.Ctx) error {
+	var req CreateBookingRequest
+	if err := c.Bind().Body(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid json body"})
+	}
+
+	data, eventData, err := prepareBooking(req, c.Get("Authorization"))
+	if err != nil {
+		return respondError(c, err)
+	}
+
+	if err := reserveSeats(&data); err != nil {
+		return respondError(c, err)
+	}
+
+	var booking Booking
+	db.Where("booking_id = ?", data.BookingID).First(&booking)
+
+	return c.Status(201).JSON(fiber.Map{
+		"booking_id":      booking.BookingID,
+		"event":           eventData,
+		"member_id":       booking.MemberID,
+		"seat_ids":        req.SeatIDs,
+		"total_amount":    booking.TotalAmount,
+		"status":          booking.Status,
+		"hold_expires_at": booking.HoldExpiresAt,
+	})
+}
+
+func confirmHoldHandler(c fiber.Ctx) error {
+	booking, err := loadOwnedBooking(c, c.Params("booking_id"))
+	if err != nil {
+		return respondError(c, err)
+	}
+
+	if booking.Status != StatusHeld {
+		return c.Status(409).JSON(fiber.Map{"error": fmt.Sprintf("booking is %s, not held", booking.Status)})
+	}
+	if booking.HoldExpiresAt != nil && time.Now().After(*booking.HoldExpiresAt) {
+		return c.Status(410).JSON(fiber.Map{"error": "hold has expired"})
+	}
+
+	authHeader := c.Get("Authorization")
+
+	eventData, err := fetchEvent(booking.EventID, authHeader)
+	if err != nil {
+		return respondError(c, err)
+	}
+	// The event may have been cancelled or closed since the seats were held.
+	if status, _ := eventData["status"].(string); status != "on_sale" {
+		return c.Status(409).JSON(fiber.Map{"error": "event is not on sale"})
+	}
+	member, err := fetchMember(booking.MemberID, authHeader)
+	if err != nil {
+		return respondError(c, err)
+	}
+	eventName, _ := eventData["name"].(string)
+
+	seatIDs := make([]string, 0, len(booking.Seats))
+	for _, seat := range booking.Seats {
+		seatIDs = append(seatIDs, seat.SeatID)
+	}
+
+	saga, err := startSaga(SagaConfirmHold, sagaData{
+		BookingID:   booking.BookingID,
+		EventID:     booking.EventID,
+		MemberID:    booking.MemberID,
+		SeatIDs:     seatIDs,
+		TotalAmount: booking.TotalAmount,
+		EventName:   eventName,
+		MemberEmail: member.Email,
+		MemberName:  member.Name,
+	})
+	if err != nil {
+		return respondSagaError(c, saga, booking.BookingID, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"booking_id":   booking.BookingID,
+		"event":        eventData,
+		"member_id":    booking.MemberID,
+		"seat_ids":     seatIDs,
+		"total_amount": booking.TotalAmount,
+		"status":       StatusConfirmed,
+	})
+}
+
+func releaseHoldHandler(c fiber.Ctx) error {
+	booking, err := loadOwnedBooking(c, c.Params("booking_id"))
+	if err != nil {
+		return respondError(c, err)
+	}
+
+	var released bool
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		released, err = releaseSeats(tx, booking.BookingID, StatusReleased)
+		return err
+	}); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to release hold"})
+	}
+	if !released {
+		return c.Status(409).JSON(fiber.Map{"error": fmt.Sprintf("booking is %s, not held", booking.Status)})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":    "hold released",
+		"booking_id": booking.BookingID,
+	})
+}
+
+func sweepExpiredHolds(every time.Duration) {
+	for {
+		time.Sleep(every)
+
+		var expired []Booking
+		if err := db.Where("status = ? AND hold_expires_at < ?", StatusHeld, time.Now()).
+			Limit(500).Find(&expired).Error; err != nil {
+			log.Printf("couldn't load expired holds: %v", err)
+			continue
+		}
+
+		for _, booking := range expired {
+			err := db.Transaction(func(tx *gorm.DB) error {
+				_, err := releaseSeats(tx, booking.BookingID, StatusExpired)
+				return err
+			})
+			if err != nil {
+				log.Printf("couldn't expire hold %s: %v", booking.BookingID, err)
+			}
+		}
+	}
+}
+
+// takenSeats lists the seats of an event that are held or booked, for the
+// event service's availability view.
+func takenSeats(c fiber.Ctx) error {
+	eventID, err := strconv.Atoi(c.Params("event_id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid event id"})
+	}
+
+	seatIDs := []string{}
+	if err := db.Model(&BookingSeat{}).Where("event_id = ?", eventID).
+		Order("seat_id").Pluck("seat_id", &seatIDs).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to load seats"})
+	}
+
+	return c.JSON(fiber.Map{
+		"event_id": eventID,
+		"seat_ids": seatIDs,
+	})
+}
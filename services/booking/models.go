@@ -1,35 +1,111 @@
 package main
 
 import (
+	"encoding/json"
 	"time"
 
+	"github.com/zensos/microservice-project/internal/money"
 	"gorm.io/gorm"
 )
 
+const (
+	StatusHeld       = "HELD"
+	StatusConfirmed  = "CONFIRMED"
+	StatusCancelling = "CANCELLING"
+	StatusCancelled  = "CANCELLED"
+	StatusExpired    = "EXPIRED"
+	StatusReleased   = "RELEASED"
+	StatusFailed     = "FAILED"
+)
+
 type Booking struct {
-	ID          uint           `json:"id" gorm:"primaryKey"`
-	BookingID   string         `json:"booking_id" gorm:"uniqueIndex"`
-	EventID     uint           `json:"event_id" gorm:"index"`
-	MemberID    string         `json:"member_id" gorm:"index"`
-	TotalAmount float64        `json:"total_amount"`
-	Status      string         `json:"status"`
-	Seats       []BookingSeat  `json:"seats" gorm:"foreignKey:BookingID;references:BookingID"`
-	CreatedAt   time.Time      `json:"created_at"`
-	UpdatedAt   time.Time      `json:"updated_at"`
-	DeletedAt   gorm.DeletedAt `json:"-" gorm:"index"`
+	ID            uint           `json:"id" gorm:"primaryKey"`
+	BookingID     string         `json:"booking_id" gorm:"uniqueIndex"`
+	EventID       uint           `json:"event_id" gorm:"index"`
+	MemberID      string         `json:"member_id" gorm:"index"`
+	TotalAmount   money.Money    `json:"total_amount" gorm:"embedded;embeddedPrefix:total_amount_"`
+	Status        string         `json:"status" gorm:"index"`
+	HoldExpiresAt *time.Time     `json:"hold_expires_at,omitempty" gorm:"index"`
+	Seats         []BookingSeat  `json:"seats" gorm:"foreignKey:BookingID;references:BookingID"`
+	CreatedAt     time.Time      `json:"created_at"`
+	UpdatedAt     time.Time      `json:"updated_at"`
+	DeletedAt     gorm.DeletedAt `json:"-" gorm:"index"`
 }
 
+// BookingSeat.Price is what the seat cost at booking time, so refunds aren't
+// affected by later price changes.
 type BookingSeat struct {
 	ID        uint           `json:"id" gorm:"primaryKey"`
 	BookingID string         `json:"booking_id" gorm:"index"`
 	EventID   uint           `json:"event_id"`
 	SeatID    string         `json:"seat_id"`
+	TierID    uint           `json:"tier_id,omitempty" gorm:"index"`
+	Tier      string         `json:"tier,omitempty"`
+	Price     money.Money    `json:"price" gorm:"embedded;embeddedPrefix:price_"`
 	CreatedAt time.Time      `json:"created_at"`
 	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
 }
 
 type CreateBookingRequest struct {
-	EventID  uint     `json:"event_id"`
-	MemberID string   `json:"member_id"`
-	SeatIDs  []string `json:"seat_ids"`
+	EventID     uint     `json:"event_id"`
+	MemberID    string   `json:"member_id"`
+	SeatIDs     []string `json:"seat_ids"`
+	HoldMinutes int      `json:"hold_minutes,omitempty"`
+}
+
+const (
+	CancellationRunning   = "running"
+	CancellationCompleted = "completed"
+)
+
+// EventCancellation tracks cancelling every booking of a cancelled event.
+// Bookings are walked in ID order and LastBookingID is the cursor.
+type EventCancellation struct {
+	ID            uint       `json:"-" gorm:"primaryKey"`
+	EventID       uint       `json:"event_id" gorm:"uniqueIndex"`
+	EventName     string     `json:"event_name"`
+	Reason        string     `json:"reason,omitempty"`
+	Status        string     `json:"status" gorm:"index"`
+	Total         int        `json:"total"`
+	Released      int        `json:"released"`
+	Refunding     int        `json:"refunding"`
+	Failed        int        `json:"failed"`
+	LastBookingID uint       `json:"last_booking_id"`
+	LastError     string     `json:"last_error,omitempty"`
+	LockedUntil   *time.Time `json:"-"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	CompletedAt   *time.Time `json:"completed_at,omitempty"`
+}
+
+type CancelSeatsRequest struct {
+	SeatIDs []string `json:"seat_ids"`
+}
+
+type Saga struct {
+	ID          uint            `json:"-" gorm:"primaryKey"`
+	SagaID      string          `json:"saga_id" gorm:"uniqueIndex"`
+	Type        string          `json:"type"`
+	BookingID   string          `json:"booking_id" gorm:"index"`
+	Status      string          `json:"status" gorm:"index"`
+	CurrentStep int             `json:"current_step"`
+	Payload     json.RawMessage `json:"payload" gorm:"type:jsonb"`
+	Attempts    int             `json:"attempts"`
+	LastError   string          `json:"last_error,omitempty"`
+	NextRunAt   time.Time       `json:"next_run_at" gorm:"index"`
+	LockedUntil *time.Time      `json:"locked_until,omitempty"`
+	Steps       []SagaStep      `json:"steps" gorm:"foreignKey:SagaID;references:SagaID"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+type SagaStep struct {
+	ID        uint      `json:"-" gorm:"primaryKey"`
+	SagaID    string    `json:"-" gorm:"index"`
+	Name      string    `json:"name"`
+	Action    string    `json:"action"`
+	Attempt   int       `json:"attempt"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
 }
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/zensos/microservice-project/internal/money"
+	"gorm.io/gorm"
+)
+
+const (
+	SagaCreateBooking = "create_booking"
+	SagaConfirmHold   = "confirm_hold"
+	SagaCancelBooking = "cancel_booking"
+	SagaCancelSeats   = "cancel_seats"
+
+	SagaRunning      = "running"
+	SagaCompensating = "compensating"
+	SagaCompleted    = "completed"
+	SagaCompensated  = "compensated"
+
+	StepExecute    = "execute"
+	StepCompensate = "compensate"
+
+	sagaMaxAttempts = 8
+	sagaLease       = time.Minute
+)
+
+var errSagaPending = errors.New("saga is still in progress")
+
+type sagaData struct {
+	BookingID   string      `json:"booking_id"`
+	EventID     uint        `json:"event_id"`
+	MemberID    string      `json:"member_id"`
+	SeatIDs     []string    `json:"seat_ids"`
+	TotalAmount money.Money `json:"total_amount"`
+	HoldMinutes int         `json:"hold_minutes,omitempty"`
+	EventName   string      `json:"event_name"`
+	MemberEmail string      `json:"member_email"`
+	MemberName  string      `json:"member_name"`
+
+	Seats []seatQuote `json:"seats,omitempty"`
+
+	// Set when only some seats are cancelled: SeatIDs then lists just those
+	// seats and RefundAmount is their share of the total.
+	RefundAmount money.Money `json:"refund_amount"`
+	RefundKey    string      `json:"refund_key,omitempty"`
+
+	// Set when the event itself was cancelled; the member is notified.
+	CancelReason string `json:"cancel_reason,omitempty"`
+}
+
+type seatQuote struct {
+	SeatID string      `json:"seat_id"`
+	TierID uint        `json:"tier_id,omitempty"`
+	Tier   string      `json:"tier,omitempty"`
+	Price  money.Money `json:"price"`
+	Quota  int         `json:"quota,omitempty"`
+}
+
+type sagaStep struct {
+	name       string
+	execute    func(*sagaData) error
+	compensate func(*sagaData) error
+	// Steps past the point of no return are retried until they succeed
+	// instead of unwinding the saga.
+	retryOnly bool
+}
+
+var sagaDefinitions = map[string][]sagaStep{
+	SagaCreateBooking: {
+		{name: "reserve_seats", execute: reserveSeats, compensate: failReservation},
+		{name: "authorize_payment", execute: authorizeBooking, compensate: voidBooking},
+		{name: "confirm_booking", execute: confirmBooking},
+		{name: "capture_payment", execute: captureBooking, retryOnly: true},
+	},
+	SagaConfirmHold: {
+		{name: "authorize_payment", execute: authorizeBooking, compensate: voidBooking},
+		{name: "confirm_booking", execute: confirmBooking},
+		{name: "capture_payment", execute: captureBooking, retryOnly: true},
+	},
+	SagaCancelBooking: {
+		{name: "mark_cancelling", execute: markCancelling, compensate: unmarkCancelling},
+		{name: "refund_payment", execute: refundBooking},
+		{name: "cancel_booking", execute: cancelBooking, retryOnly: true},
+	},
+	SagaCancelSeats: {
+		{name: "mark_cancelling", execute: markCancelling, compensate: unmarkCancelling},
+		{name: "refund_seats", execute: refundSeats},
+		{name: "release_seats", execute: releaseCancelledSeats, retryOnly: true},
+	},
+}
+
+func startSaga(sagaType string, data sagaData) (*Saga, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	lease := time.Now().Add(sagaLease)
+	saga := &Saga{
+		SagaID:      fmt.Sprintf("saga_%d", time.Now().UnixNano()),
+		Type:        sagaType,
+		BookingID:   data.BookingID,
+		Status:      SagaRunning,
+		Payload:     payload,
+		NextRunAt:   time.Now(),
+		LockedUntil: &lease,
+	}
+	if err := db.Create(saga).Error; err != nil {
+		return nil, err
+	}
+
+	return saga, runSaga(saga)
+}
+
+// runSaga drives a claimed saga as far as it can go. It returns nil once the
+// saga completes, errSagaPending when a step has to be retried later, and the
+// failing step's error once the saga has been fully compensated.
+func runSaga(saga *Saga) error {
+	defer db.Model(saga).Update("locked_until", nil)
+
+	steps, ok := sagaDefinitions[saga.Type]
+	if !ok {
+		return fmt.Errorf("unknown saga type %q", saga.Type)
+	}
+
+	var data sagaData
+	if err := json.Unmarshal(saga.Payload, &data); err != nil {
+		return fmt.Errorf("couldn't decode saga payload: %w", err)
+	}
+
+	var failure error
+
+	for saga.Status == SagaRunning && saga.CurrentStep < len(steps) {
+		step := steps[saga.CurrentStep]
+
+		err := step.execute(&data)
+		logSagaStep(saga, step.name, StepExecute, err)
+		if err == nil {
+			saga.CurrentStep++
+			saga.Attempts = 0
+			saga.LastError = ""
+			saga.Payload, _ = json.Marshal(data)
+			saveSaga(saga)
+			continue
+		}
+
+		saga.LastError = err.Error()
+		if step.retryOnly || (isRetryable(err) && saga.Attempts+1 < sagaMaxAttempts) {
+			scheduleRetry(saga)
+			return errSagaPending
+		}
+
+		// A step that kept failing with transient errors may still have
+		// taken effect, so it is compensated along with the earlier ones.
+		if isRetryable(err) {
+			saga.CurrentStep++
+		}
+		failure = err
+		saga.Status = SagaCompensating
+		saga.Attempts = 0
+		saveSaga(saga)
+	}
+
+	for saga.Status == SagaCompensating && saga.CurrentStep > 0 {
+		step := steps[saga.CurrentStep-1]
+
+		if step.compensate != nil {
+			err := step.compensate(&data)
+			logSagaStep(saga, step.name, StepCompensate, err)
+			if err != nil {
+				saga.LastError = err.Error()
+				scheduleRetry(saga)
+				return errSagaPending
+			}
+		}
+
+		saga.CurrentStep--
+		saga.Attempts = 0
+		saveSaga(saga)
+	}
+
+	if saga.Status == SagaCompensating {
+		saga.Status = SagaCompensated
+		saveSaga(saga)
+		if failure == nil {
+			failure = errors.New(saga.LastError)
+		}
+		return failure
+	}
+
+	saga.Status = SagaCompleted
+	saveSaga(saga)
+	return nil
+}
+
+func isRetryable(err error) bool {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr.Status >= 500
+	}
+	return true
+}
+
+func scheduleRetry(saga *Saga) {
+	saga.Attempts++
+	backoff := time.Duration(1<<min(saga.Attempts, 8)) * time.Second
+	saga.NextRunAt = time.Now().Add(min(backoff, 5*time.Minute))
+	saveSaga(saga)
+}
+
+func saveSaga(saga *Saga) {
+	if err := db.Omit("Steps", "LockedUntil").Save(saga).Error; err != nil {
+		log.Printf("couldn't persist saga %s: %v", saga.SagaID, err)
+	}
+}
+
+func logSagaStep(saga *Saga, name, action string, err error) {
+	entry := SagaStep{
+		SagaID:  saga.SagaID,
+		Name:    name,
+		Action:  action,
+		Attempt: saga.Attempts + 1,
+		Status:  "succeeded",
+	}
+	if err != nil {
+		entry.Status = "failed"
+		entry.Error = err.Error()
+	}
+
+	if err := db.Create(&entry).Error; err != nil {
+		log.Printf("couldn't log step %s of saga %s: %v", name, saga.SagaID, err)
+	}
+}
+
+func claimSaga(sagaID string) bool {
+	now := time.Now()
+	result := db.Model(&Saga{}).
+		Where("saga_id = ? AND (locked_until IS NULL OR locked_until < ?)", sagaID, now).
+		Update("locked_until", now.Add(sagaLease))
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+// resumeSagas picks up sagas left unfinished by a crash or waiting on a retry.
+func resumeSagas(every time.Duration) {
+	for {
+		var pending []Saga
+		err := db.Where("status IN ? AND next_run_at <= ? AND (locked_until IS NULL OR locked_until < ?)",
+			[]string{SagaRunning, SagaCompensating}, time.Now(), time.Now()).
+			Order("next_run_at").Limit(100).Find(&pending).Error
+		if err != nil {
+			log.Printf("couldn't load pending sagas: %v", err)
+		}
+
+		for i := range pending {
+			saga := &pending[i]
+			if !claimSaga(saga.SagaID) {
+				continue
+			}
+			if err := runSaga(saga); err != nil && !errors.Is(err, errSagaPending) {
+				log.Printf("saga %s for booking %s was compensated: %v", saga.SagaID, saga.BookingID, err)
+			}
+		}
+
+		time.Sleep(every)
+	}
+}
+
+func serviceAuthHeader() (string, error) {
+	header, err := serviceTokens.Header()
+	if err != nil {
+		return "", newAPIError(503, "couldn't authenticate with other services: %v", err)
+	}
+	return header, nil
+}
+
+func getBookingSaga(c fiber.Ctx) error {
+	var sagas []Saga
+	err := db.Preload("Steps", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order("created_at")
+	}).Where("booking_id = ?", c.Params("booking_id")).Order("created_at").Find(&sagas).Error
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to load sagas"})
+	}
+	if len(sagas) == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "no saga found for this booking"})
+	}
+
+	return c.JSON(fiber.Map{
+		"booking_id": c.Params("booking_id"),
+		"sagas":      sagas,
+	})
+}
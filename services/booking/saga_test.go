@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/zensos/microservice-project/internal/rabbitmq"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testDB points the package's db at a fresh in-memory database.
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	conn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.AutoMigrate(&Booking{}, &BookingSeat{}, &Saga{}, &SagaStep{}, &rabbitmq.OutboxMessage{}); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := db
+	db = conn
+	t.Cleanup(func() { db = previous })
+	return conn
+}
+
+// testSaga registers a saga of steps named after their index whose execute
+// returns the matching error in fails, recording every call in calls.
+func testSaga(t *testing.T, retryOnlyLast bool, fails []error, compensateErr error) *[]string {
+	t.Helper()
+	var calls []string
+
+	steps := make([]sagaStep, len(fails))
+	for i := range fails {
+		name := string(rune('a' + i))
+		steps[i] = sagaStep{
+			name: name,
+			execute: func(*sagaData) error {
+				calls = append(calls, "execute "+name)
+				return fails[i]
+			},
+			compensate: func(*sagaData) error {
+				calls = append(calls, "compensate "+name)
+				return compensateErr
+			},
+			retryOnly: retryOnlyLast && i == len(fails)-1,
+		}
+	}
+
+	sagaDefinitions["test"] = steps
+	t.Cleanup(func() { delete(sagaDefinitions, "test") })
+	return &calls
+}
+
+func TestSagaCompensation(t *testing.T) {
+	rejected := newAPIError(400, "rejected")
+	down := newAPIError(503, "unavailable")
+
+	tests := []struct {
+		name          string
+		fails         []error
+		retryOnlyLast bool
+		compensateErr error
+		err           error
+		status        string
+		calls         []string
+	}{
+		{
+			name:   "all steps succeed",
+			fails:  []error{nil, nil, nil},
+			status: SagaCompleted,
+			calls:  []string{"execute a", "execute b", "execute c"},
+		},
+		{
+			name:   "rejected step unwinds the earlier ones",
+			fails:  []error{nil, nil, rejected},
+			err:    rejected,
+			status: SagaCompensated,
+			calls:  []string{"execute a", "execute b", "execute c", "compensate b", "compensate a"},
+		},
+		{
+			name:   "first step rejected",
+			fails:  []error{rejected, nil},
+			err:    rejected,
+			status: SagaCompensated,
+			calls:  []string{"execute a"},
+		},
+		{
+			name:   "transient failure is retried later",
+			fails:  []error{nil, down},
+			err:    errSagaPending,
+			status: SagaRunning,
+			calls:  []string{"execute a", "execute b"},
+		},
+		{
+			name:          "retry-only step never unwinds",
+			fails:         []error{nil, rejected},
+			retryOnlyLast: true,
+			err:           errSagaPending,
+			status:        SagaRunning,
+			calls:         []string{"execute a", "execute b"},
+		},
+		{
+			name:          "failed compensation is retried later",
+			fails:         []error{nil, rejected},
+			compensateErr: down,
+			err:           errSagaPending,
+			status:        SagaCompensating,
+			calls:         []string{"execute a", "execute b", "compensate a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testDB(t)
+			calls := testSaga(t, tt.retryOnlyLast, tt.fails, tt.compensateErr)
+
+			saga, err := startSaga("test", sagaData{BookingID: "bk_1"})
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+			if !slices.Equal(*calls, tt.calls) {
+				t.Errorf("got calls %v, want %v", *calls, tt.calls)
+			}
+
+			var stored Saga
+			if err := db.Where("saga_id = ?", saga.SagaID).First(&stored).Error; err != nil {
+				t.Fatal(err)
+			}
+			if stored.Status != tt.status {
+				t.Errorf("saga is %s, want %s", stored.Status, tt.status)
+			}
+		})
+	}
+}
+
+// TestSagaCompensatesExhaustedStep checks that a step which kept failing
+// with transient errors is compensated too, since it may have gone through.
+func TestSagaCompensatesExhaustedStep(t *testing.T) {
+	testDB(t)
+	calls := testSaga(t, false, []error{nil, newAPIError(503, "unavailable")}, nil)
+
+	saga, err := startSaga("test", sagaData{BookingID: "bk_1"})
+	for range sagaMaxAttempts {
+		if !errors.Is(err, errSagaPending) {
+			break
+		}
+		err = runSaga(saga)
+	}
+
+	if saga.Status != SagaCompensated {
+		t.Fatalf("saga is %s after %d attempts, want %s", saga.Status, sagaMaxAttempts, SagaCompensated)
+	}
+	if last := (*calls)[len(*calls)-2:]; !slices.Equal(last, []string{"compensate b", "compensate a"}) {
+		t.Errorf("ended with %v, want both steps compensated", last)
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/zensos/microservice-project/internal/rabbitmq"
+	"gorm.io/gorm"
+)
+
+// reserveSeats claims the seats under a HELD booking. The booking_seats unique
+// index makes a concurrent hold or booking on the same seat fail here, before
+// anyone is charged.
+func reserveSeats(data *sagaData) error {
+	ttl := holdTTL
+	if data.HoldMinutes > 0 {
+		ttl = time.Duration(data.HoldMinutes) * time.Minute
+	}
+	expiresAt := time.Now().Add(ttl)
+
+	txErr := db.Transaction(func(tx *gorm.DB) error {
+		var existing Booking
+		if err := tx.Where("booking_id = ?", data.BookingID).First(&existing).Error; err == nil {
+			return nil
+		}
+
+		booking := Booking{
+			BookingID:     data.BookingID,
+			EventID:       data.EventID,
+			MemberID:      data.MemberID,
+			TotalAmount:   data.TotalAmount,
+			Status:        StatusHeld,
+			HoldExpiresAt: &expiresAt,
+		}
+		if err := tx.Create(&booking).Error; err != nil {
+			return err
+		}
+
+		quotes := data.seatQuotes()
+		if err := checkTierQuotas(tx, data.EventID, quotes); err != nil {
+			return err
+		}
+
+		for _, quote := range quotes {
+			seat := BookingSeat{
+				BookingID: data.BookingID,
+				EventID:   data.EventID,
+				SeatID:    quote.SeatID,
+				TierID:    quote.TierID,
+				Tier:      quote.Tier,
+				Price:     quote.Price,
+			}
+			if err := tx.Create(&seat).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if txErr != nil {
+		if isDuplicateKeyError(txErr) {
+			return newAPIError(409, "one or more seats are already reserved")
+		}
+		return txErr
+	}
+
+	return nil
+}
+
+// seatQuotes falls back to splitting the total evenly for sagas started
+// before seats were priced individually.
+func (data *sagaData) seatQuotes() []seatQuote {
+	if len(data.Seats) > 0 {
+		return data.Seats
+	}
+
+	weights := make([]int64, len(data.SeatIDs))
+	for i := range weights {
+		weights[i] = 1
+	}
+	shares := data.TotalAmount.Allocate(weights...)
+
+	quotes := make([]seatQuote, len(data.SeatIDs))
+	for i, seatID := range data.SeatIDs {
+		quotes[i] = seatQuote{SeatID: seatID, Price: shares[i]}
+	}
+	return quotes
+}
+
+// checkTierQuotas refuses seats beyond a tier's quota. Reservations for the
+// event are serialized with an advisory lock so two bookings can't both take
+// the last seats of a tier.
+func checkTierQuotas(tx *gorm.DB, eventID uint, quotes []seatQuote) error {
+	requested := map[uint]int{}
+	quotas := map[uint]seatQuote{}
+	for _, quote := range quotes {
+		if quote.TierID == 0 || quote.Quota == 0 {
+			continue
+		}
+		requested[quote.TierID]++
+		quotas[quote.TierID] = quote
+	}
+	if len(requested) == 0 {
+		return nil
+	}
+
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", int64(eventID)).Error; err != nil {
+		return err
+	}
+
+	for tierID, count := range requested {
+		var sold int64
+		if err := tx.Model(&BookingSeat{}).
+			Where("event_id = ? AND tier_id = ?", eventID, tierID).
+			Count(&sold).Error; err != nil {
+			return err
+		}
+		if quote := quotas[tierID]; int(sold)+count > quote.Quota {
+			return newAPIError(409, "only %d %s tickets are left", max(quote.Quota-int(sold), 0), quote.Tier)
+		}
+	}
+
+	return nil
+}
+
+func failReservation(data *sagaData) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		_, err := releaseSeats(tx, data.BookingID, StatusFailed)
+		return err
+	})
+}
+
+// authorizeBooking holds the total in the member's wallet. Nothing is
+// charged until the booking is confirmed, so a failed booking only has to
+// give the hold back.
+func authorizeBooking(data *sagaData) error {
+	header, err := serviceAuthHeader()
+	if err != nil {
+		return err
+	}
+
+	err = authorizePayment(data.BookingID, data.MemberID, data.MemberEmail, data.TotalAmount, header)
+
+	// The booking ID is unique to this saga, so an existing payment for it
+	// means an earlier attempt went through.
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.Status == 409 {
+		return nil
+	}
+	return err
+}
+
+// voidBooking releases the hold. Sagas that started before holds existed
+// charged the wallet outright, which payment reports as a conflict, so
+// those are refunded instead.
+func voidBooking(data *sagaData) error {
+	header, err := serviceAuthHeader()
+	if err != nil {
+		return err
+	}
+
+	err = voidPayment(data.BookingID, data.MemberID, header)
+
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		switch apiErr.Status {
+		case 404:
+			return nil
+		case 409:
+			return refundBooking(data)
+		}
+	}
+	return err
+}
+
+// captureBooking charges the hold once the booking is confirmed. If the
+// hold ran out first the wallet is charged directly, since the seats are
+// already the member's. When that charge is refused, e.g. because the member
+// spent the money in the meantime, retrying won't help, so the booking is
+// cancelled and its seats given back instead.
+func captureBooking(data *sagaData) error {
+	header, err := serviceAuthHeader()
+	if err != nil {
+		return err
+	}
+
+	err = capturePayment(data.BookingID, data.MemberID, data.MemberEmail, header)
+
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.Status == 409 {
+		err = chargePayment(data.BookingID, data.MemberID, data.MemberEmail, data.TotalAmount, header)
+		if errors.As(err, &apiErr) {
+			switch apiErr.Status {
+			case 409:
+				return nil
+			case 400, 404:
+				// Retrying won't help when the member can't pay or has no
+				// wallet to pay from.
+				return cancelUnpaidBooking(data, apiErr.Message)
+			}
+		}
+	}
+	return err
+}
+
+// cancelUnpaidBooking cancels a confirmed booking that couldn't be paid for
+// and tells the member why.
+func cancelUnpaidBooking(data *sagaData, reason string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Booking{}).
+			Where("booking_id = ? AND status = ?", data.BookingID, StatusConfirmed).
+			Update("status", StatusCancelled)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		if err := tx.Where("booking_id = ?", data.BookingID).Delete(&BookingSeat{}).Error; err != nil {
+			return err
+		}
+
+		data.CancelReason = "payment failed: " + reason
+		return enqueueCancellationNotice(tx, data, false)
+	})
+}
+
+func refundBooking(data *sagaData) error {
+	header, err := serviceAuthHeader()
+	if err != nil {
+		return err
+	}
+
+	err = refundPayment(data.BookingID, data.MemberID, data.MemberEmail, data.TotalAmount, "refund-"+data.BookingID, header)
+
+	// No confirmed payment left means there is nothing (more) to refund.
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.Status == 404 {
+		return nil
+	}
+	return err
+}
+
+// confirmBooking flips the hold to CONFIRMED and queues the confirmation
+// message in the same transaction, so the email goes out exactly when the
+// booking is confirmed.
+func confirmBooking(data *sagaData) error {
+	var booking Booking
+	if err := db.Where("booking_id = ?", data.BookingID).First(&booking).Error; err != nil {
+		return err
+	}
+	if booking.Status == StatusConfirmed {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Booking{}).
+			Where("booking_id = ? AND status = ?", data.BookingID, StatusHeld).
+			Updates(map[string]any{"status": StatusConfirmed, "hold_expires_at": nil})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return newAPIError(410, "hold has expired")
+		}
+
+		mqEvent, _ := json.Marshal(map[string]any{
+			"booking_id":   data.BookingID,
+			"member_id":    data.MemberID,
+			"member_email": data.MemberEmail,
+			"member_name":  data.MemberName,
+			"event_name":   data.EventName,
+			"seat_ids":     data.SeatIDs,
+			"total_amount": data.TotalAmount,
+		})
+		return rabbitmq.Enqueue(tx, "booking.confirmed", mqEvent)
+	})
+}
+
+func markCancelling(data *sagaData) error {
+	result := db.Model(&Booking{}).
+		Where("booking_id = ? AND status = ?", data.BookingID, StatusConfirmed).
+		Update("status", StatusCancelling)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return newAPIError(409, "booking is no longer confirmed")
+	}
+	return nil
+}
+
+func unmarkCancelling(data *sagaData) error {
+	return db.Model(&Booking{}).
+		Where("booking_id = ? AND status = ?", data.BookingID, StatusCancelling).
+		Update("status", StatusConfirmed).Error
+}
+
+func refundSeats(data *sagaData) error {
+	if !data.RefundAmount.IsPositive() {
+		return nil
+	}
+
+	header, err := serviceAuthHeader()
+	if err != nil {
+		return err
+	}
+
+	err = refundPayment(data.BookingID, data.MemberID, data.MemberEmail, data.RefundAmount, data.RefundKey, header)
+
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.Status == 404 {
+		return nil
+	}
+	return err
+}
+
+// releaseCancelledSeats drops the cancelled seats and takes their share off
+// the booking total. The booking goes back to CONFIRMED, or CANCELLED once no
+// seats are left.
+func releaseCancelledSeats(data *sagaData) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var booking Booking
+		if err := tx.Where("booking_id = ? AND status = ?", data.BookingID, StatusCancelling).
+			First(&booking).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+
+		if err := tx.Where("booking_id = ? AND seat_id IN ?", data.BookingID, data.SeatIDs).
+			Delete(&BookingSeat{}).Error; err != nil {
+			return err
+		}
+
+		var remaining int64
+		if err := tx.Model(&BookingSeat{}).Where("booking_id = ?", data.BookingID).Count(&remaining).Error; err != nil {
+			return err
+		}
+
+		status := StatusConfirmed
+		if remaining == 0 {
+			status = StatusCancelled
+		}
+		total := booking.TotalAmount.Sub(data.RefundAmount)
+
+		return tx.Model(&booking).Updates(map[string]any{
+			"status":                status,
+			"total_amount_minor":    total.Minor,
+			"total_amount_currency": total.Currency,
+		}).Error
+	})
+}
+
+func cancelBooking(data *sagaData) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Booking{}).
+			Where("booking_id = ? AND status = ?", data.BookingID, StatusCancelling).
+			Update("status", StatusCancelled)
+		if result.Error != nil {
+			return result.Error
+		}
+		if err := tx.Where("booking_id = ?", data.BookingID).Delete(&BookingSeat{}).Error; err != nil {
+			return err
+		}
+
+		if result.RowsAffected == 0 || data.CancelReason == "" {
+			return nil
+		}
+		return enqueueCancellationNotice(tx, data, true)
+	})
+}
+
+func enqueueCancellationNotice(tx *gorm.DB, data *sagaData, refunded bool) error {
+	body, _ := json.Marshal(map[string]any{
+		"booking_id":   data.BookingID,
+		"member_id":    data.MemberID,
+		"member_email": data.MemberEmail,
+		"member_name":  data.MemberName,
+		"event_name":   data.EventName,
+		"reason":       data.CancelReason,
+		"refunded":     refunded,
+		"total_amount": data.TotalAmount,
+	})
+	return rabbitmq.Enqueue(tx, "booking.cancelled", body)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/zensos/microservice-project/internal/money"
+	"github.com/zensos/microservice-project/internal/rabbitmq"
+)
+
+func TestCancelUnpaidBooking(t *testing.T) {
+	conn := testDB(t)
+	total := money.New(30000, "THB")
+	conn.Create(&Booking{BookingID: "bk_1", EventID: 1, MemberID: "m1", TotalAmount: total, Status: StatusConfirmed})
+	conn.Create(&BookingSeat{BookingID: "bk_1", EventID: 1, SeatID: "A1", Price: total})
+
+	data := &sagaData{BookingID: "bk_1", MemberID: "m1", TotalAmount: total}
+	if err := cancelUnpaidBooking(data, "insufficient balance"); err != nil {
+		t.Fatal(err)
+	}
+	// A retried capture must not send a second notice.
+	if err := cancelUnpaidBooking(data, "insufficient balance"); err != nil {
+		t.Fatal(err)
+	}
+
+	var booking Booking
+	conn.Where("booking_id = ?", "bk_1").First(&booking)
+	if booking.Status != StatusCancelled {
+		t.Errorf("booking is %s, want %s", booking.Status, StatusCancelled)
+	}
+
+	var seats, notices int64
+	conn.Model(&BookingSeat{}).Where("booking_id = ?", "bk_1").Count(&seats)
+	conn.Model(&rabbitmq.OutboxMessage{}).Where("queue = ?", "booking.cancelled").Count(&notices)
+	if seats != 0 {
+		t.Errorf("%d seats are still taken", seats)
+	}
+	if notices != 1 {
+		t.Errorf("queued %d cancellation notices, want 1", notices)
+	}
+}
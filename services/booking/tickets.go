@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/zensos/microservice-project/internal/pagination"
+	"gorm.io/gorm"
+)
+
+var ticketSorts = pagination.Sorts{}.
+	Add("created_at", "created_at", pagination.KeyTime).
+	Add("total_amount", "total_amount_minor", pagination.KeyInt)
+
+func ticketSortKey(sort string) func(Booking) (any, uint) {
+	return func(b Booking) (any, uint) {
+		if strings.TrimPrefix(sort, "-") == "total_amount" {
+			return b.TotalAmount.Minor, b.ID
+		}
+		return b.CreatedAt, b.ID
+	}
+}
+
+var bookingStatuses = []string{
+	StatusHeld, StatusConfirmed, StatusCancelling, StatusCancelled, StatusExpired, StatusReleased, StatusFailed,
+}
+
+func filterTickets(c fiber.Ctx, memberID string) (*gorm.DB, error) {
+	query := db.Model(&Booking{}).Where("member_id = ?", memberID)
+
+	dates, err := pagination.ParseTimeRange(c)
+	if err != nil {
+		return nil, err
+	}
+	query = dates.Where(query, "created_at")
+
+	if raw := c.Query("status"); raw != "" {
+		statuses := strings.Split(strings.ToUpper(raw), ",")
+		for _, status := range statuses {
+			if !slices.Contains(bookingStatuses, status) {
+				return nil, errors.New("unknown booking status: " + status)
+			}
+		}
+		query = query.Where("status IN ?", statuses)
+	}
+
+	if raw := c.Query("event_id"); raw != "" {
+		eventID, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, errors.New("invalid event_id")
+		}
+		query = query.Where("event_id = ?", eventID)
+	}
+
+	// The same filters feed both the summary and the page.
+	return query.Session(&gorm.Session{}), nil
+}
+
+func listTickets(c fiber.Ctx) error {
+	memberID := c.Params("member_id")
+	if memberID == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "member_id is required"})
+	}
+
+	params, err := pagination.Parse(c, ticketSorts, "-created_at")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	query, err := filterTickets(c, memberID)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var counts []struct {
+		Status string
+		Count  int
+	}
+	if err := query.Select("status, count(*) AS count").Group("status").Scan(&counts).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to summarize bookings"})
+	}
+	byStatus := fiber.Map{}
+	total := 0
+	for _, row := range counts {
+		byStatus[row.Status] = row.Count
+		total += row.Count
+	}
+
+	var bookings []Booking
+	if err := pagination.Apply(query.Preload("Seats"), params).Find(&bookings).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to load bookings"})
+	}
+	page := pagination.NewPage(bookings, params, ticketSortKey(params.Sort.Name))
+
+	return c.JSON(fiber.Map{
+		"member_id": memberID,
+		"data":      page.Data,
+		"page":      page.Page,
+		"summary":   fiber.Map{"total": total, "by_status": byStatus},
+	})
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/zensos/microservice-project/internal/auth"
+	"github.com/zensos/microservice-project/internal/middleware"
+	"github.com/zensos/microservice-project/internal/money"
+	"github.com/zensos/microservice-project/internal/pagination"
+	"github.com/zensos/microservice-project/internal/rabbitmq"
+	"gorm.io/gorm"
+)
+
+func loadEvent(param string) (Event, *fiber.Error) {
+	var event Event
+	id, err := strconv.Atoi(param)
+	if err != nil {
+		return event, fiber.NewError(400, "invalid event id")
+	}
+	if err := db.First(&event, id).Error; err != nil {
+		return event, fiber.NewError(404, "event not found")
+	}
+	return event, nil
+}
+
+// loadManagedEvent loads the event for a change, which only its organizer
+// or an admin may make.
+func loadManagedEvent(c fiber.Ctx) (Event, *fiber.Error) {
+	event, ferr := loadEvent(c.Params("id"))
+	if ferr != nil {
+		return event, ferr
+	}
+	if !middleware.Can(c, auth.PermEventsManageAny) &&
+		(event.OrganizerID == "" || event.OrganizerID != middleware.Subject(c)) {
+		return event, fiber.NewError(403, "only the event's organizer can change it")
+	}
+	return event, nil
+}
+
+var eventSorts = pagination.Sorts{}.
+	Add("date", "date", pagination.KeyTime).
+	Add("price", "price_minor", pagination.KeyInt).
+	Add("name", "name", pagination.KeyString).
+	Add("created_at", "created_at", pagination.KeyTime)
+
+func eventSortKey(sort string) func(Event) (any, uint) {
+	return func(e Event) (any, uint) {
+		switch strings.TrimPrefix(sort, "-") {
+		case "price":
+			return e.Price.Minor, e.ID
+		case "name":
+			return e.Name, e.ID
+		case "created_at":
+			return e.CreatedAt, e.ID
+		}
+		return e.Date, e.ID
+	}
+}
+
+var errDraftsHidden = errors.New("only event managers can list draft events")
+
+// filterEvents applies the query string filters of GET /events. Prices are
+// compared in minor units of ?currency=, THB by default. Drafts are left
+// out unless an event manager asks for them with ?status=.
+func filterEvents(c fiber.Ctx, query *gorm.DB) (*gorm.DB, error) {
+	dates, err := pagination.ParseTimeRange(c)
+	if err != nil {
+		return nil, err
+	}
+	query = dates.Where(query, "date")
+
+	if raw := c.Query("venue_id"); raw != "" {
+		venueID, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, errors.New("invalid venue_id")
+		}
+		query = query.Where("venue_id = ?", venueID)
+	}
+	if venue := strings.TrimSpace(c.Query("venue")); venue != "" {
+		query = query.Where("venue ILIKE ?", "%"+venue+"%")
+	}
+
+	currency := c.Query("currency", money.DefaultCurrency)
+	for _, param := range []string{"min_price", "max_price"} {
+		raw := c.Query(param)
+		if raw == "" {
+			continue
+		}
+		price, err := money.Parse(raw, currency)
+		if err != nil {
+			return nil, errors.New("invalid " + param)
+		}
+		op := ">="
+		if param == "max_price" {
+			op = "<="
+		}
+		query = query.Where("price_currency = ? AND price_minor "+op+" ?", price.Currency, price.Minor)
+	}
+
+	if raw := c.Query("status"); raw != "" {
+		statuses := strings.Split(raw, ",")
+		for _, status := range statuses {
+			if _, ok := eventTransitions[status]; !ok {
+				return nil, errors.New("unknown status: " + status)
+			}
+		}
+		query = query.Where("status IN ?", statuses)
+
+		if slices.Contains(statuses, StatusDraft) {
+			if !middleware.Can(c, auth.PermEventsManage) {
+				return nil, errDraftsHidden
+			}
+			// Organizers only see their own drafts.
+			if !middleware.Can(c, auth.PermEventsManageAny) {
+				query = query.Where("status <> ? OR organizer_id = ?", StatusDraft, middleware.Subject(c))
+			}
+		}
+	} else {
+		query = query.Where("status <> ?", StatusDraft)
+	}
+
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		query = query.Where("to_tsvector('simple', name) @@ plainto_tsquery('simple', ?)", q)
+	}
+
+	return query, nil
+}
+
+func listEvents(c fiber.Ctx) error {
+	params, err := pagination.Parse(c, eventSorts, "date")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	query, err := filterEvents(c, db.Model(&Event{}))
+	if errors.Is(err, errDraftsHidden) {
+		return c.Status(403).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var events []Event
+	if err := pagination.Apply(query, params).Find(&events).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to load events"})
+	}
+	return c.JSON(pagination.NewPage(events, params, eventSortKey(params.Sort.Name)))
+}
+
+var errEventChanged = errors.New("event changed concurrently")
+
+func isFinal(status string) bool {
+	return status == StatusCompleted || status == StatusCancelled
+}
+
+func updateEvent(c fiber.Ctx) error {
+	var req UpdateEventRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid request body"})
+	}
+
+	event, ferr := loadManagedEvent(c)
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{"error": ferr.Message})
+	}
+	if isFinal(event.Status) {
+		return c.Status(409).JSON(fiber.Map{"error": "event is " + event.Status + " and can't be changed"})
+	}
+
+	updates := map[string]any{}
+
+	if req.Name != nil {
+		if strings.TrimSpace(*req.Name) == "" {
+			return c.Status(400).JSON(fiber.Map{"error": "name can't be empty"})
+		}
+		updates["name"] = *req.Name
+	}
+	if req.Date != nil {
+		updates["date"] = *req.Date
+	}
+
+	if req.Price != nil {
+		if req.Price.IsNegative() {
+			return c.Status(400).JSON(fiber.Map{"error": "price can't be negative"})
+		}
+		if !req.Price.SameCurrency(event.Price) {
+			var tiers int64
+			db.Model(&TicketTier{}).Where("event_id = ?", event.ID).Count(&tiers)
+			if tiers > 0 {
+				return c.Status(409).JSON(fiber.Map{"error": "can't change the currency of an event with ticket tiers"})
+			}
+		}
+		price := money.New(req.Price.Minor, req.Price.Currency)
+		updates["price_minor"] = price.Minor
+		updates["price_currency"] = price.Currency
+	}
+
+	if req.VenueID != nil || req.Venue != nil {
+		// Seats may already be sold against the current seat map.
+		if event.Status != StatusDraft && event.Status != StatusPublished {
+			return c.Status(409).JSON(fiber.Map{"error": "the venue can't be changed once tickets are on sale"})
+		}
+	}
+	if req.VenueID != nil {
+		var venue Venue
+		if err := db.First(&venue, *req.VenueID).Error; err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "venue not found"})
+		}
+		var tiers int64
+		db.Model(&TicketTier{}).Where("event_id = ?", event.ID).Count(&tiers)
+		if tiers > 0 && (event.VenueID == nil || *event.VenueID != venue.ID) {
+			return c.Status(409).JSON(fiber.Map{"error": "remove the event's ticket tiers before moving it to another venue"})
+		}
+		updates["venue_id"] = venue.ID
+		if req.Venue == nil {
+			updates["venue"] = venue.Name
+		}
+	}
+	if req.Venue != nil {
+		updates["venue"] = *req.Venue
+	}
+
+	if len(updates) == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "nothing to update"})
+	}
+
+	result := db.Model(&Event{}).Where("id = ? AND status = ?", event.ID, event.Status).Updates(updates)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to update event"})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(409).JSON(fiber.Map{"error": "event changed while updating, please retry"})
+	}
+
+	db.Preload("Tiers.Sections").First(&event, event.ID)
+	return c.JSON(event)
+}
+
+// deleteEvent only removes drafts. Anything that was published may have
+// bookings and has to be cancelled instead.
+func deleteEvent(c fiber.Ctx) error {
+	event, ferr := loadManagedEvent(c)
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{"error": ferr.Message})
+	}
+	if event.Status != StatusDraft {
+		return c.Status(409).JSON(fiber.Map{"error": "only draft events can be deleted, cancel it instead"})
+	}
+
+	result := db.Where("id = ? AND status = ?", event.ID, StatusDraft).Delete(&Event{})
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to delete event"})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(409).JSON(fiber.Map{"error": "event changed while deleting, please retry"})
+	}
+
+	return c.JSON(fiber.Map{"message": "event deleted", "id": event.ID})
+}
+
+func changeEventStatus(c fiber.Ctx) error {
+	var req ChangeStatusRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid request body"})
+	}
+	if _, ok := eventTransitions[req.Status]; !ok {
+		return c.Status(400).JSON(fiber.Map{"error": "unknown status: " + req.Status})
+	}
+
+	event, ferr := loadManagedEvent(c)
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{"error": ferr.Message})
+	}
+	if !slices.Contains(eventTransitions[event.Status], req.Status) {
+		return c.Status(409).JSON(fiber.Map{"error": "event can't go from " + event.Status + " to " + req.Status})
+	}
+
+	// Cancelling publishes event.cancelled in the same transaction, and the
+	// booking service refunds every booking of the event from there.
+	txErr := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Event{}).Where("id = ? AND status = ?", event.ID, event.Status).Update("status", req.Status)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errEventChanged
+		}
+		if req.Status != StatusCancelled {
+			return nil
+		}
+
+		body, _ := json.Marshal(map[string]any{
+			"event_id":     event.ID,
+			"event_name":   event.Name,
+			"reason":       req.Reason,
+			"cancelled_at": time.Now(),
+		})
+		return rabbitmq.Enqueue(tx, "event.cancelled", body)
+	})
+	if errors.Is(txErr, errEventChanged) {
+		return c.Status(409).JSON(fiber.Map{"error": "event changed while updating, please retry"})
+	}
+	if txErr != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to update event status"})
+	}
+
+	event.Status = req.Status
+	return c.JSON(event)
+}
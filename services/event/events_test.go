@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/gofiber/fiber/v3"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/zensos/microservice-project/internal/auth"
+	"github.com/zensos/microservice-project/internal/middleware"
+	"github.com/zensos/microservice-project/internal/rabbitmq"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testKeys signs the tokens of the tests and verifies them again.
+type testKeys struct {
+	key *rsa.PrivateKey
+}
+
+func (k testKeys) PublicKey(kid string) (*rsa.PublicKey, error) {
+	return &k.key.PublicKey, nil
+}
+
+func (k testKeys) token(t *testing.T, role auth.Role, subject string) string {
+	t.Helper()
+	token, err := auth.Sign("test", k.key, &auth.Claims{
+		Role: role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    auth.Issuer,
+			Subject:   subject,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + token
+}
+
+// testApp points the package's db at a fresh in-memory database and serves
+// the event routes the tests need.
+func testApp(t *testing.T) (*fiber.App, testKeys) {
+	t.Helper()
+	conn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.AutoMigrate(&Event{}, &Venue{}, &Section{}, &SeatRow{}, &Seat{}, &TicketTier{}, &rabbitmq.OutboxMessage{}); err != nil {
+		t.Fatal(err)
+	}
+	previous := db
+	db = conn
+	t.Cleanup(func() { db = previous })
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := testKeys{key: key}
+
+	app := fiber.New()
+	verifier := auth.NewVerifier(keys)
+	authn := middleware.Authenticate(verifier)
+	app.Get("/events", middleware.OptionalAuthenticate(verifier), listEvents)
+	app.Patch("/events/:id", authn, middleware.Authorize(auth.PermEventsManage), updateEvent)
+	app.Delete("/events/:id", authn, middleware.Authorize(auth.PermEventsManage), deleteEvent)
+	app.Post("/events/:id/status", authn, middleware.Authorize(auth.PermEventsManage), changeEventStatus)
+	app.Post("/venues", authn, middleware.Authorize(auth.PermEventsCreate), createVenue)
+	return app, keys
+}
+
+func send(t *testing.T, app *fiber.App, method, path, authHeader, body string) int {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if authHeader != "" {
+		req.Header.Set("Authorization", authHeader)
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+func TestManageEvent(t *testing.T) {
+	requests := []struct {
+		name, method, path, body string
+	}{
+		{"update", "PATCH", "/events/1", `{"name":"Renamed"}`},
+		{"publish", "POST", "/events/1/status", `{"status":"published"}`},
+		{"delete", "DELETE", "/events/1", ``},
+	}
+	callers := []struct {
+		name      string
+		role      auth.Role
+		subject   string
+		organizer string
+		want      int
+	}{
+		{"organizer", auth.RoleOrganizer, "org1", "org1", 200},
+		{"other organizer", auth.RoleOrganizer, "org2", "org1", 403},
+		{"admin", auth.RoleAdmin, "admin", "org1", 200},
+		{"organizer of a legacy event", auth.RoleOrganizer, "org1", "", 403},
+		{"admin on a legacy event", auth.RoleAdmin, "admin", "", 200},
+		{"member", auth.RoleMember, "org1", "org1", 403},
+	}
+
+	for _, req := range requests {
+		for _, caller := range callers {
+			t.Run(req.name+" by "+caller.name, func(t *testing.T) {
+				app, keys := testApp(t)
+				db.Create(&Event{Name: "Concert", Status: StatusDraft, OrganizerID: caller.organizer})
+
+				got := send(t, app, req.method, req.path, keys.token(t, caller.role, caller.subject), req.body)
+				if got != caller.want {
+					t.Errorf("got status %d, want %d", got, caller.want)
+				}
+
+				var event Event
+				changed := db.Unscoped().First(&event, 1).Error != nil ||
+					event.Name != "Concert" || event.Status != StatusDraft || event.DeletedAt.Valid
+				if changed != (caller.want == 200) {
+					t.Errorf("event changed = %v after status %d", changed, got)
+				}
+			})
+		}
+	}
+}
+
+func TestManageMissingEvent(t *testing.T) {
+	app, keys := testApp(t)
+	if got := send(t, app, "PATCH", "/events/42", keys.token(t, auth.RoleOrganizer, "org1"), `{"name":"x"}`); got != 404 {
+		t.Errorf("got status %d, want 404", got)
+	}
+}
+
+func TestListEventsDrafts(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		role   auth.Role
+		status int
+		want   []string
+	}{
+		{"anonymous", "", "", 200, []string{"Live"}},
+		{"anonymous asking for drafts", "?status=draft", "", 403, nil},
+		{"member asking for drafts", "?status=draft,published", auth.RoleMember, 403, nil},
+		{"organizer without status", "", auth.RoleOrganizer, 200, []string{"Live"}},
+		{"organizer asking for drafts", "?status=draft", auth.RoleOrganizer, 200, []string{"Own draft"}},
+		{"organizer asking for published", "?status=published", auth.RoleOrganizer, 200, []string{"Live"}},
+		{"admin asking for drafts", "?status=draft", auth.RoleAdmin, 200, []string{"Own draft", "Other draft"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, keys := testApp(t)
+			date := time.Now().Add(24 * time.Hour)
+			db.Create(&[]Event{
+				{Name: "Own draft", Status: StatusDraft, OrganizerID: "org1", Date: date},
+				{Name: "Other draft", Status: StatusDraft, OrganizerID: "org2", Date: date.Add(time.Hour)},
+				{Name: "Live", Status: StatusPublished, OrganizerID: "org2", Date: date.Add(2 * time.Hour)},
+			})
+
+			req := httptest.NewRequest("GET", "/events"+tt.query, nil)
+			if tt.role != "" {
+				req.Header.Set("Authorization", keys.token(t, tt.role, "org1"))
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status != 200 {
+				return
+			}
+
+			var page struct{ Data []Event }
+			if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, event := range page.Data {
+				got = append(got, event.Name)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got events %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -8,19 +8,48 @@ import (
 	"syscall"
 
 	"github.com/gofiber/fiber/v3"
+	"github.com/gofiber/fiber/v3/middleware/recover"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/sony/gobreaker/v2"
+	"github.com/zensos/microservice-project/internal/auth"
+	"github.com/zensos/microservice-project/internal/circuitbreaker"
 	"github.com/zensos/microservice-project/internal/common"
 	"github.com/zensos/microservice-project/internal/database"
 	"github.com/zensos/microservice-project/internal/middleware"
+	"github.com/zensos/microservice-project/internal/money"
+	"github.com/zensos/microservice-project/internal/rabbitmq"
 	"gorm.io/gorm"
 )
 
-var db *gorm.DB
+var (
+	db           *gorm.DB
+	consulClient *consul.Client
+	bookingCB    *gobreaker.CircuitBreaker[circuitbreaker.BreakerResponse]
+)
 
 func main() {
 	db = database.Connect()
-	db.AutoMigrate(&Event{})
+	hadStatus := db.Migrator().HasColumn(&Event{}, "status")
+	db.AutoMigrate(&Event{}, &Venue{}, &Section{}, &SeatRow{}, &Seat{}, &TicketTier{}, &rabbitmq.OutboxMessage{})
+	if err := money.MigrateFloatColumn(db, "events", "price", money.DefaultCurrency); err != nil {
+		log.Fatalf("couldn't migrate event prices: %v", err)
+	}
+	// Events from before the lifecycle existed were already being sold.
+	if !hadStatus {
+		db.Model(&Event{}).Where("1 = 1").Update("status", StatusOnSale)
+	}
+
+	// Backs the ?q= search of GET /events.
+	db.Exec("CREATE INDEX IF NOT EXISTS idx_events_name_fts ON events USING GIN (to_tsvector('simple', name))")
+
+	mqConn := rabbitmq.Connect()
+	defer mqConn.Close()
+	rabbitmq.StartRelay(db, mqConn, rabbitmq.RelayConfig{})
+
+	bookingCB = circuitbreaker.NewBreaker("booking-service")
 
 	app := fiber.New()
+	app.Use(recover.New())
 
 	app.Use(middleware.RateLimiter(middleware.RateLimiterConfig{
 		Max:        100,
@@ -35,11 +64,20 @@ func main() {
 		return c.JSON(fiber.Map{"status": "ok", "service": "event"})
 	})
 
-	app.Get("/events", func(c fiber.Ctx) error {
-		var events []Event
-		db.Find(&events)
-		return c.JSON(events)
+	var serviceID string
+	var err error
+	consulClient, serviceID, err = common.RegisterService(common.ServiceConfig{
+		Name: "event",
+		Port: 3002,
 	})
+	if err != nil {
+		log.Printf("Warning: failed to register with Consul: %v", err)
+	}
+
+	verifier := auth.NewVerifier(auth.MemberJWKS(consulClient))
+	authn := middleware.Authenticate(verifier)
+
+	app.Get("/events", middleware.OptionalAuthenticate(verifier), listEvents)
 
 	app.Get("/events/:id", func(c fiber.Ctx) error {
 		id, err := strconv.Atoi(c.Params("id"))
@@ -48,33 +86,49 @@ func main() {
 		}
 
 		var event Event
-		if err := db.First(&event, id).Error; err != nil {
+		if err := db.Preload("Tiers.Sections").First(&event, id).Error; err != nil {
 			return c.Status(404).JSON(fiber.Map{"error": "event not found"})
 		}
 
 		return c.JSON(event)
 	})
 
-	app.Post("/events", func(c fiber.Ctx) error {
+	app.Post("/events", authn, middleware.Authorize(auth.PermEventsCreate), func(c fiber.Ctx) error {
 		var event Event
 		if err := c.Bind().JSON(&event); err != nil {
 			return c.Status(400).JSON(fiber.Map{"error": "invalid request body"})
 		}
+		if event.VenueID != nil {
+			var venue Venue
+			if err := db.First(&venue, *event.VenueID).Error; err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "venue not found"})
+			}
+			if event.Venue == "" {
+				event.Venue = venue.Name
+			}
+		}
+		if event.Price.IsNegative() {
+			return c.Status(400).JSON(fiber.Map{"error": "price can't be negative"})
+		}
+		event.Price = money.New(event.Price.Minor, event.Price.Currency)
+		event.Status = StatusDraft
+		event.OrganizerID = middleware.Subject(c)
 
-		if err := db.Create(&event).Error; err != nil {
+		if err := db.Omit("Tiers").Create(&event).Error; err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": "failed to create event"})
 		}
 
 		return c.Status(201).JSON(event)
 	})
 
-	consulClient, serviceID, err := common.RegisterService(common.ServiceConfig{
-		Name: "event",
-		Port: 3002,
-	})
-	if err != nil {
-		log.Printf("Warning: failed to register with Consul: %v", err)
-	}
+	app.Patch("/events/:id", authn, middleware.Authorize(auth.PermEventsManage), updateEvent)
+	app.Delete("/events/:id", authn, middleware.Authorize(auth.PermEventsManage), deleteEvent)
+	app.Post("/events/:id/status", authn, middleware.Authorize(auth.PermEventsManage), changeEventStatus)
+	app.Get("/events/:id/seats", getEventSeats)
+	app.Get("/events/:id/tiers", listTiers)
+	app.Post("/events/:id/tiers", authn, middleware.Authorize(auth.PermEventsCreate), createTier)
+	app.Post("/venues", authn, middleware.Authorize(auth.PermEventsCreate), createVenue)
+	app.Get("/venues/:id", getVenue)
 
 	go func() {
 		quit := make(chan os.Signal, 1)
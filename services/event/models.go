@@ -3,16 +3,136 @@ package main
 import (
 	"time"
 
+	"github.com/zensos/microservice-project/internal/money"
 	"gorm.io/gorm"
 )
 
+const (
+	StatusDraft     = "draft"
+	StatusPublished = "published"
+	StatusOnSale    = "on_sale"
+	StatusSoldOut   = "sold_out"
+	StatusCompleted = "completed"
+	StatusCancelled = "cancelled"
+)
+
+// eventTransitions lists the statuses an event can move to from each status.
+var eventTransitions = map[string][]string{
+	StatusDraft:     {StatusPublished, StatusCancelled},
+	StatusPublished: {StatusOnSale, StatusCancelled},
+	StatusOnSale:    {StatusSoldOut, StatusCompleted, StatusCancelled},
+	StatusSoldOut:   {StatusOnSale, StatusCompleted, StatusCancelled},
+	StatusCompleted: {},
+	StatusCancelled: {},
+}
+
 type Event struct {
+	ID      uint        `json:"id" gorm:"primaryKey"`
+	Name    string      `json:"name"`
+	Price   money.Money `json:"price" gorm:"embedded;embeddedPrefix:price_"`
+	Date    time.Time   `json:"date"`
+	Venue   string      `json:"venue"`
+	Status  string      `json:"status" gorm:"default:draft;index"`
+	VenueID *uint       `json:"venue_id,omitempty" gorm:"index"`
+	// OrganizerID is the member who created the event. Events from before
+	// it was recorded can only be managed by admins.
+	OrganizerID string         `json:"organizer_id,omitempty" gorm:"index"`
+	Tiers       []TicketTier   `json:"tiers,omitempty"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+	DeletedAt   gorm.DeletedAt `json:"-" gorm:"index"`
+}
+
+type UpdateEventRequest struct {
+	Name    *string      `json:"name"`
+	Price   *money.Money `json:"price"`
+	Date    *time.Time   `json:"date"`
+	Venue   *string      `json:"venue"`
+	VenueID *uint        `json:"venue_id"`
+}
+
+type ChangeStatusRequest struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type Venue struct {
 	ID        uint           `json:"id" gorm:"primaryKey"`
 	Name      string         `json:"name"`
-	Price     float64        `json:"price"`
-	Date      time.Time      `json:"date"`
-	Venue     string         `json:"venue"`
+	Address   string         `json:"address"`
+	Sections  []Section      `json:"sections,omitempty"`
 	CreatedAt time.Time      `json:"created_at"`
 	UpdatedAt time.Time      `json:"updated_at"`
 	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
 }
+
+type Section struct {
+	ID      uint      `json:"id" gorm:"primaryKey"`
+	VenueID uint      `json:"venue_id" gorm:"index"`
+	Name    string    `json:"name"`
+	Rows    []SeatRow `json:"rows,omitempty" gorm:"foreignKey:SectionID"`
+}
+
+type SeatRow struct {
+	ID        uint   `json:"id" gorm:"primaryKey"`
+	SectionID uint   `json:"section_id" gorm:"index"`
+	Label     string `json:"label"`
+	Seats     []Seat `json:"seats,omitempty" gorm:"foreignKey:RowID"`
+}
+
+// Seat.Code is the seat_id bookings refer to, e.g. "VIP-A12".
+type Seat struct {
+	ID        uint   `json:"id" gorm:"primaryKey"`
+	VenueID   uint   `json:"venue_id" gorm:"uniqueIndex:idx_seats_venue_code"`
+	SectionID uint   `json:"section_id" gorm:"index"`
+	RowID     uint   `json:"row_id" gorm:"index"`
+	Number    int    `json:"number"`
+	Code      string `json:"seat_id" gorm:"uniqueIndex:idx_seats_venue_code"`
+}
+
+// TicketTier prices the seats of the sections it covers. Quota caps how many
+// seats of the tier can be sold; zero means no cap.
+type TicketTier struct {
+	ID             uint        `json:"id" gorm:"primaryKey"`
+	EventID        uint        `json:"event_id" gorm:"index"`
+	Name           string      `json:"name"`
+	Price          money.Money `json:"price" gorm:"embedded;embeddedPrefix:price_"`
+	EarlyBirdPrice money.Money `json:"early_bird_price" gorm:"embedded;embeddedPrefix:early_bird_price_"`
+	EarlyBirdUntil *time.Time  `json:"early_bird_until,omitempty"`
+	Quota          int         `json:"quota"`
+	Sections       []Section   `json:"sections,omitempty" gorm:"many2many:ticket_tier_sections"`
+	CreatedAt      time.Time   `json:"created_at"`
+	UpdatedAt      time.Time   `json:"updated_at"`
+}
+
+func (t TicketTier) PriceAt(now time.Time) money.Money {
+	if t.EarlyBirdUntil != nil && now.Before(*t.EarlyBirdUntil) {
+		return t.EarlyBirdPrice
+	}
+	return t.Price
+}
+
+type CreateTierRequest struct {
+	Name           string       `json:"name"`
+	Price          money.Money  `json:"price"`
+	EarlyBirdPrice *money.Money `json:"early_bird_price,omitempty"`
+	EarlyBirdUntil *time.Time   `json:"early_bird_until,omitempty"`
+	Quota          int          `json:"quota"`
+	SectionIDs     []uint       `json:"section_ids"`
+}
+
+type CreateVenueRequest struct {
+	Name     string                 `json:"name"`
+	Address  string                 `json:"address"`
+	Sections []CreateSectionRequest `json:"sections"`
+}
+
+type CreateSectionRequest struct {
+	Name string             `json:"name"`
+	Rows []CreateRowRequest `json:"rows"`
+}
+
+type CreateRowRequest struct {
+	Label string `json:"label"`
+	Seats int    `json:"seats"`
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/sony/gobreaker/v2"
+	"github.com/zensos/microservice-project/internal/circuitbreaker"
+	"github.com/zensos/microservice-project/internal/common"
+	"github.com/zensos/microservice-project/internal/money"
+	"gorm.io/gorm"
+)
+
+const (
+	maxSeatsPerRow   = 500
+	maxSeatsPerVenue = 20000
+)
+
+func seatCode(section, row string, number int) string {
+	return fmt.Sprintf("%s-%s%d", section, row, number)
+}
+
+// validateVenueRequest also makes sure no two seats end up with the same
+// code, which labels like row "1" seat 11 and row "11" seat 1 would.
+func validateVenueRequest(req CreateVenueRequest) error {
+	if req.Name == "" {
+		return errors.New("name is required")
+	}
+	if len(req.Sections) == 0 {
+		return errors.New("sections must not be empty")
+	}
+
+	sections := map[string]bool{}
+	codes := map[string]bool{}
+	for _, section := range req.Sections {
+		if section.Name == "" {
+			return errors.New("section name is required")
+		}
+		if sections[section.Name] {
+			return fmt.Errorf("duplicate section: %s", section.Name)
+		}
+		sections[section.Name] = true
+
+		if len(section.Rows) == 0 {
+			return fmt.Errorf("section %s has no rows", section.Name)
+		}
+		rows := map[string]bool{}
+		for _, row := range section.Rows {
+			if row.Label == "" {
+				return fmt.Errorf("row label is required in section %s", section.Name)
+			}
+			if rows[row.Label] {
+				return fmt.Errorf("duplicate row %s in section %s", row.Label, section.Name)
+			}
+			rows[row.Label] = true
+
+			if row.Seats < 1 || row.Seats > maxSeatsPerRow {
+				return fmt.Errorf("row %s in section %s must have between 1 and %d seats", row.Label, section.Name, maxSeatsPerRow)
+			}
+			if len(codes)+row.Seats > maxSeatsPerVenue {
+				return fmt.Errorf("a venue can't have more than %d seats", maxSeatsPerVenue)
+			}
+
+			for n := 1; n <= row.Seats; n++ {
+				code := seatCode(section.Name, row.Label, n)
+				if codes[code] {
+					return fmt.Errorf("seat %s would exist twice, rename row %s in section %s", code, row.Label, section.Name)
+				}
+				codes[code] = true
+			}
+		}
+	}
+
+	return nil
+}
+
+func createVenue(c fiber.Ctx) error {
+	var req CreateVenueRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid request body"})
+	}
+	if err := validateVenueRequest(req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	venue := Venue{Name: req.Name, Address: req.Address}
+
+	txErr := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&venue).Error; err != nil {
+			return err
+		}
+
+		for _, s := range req.Sections {
+			section := Section{VenueID: venue.ID, Name: s.Name}
+			if err := tx.Create(&section).Error; err != nil {
+				return err
+			}
+
+			for _, r := range s.Rows {
+				row := SeatRow{SectionID: section.ID, Label: r.Label}
+				if err := tx.Create(&row).Error; err != nil {
+					return err
+				}
+
+				seats := make([]Seat, 0, r.Seats)
+				for n := 1; n <= r.Seats; n++ {
+					seats = append(seats, Seat{
+						VenueID:   venue.ID,
+						SectionID: section.ID,
+						RowID:     row.ID,
+						Number:    n,
+						Code:      seatCode(s.Name, r.Label, n),
+					})
+				}
+				if err := tx.Create(&seats).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	if txErr != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to create venue"})
+	}
+
+	if err := loadVenue(&venue, venue.ID); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to load venue"})
+	}
+	return c.Status(201).JSON(venue)
+}
+
+func loadVenue(venue *Venue, id uint) error {
+	return db.Preload("Sections", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order("id")
+	}).Preload("Sections.Rows", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order("id")
+	}).Preload("Sections.Rows.Seats", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order("number")
+	}).First(venue, id).Error
+}
+
+func getVenue(c fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid venue id"})
+	}
+
+	var venue Venue
+	if err := loadVenue(&venue, uint(id)); err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "venue not found"})
+	}
+	return c.JSON(venue)
+}
+
+type seatAvailability struct {
+	SeatID    string `json:"seat_id"`
+	Number    int    `json:"number"`
+	Available *bool  `json:"available,omitempty"`
+}
+
+type rowAvailability struct {
+	Label string             `json:"label"`
+	Seats []seatAvailability `json:"seats"`
+}
+
+type tierQuote struct {
+	ID    uint        `json:"id"`
+	Name  string      `json:"name"`
+	Price money.Money `json:"price"`
+	Quota int         `json:"quota"`
+}
+
+// Sections without a tier are sold at the event price.
+type sectionAvailability struct {
+	ID   uint              `json:"id"`
+	Name string            `json:"name"`
+	Tier *tierQuote        `json:"tier,omitempty"`
+	Rows []rowAvailability `json:"rows"`
+}
+
+// getEventSeats returns the seat map of the event's venue. Availability comes
+// from the booking service and is skipped with ?availability=false, which is
+// what booking itself uses to validate seat IDs.
+func getEventSeats(c fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid event id"})
+	}
+
+	var event Event
+	if err := db.First(&event, id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "event not found"})
+	}
+	if event.VenueID == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "event has no seat map"})
+	}
+
+	var venue Venue
+	if err := loadVenue(&venue, *event.VenueID); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to load seat map"})
+	}
+
+	tiers, err := sectionTiers(event.ID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to load ticket tiers"})
+	}
+
+	withAvailability := c.Query("availability") != "false"
+	var taken map[string]bool
+	if withAvailability {
+		taken, err = fetchTakenSeats(event.ID)
+		if err != nil {
+			return c.Status(502).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+
+	now := time.Now()
+	total, available := 0, 0
+	sections := make([]sectionAvailability, 0, len(venue.Sections))
+	for _, section := range venue.Sections {
+		s := sectionAvailability{ID: section.ID, Name: section.Name, Rows: []rowAvailability{}}
+		if tier, ok := tiers[section.ID]; ok {
+			s.Tier = &tierQuote{ID: tier.ID, Name: tier.Name, Price: tier.PriceAt(now), Quota: tier.Quota}
+		}
+		for _, row := range section.Rows {
+			r := rowAvailability{Label: row.Label, Seats: make([]seatAvailability, 0, len(row.Seats))}
+			for _, seat := range row.Seats {
+				entry := seatAvailability{SeatID: seat.Code, Number: seat.Number}
+				if withAvailability {
+					free := !taken[seat.Code]
+					entry.Available = &free
+					if free {
+						available++
+					}
+				}
+				total++
+				r.Seats = append(r.Seats, entry)
+			}
+			s.Rows = append(s.Rows, r)
+		}
+		sections = append(sections, s)
+	}
+
+	resp := fiber.Map{
+		"event_id": event.ID,
+		"venue_id": venue.ID,
+		"venue":    venue.Name,
+		"price":    event.Price,
+		"total":    total,
+		"sections": sections,
+	}
+	if withAvailability {
+		resp["available"] = available
+	}
+	return c.JSON(resp)
+}
+
+func fetchTakenSeats(eventID uint) (map[string]bool, error) {
+	if consulClient == nil {
+		return nil, errors.New("service discovery is not available right now")
+	}
+
+	addr, err := common.DiscoverService(consulClient, "booking")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't find the booking service: %v", err)
+	}
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s/bookings/events/%d/seats", addr, eventID), nil)
+	resp, err := circuitbreaker.Do(bookingCB, req)
+	if err != nil {
+		if errors.Is(err, gobreaker.ErrOpenState) {
+			return nil, errors.New("booking service is temporarily unavailable")
+		}
+		return nil, fmt.Errorf("couldn't reach the booking service: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		return nil, errors.New("booking service error")
+	}
+
+	var body struct {
+		SeatIDs []string `json:"seat_ids"`
+	}
+	if err := json.Unmarshal(resp.Body, &body); err != nil {
+		return nil, errors.New("got a bad response from the booking service")
+	}
+
+	taken := make(map[string]bool, len(body.SeatIDs))
+	for _, seatID := range body.SeatIDs {
+		taken[seatID] = true
+	}
+	return taken, nil
+}
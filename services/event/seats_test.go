@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/zensos/microservice-project/internal/auth"
+)
+
+func TestValidateVenueRequest(t *testing.T) {
+	row := func(label string, seats int) CreateRowRequest {
+		return CreateRowRequest{Label: label, Seats: seats}
+	}
+	venue := func(sections ...CreateSectionRequest) CreateVenueRequest {
+		return CreateVenueRequest{Name: "Hall", Sections: sections}
+	}
+
+	tests := []struct {
+		name string
+		req  CreateVenueRequest
+		err  string
+	}{
+		{"valid", venue(CreateSectionRequest{"A", []CreateRowRequest{row("A", 10), row("B", 10)}}), ""},
+		{"no name", CreateVenueRequest{Sections: []CreateSectionRequest{{"A", []CreateRowRequest{row("A", 1)}}}}, "name is required"},
+		{"no sections", venue(), "sections must not be empty"},
+		{"duplicate section", venue(CreateSectionRequest{"A", []CreateRowRequest{row("A", 1)}}, CreateSectionRequest{"A", []CreateRowRequest{row("B", 1)}}), "duplicate section"},
+		{"duplicate row", venue(CreateSectionRequest{"A", []CreateRowRequest{row("A", 1), row("A", 1)}}), "duplicate row"},
+		{"empty row", venue(CreateSectionRequest{"A", []CreateRowRequest{row("A", 0)}}), "between 1 and"},
+		{"row too long", venue(CreateSectionRequest{"A", []CreateRowRequest{row("A", maxSeatsPerRow+1)}}), "between 1 and"},
+		{"numeric rows with clashing codes", venue(CreateSectionRequest{"A", []CreateRowRequest{row("1", 11), row("11", 1)}}), "A-111 would exist twice"},
+		{"sections with clashing codes", venue(
+			CreateSectionRequest{"A", []CreateRowRequest{row("-B", 1)}},
+			CreateSectionRequest{"A-", []CreateRowRequest{row("B", 1)}},
+		), "would exist twice"},
+		{"too many seats", venue(CreateSectionRequest{"A", func() []CreateRowRequest {
+			var rows []CreateRowRequest
+			for i := range maxSeatsPerVenue/maxSeatsPerRow + 1 {
+				rows = append(rows, row(strings.Repeat("R", i+1), maxSeatsPerRow))
+			}
+			return rows
+		}()}), "can't have more than"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateVenueRequest(tt.req)
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("got %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCreateVenueClashingCodes(t *testing.T) {
+	app, keys := testApp(t)
+	body := `{"name":"Hall","sections":[{"name":"A","rows":[{"label":"1","seats":11},{"label":"11","seats":1}]}]}`
+	if got := send(t, app, "POST", "/venues", keys.token(t, auth.RoleOrganizer, "org1"), body); got != 400 {
+		t.Errorf("got status %d, want 400", got)
+	}
+
+	var seats int64
+	db.Model(&Seat{}).Count(&seats)
+	if seats != 0 {
+		t.Errorf("%d seats were created", seats)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/zensos/microservice-project/internal/money"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+func validateTierRequest(event Event, req CreateTierRequest) error {
+	if req.Name == "" {
+		return errors.New("name is required")
+	}
+	if req.Price.IsNegative() {
+		return errors.New("price can't be negative")
+	}
+	if !req.Price.SameCurrency(event.Price) {
+		return fmt.Errorf("price must be in %s like the event", event.Price.Currency)
+	}
+	if req.Quota < 0 {
+		return errors.New("quota can't be negative")
+	}
+	if len(req.SectionIDs) == 0 {
+		return errors.New("section_ids must not be empty")
+	}
+
+	if (req.EarlyBirdPrice == nil) != (req.EarlyBirdUntil == nil) {
+		return errors.New("early_bird_price and early_bird_until go together")
+	}
+	if req.EarlyBirdPrice != nil {
+		if req.EarlyBirdPrice.IsNegative() || !req.EarlyBirdPrice.SameCurrency(req.Price) {
+			return errors.New("early_bird_price must be a non-negative amount in the tier currency")
+		}
+		if req.EarlyBirdUntil.After(event.Date) {
+			return errors.New("early_bird_until must be before the event date")
+		}
+	}
+
+	return nil
+}
+
+func createTier(c fiber.Ctx) error {
+	var req CreateTierRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid request body"})
+	}
+
+	event, ferr := loadManagedEvent(c)
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{"error": ferr.Message})
+	}
+	if event.VenueID == nil {
+		return c.Status(400).JSON(fiber.Map{"error": "event has no seat map to attach tiers to"})
+	}
+	if err := validateTierRequest(event, req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var sections []Section
+	if err := db.Where("id IN ? AND venue_id = ?", req.SectionIDs, *event.VenueID).Find(&sections).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to load sections"})
+	}
+	if len(sections) != len(req.SectionIDs) {
+		return c.Status(400).JSON(fiber.Map{"error": "section_ids must be distinct sections of the event venue"})
+	}
+
+	tier := TicketTier{
+		EventID:        event.ID,
+		Name:           req.Name,
+		Price:          money.New(req.Price.Minor, req.Price.Currency),
+		EarlyBirdPrice: money.Zero(req.Price.Currency),
+		EarlyBirdUntil: req.EarlyBirdUntil,
+		Quota:          req.Quota,
+		Sections:       sections,
+	}
+	if req.EarlyBirdPrice != nil {
+		tier.EarlyBirdPrice = money.New(req.EarlyBirdPrice.Minor, req.EarlyBirdPrice.Currency)
+	}
+
+	txErr := db.Transaction(func(tx *gorm.DB) error {
+		// A section can only be priced by one tier of an event. The join table
+		// has no event_id to put a unique index on, so tier creation is
+		// serialized per event by locking its row.
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&Event{}, event.ID).Error; err != nil {
+			return err
+		}
+
+		var taken int64
+		if err := tx.Table("ticket_tier_sections").
+			Joins("JOIN ticket_tiers ON ticket_tiers.id = ticket_tier_sections.ticket_tier_id").
+			Where("ticket_tiers.event_id = ? AND ticket_tier_sections.section_id IN ?", event.ID, req.SectionIDs).
+			Count(&taken).Error; err != nil {
+			return err
+		}
+		if taken > 0 {
+			return errSectionTaken
+		}
+
+		return tx.Omit("Sections.*").Create(&tier).Error
+	})
+	if errors.Is(txErr, errSectionTaken) {
+		return c.Status(409).JSON(fiber.Map{"error": txErr.Error()})
+	}
+	if txErr != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to create tier"})
+	}
+
+	return c.Status(201).JSON(tier)
+}
+
+var errSectionTaken = errors.New("one or more sections already belong to another tier of this event")
+
+func listTiers(c fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid event id"})
+	}
+
+	var tiers []TicketTier
+	if err := db.Preload("Sections").Where("event_id = ?", id).Order("id").Find(&tiers).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to load tiers"})
+	}
+
+	now := time.Now()
+	resp := make([]fiber.Map, 0, len(tiers))
+	for _, tier := range tiers {
+		resp = append(resp, fiber.Map{
+			"tier":          tier,
+			"current_price": tier.PriceAt(now),
+		})
+	}
+	return c.JSON(fiber.Map{"event_id": id, "tiers": resp})
+}
+
+// sectionTiers maps each section of the event to the tier that prices it.
+func sectionTiers(eventID uint) (map[uint]TicketTier, error) {
+	var tiers []TicketTier
+	if err := db.Preload("Sections").Where("event_id = ?", eventID).Find(&tiers).Error; err != nil {
+		return nil, err
+	}
+
+	bySection := map[uint]TicketTier{}
+	for _, tier := range tiers {
+		for _, section := range tier.Sections {
+			bySection[section.ID] = tier
+		}
+	}
+	return bySection, nil
+}
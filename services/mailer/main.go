@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/smtp"
@@ -10,19 +11,35 @@ import (
 	"strings"
 	"syscall"
 
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/zensos/microservice-project/internal/events"
+	"github.com/zensos/microservice-project/internal/money"
 	"github.com/zensos/microservice-project/internal/rabbitmq"
 )
 
 type BookingEvent struct {
-	BookingID   string   `json:"booking_id"`
-	MemberID    string   `json:"member_id"`
-	MemberEmail string   `json:"member_email"`
-	MemberName  string   `json:"member_name"`
-	EventName   string   `json:"event_name"`
-	SeatIDs     []string `json:"seat_ids"`
-	TotalAmount float64  `json:"total_amount"`
+	BookingID   string      `json:"booking_id"`
+	MemberID    string      `json:"member_id"`
+	MemberEmail string      `json:"member_email"`
+	MemberName  string      `json:"member_name"`
+	EventName   string      `json:"event_name"`
+	SeatIDs     []string    `json:"seat_ids"`
+	TotalAmount money.Money `json:"total_amount"`
 }
 
+type CancellationEvent struct {
+	BookingID   string      `json:"booking_id"`
+	MemberID    string      `json:"member_id"`
+	MemberEmail string      `json:"member_email"`
+	MemberName  string      `json:"member_name"`
+	EventName   string      `json:"event_name"`
+	Reason      string      `json:"reason"`
+	Refunded    bool        `json:"refunded"`
+	TotalAmount money.Money `json:"total_amount"`
+}
+
+var errMalformed = errors.New("malformed message")
+
 func main() {
 	conn := rabbitmq.Connect()
 	defer conn.Close()
@@ -33,91 +50,293 @@ func main() {
 	}
 	defer ch.Close()
 
-	_, err = rabbitmq.DeclareQueue(ch, "booking.confirmed")
+	consume(ch, "booking.confirmed", handleConfirmed)
+	consume(ch, "booking.cancelled", handleCancelled)
+	consume(ch, events.TypeWalletToppedUp, handleToppedUp)
+	consume(ch, events.TypePaymentConfirmed, handlePaymentConfirmed)
+	consume(ch, events.TypePaymentRefunded, handleRefunded)
+	consume(ch, events.TypeWalletLowBalance, handleLowBalance)
+
+	log.Println("mailer service started, waiting for messages...")
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	log.Println("mailer service shutting down...")
+}
+
+// consume acks handled messages, drops malformed ones and requeues the rest.
+func consume(ch *amqp.Channel, queue string, handle func([]byte) error) {
+	_, err := rabbitmq.DeclareQueue(ch, queue)
 	if err != nil {
 		log.Fatalf("failed to declare queue: %v", err)
 	}
 
-	msgs, err := rabbitmq.Consume(ch, "booking.confirmed")
+	msgs, err := rabbitmq.Consume(ch, queue)
 	if err != nil {
 		log.Fatalf("failed to consume: %v", err)
 	}
 
-	log.Println("mailer service started, waiting for messages...")
-
 	go func() {
 		for msg := range msgs {
-			var event BookingEvent
-			if err := json.Unmarshal(msg.Body, &event); err != nil {
-				log.Printf("failed to parse message: %v", err)
+			err := handle(msg.Body)
+			if errors.Is(err, errMalformed) {
+				log.Printf("failed to parse message from %s: %v", queue, err)
 				msg.Nack(false, false)
 				continue
 			}
-
-			log.Printf("sending confirmation email for booking %s to %s", event.BookingID, event.MemberEmail)
-
-			if err := sendEmail(event); err != nil {
+			if err != nil {
 				log.Printf("failed to send email: %v", err)
 				msg.Nack(false, true)
 				continue
 			}
-
-			log.Printf("email sent for booking %s", event.BookingID)
 			msg.Ack(false)
 		}
 	}()
-
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	log.Println("mailer service shutting down...")
 }
 
-func sendEmail(event BookingEvent) error {
-	smtpHost := os.Getenv("SMTP_HOST")
-	if smtpHost == "" {
-		smtpHost = "smtp.gmail.com"
-	}
-	smtpPort := os.Getenv("SMTP_PORT")
-	if smtpPort == "" {
-		smtpPort = "587"
-	}
-	senderEmail := os.Getenv("SMTP_EMAIL")
-	senderPassword := os.Getenv("SMTP_PASSWORD")
-
-	if senderEmail == "" || senderPassword == "" {
-		log.Printf("[MOCK] would send email to %s for booking %s", event.MemberEmail, event.BookingID)
-		return nil
+func handleConfirmed(body []byte) error {
+	var event BookingEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return fmt.Errorf("%w: %v", errMalformed, err)
 	}
 
-	auth := smtp.PlainAuth("", senderEmail, senderPassword, smtpHost)
+	log.Printf("sending confirmation email for booking %s to %s", event.BookingID, event.MemberEmail)
 
 	seats := strings.Join(event.SeatIDs, ", ")
 
 	subject := fmt.Sprintf("Booking Confirmation - %s", event.BookingID)
-	body := fmt.Sprintf(
+	text := fmt.Sprintf(
 		"Hi %s,\n\n"+
 			"Your booking has been confirmed!\n\n"+
 			"Booking ID: %s\n"+
 			"Event: %s\n"+
 			"Seats: %s\n"+
-			"Total: %.2f THB\n\n"+
+			"Total: %s %s\n\n"+
 			"Thank you for your purchase!",
 		event.MemberName,
 		event.BookingID,
 		event.EventName,
 		seats,
 		event.TotalAmount,
+		event.TotalAmount.Currency,
+	)
+
+	if err := sendEmail(event.MemberEmail, event.BookingID, subject, text); err != nil {
+		return err
+	}
+	log.Printf("email sent for booking %s", event.BookingID)
+	return nil
+}
+
+func handleCancelled(body []byte) error {
+	var event CancellationEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return fmt.Errorf("%w: %v", errMalformed, err)
+	}
+	if event.MemberEmail == "" {
+		log.Printf("no email address for member %s, skipping cancellation notice for booking %s", event.MemberID, event.BookingID)
+		return nil
+	}
+
+	log.Printf("sending cancellation email for booking %s to %s", event.BookingID, event.MemberEmail)
+
+	refund := "No payment was taken for this booking."
+	if event.Refunded {
+		refund = fmt.Sprintf("%s %s has been refunded to your wallet.", event.TotalAmount, event.TotalAmount.Currency)
+	}
+
+	subject := fmt.Sprintf("Booking Cancelled - %s", event.BookingID)
+	text := fmt.Sprintf(
+		"Hi %s,\n\n"+
+			"Unfortunately %s has been cancelled (%s), so your booking was cancelled too.\n\n"+
+			"Booking ID: %s\n"+
+			"%s\n\n"+
+			"We're sorry for the inconvenience.",
+		event.MemberName,
+		event.EventName,
+		event.Reason,
+		event.BookingID,
+		refund,
 	)
 
+	if err := sendEmail(event.MemberEmail, event.BookingID, subject, text); err != nil {
+		return err
+	}
+	log.Printf("email sent for booking %s", event.BookingID)
+	return nil
+}
+
+func handleToppedUp(body []byte) error {
+	var event events.WalletToppedUp
+	if _, err := events.Decode(body, events.TypeWalletToppedUp, &event); err != nil {
+		return fmt.Errorf("%w: %v", errMalformed, err)
+	}
+	if event.MemberEmail == "" {
+		log.Printf("no email address for member %s, skipping receipt for top-up %s", event.MemberID, event.IntentID)
+		return nil
+	}
+
+	log.Printf("sending receipt for top-up %s to %s", event.IntentID, event.MemberEmail)
+
+	subject := fmt.Sprintf("Top-up Receipt - %s", event.IntentID)
+	text := fmt.Sprintf(
+		"Hi,\n\n"+
+			"We've added %s %s to your wallet.\n\n"+
+			"Top-up ID: %s\n"+
+			"Method: %s\n"+
+			"Balance: %s %s\n\n"+
+			"Thank you!",
+		event.Amount,
+		event.Amount.Currency,
+		event.IntentID,
+		event.Method,
+		event.BalanceAfter,
+		event.BalanceAfter.Currency,
+	)
+
+	if err := sendEmail(event.MemberEmail, event.IntentID, subject, text); err != nil {
+		return err
+	}
+	log.Printf("email sent for top-up %s", event.IntentID)
+	return nil
+}
+
+func handlePaymentConfirmed(body []byte) error {
+	var event events.PaymentConfirmed
+	if _, err := events.Decode(body, events.TypePaymentConfirmed, &event); err != nil {
+		return fmt.Errorf("%w: %v", errMalformed, err)
+	}
+	if event.MemberEmail == "" {
+		log.Printf("no email address for member %s, skipping receipt for payment %s", event.MemberID, event.PaymentID)
+		return nil
+	}
+
+	log.Printf("sending receipt for payment %s to %s", event.PaymentID, event.MemberEmail)
+
+	subject := fmt.Sprintf("Payment Receipt - %s", event.BookingID)
+	text := fmt.Sprintf(
+		"Hi,\n\n"+
+			"We've taken %s %s from your wallet for booking %s.\n\n"+
+			"Payment ID: %s\n\n"+
+			"Thank you!",
+		event.Amount,
+		event.Amount.Currency,
+		event.BookingID,
+		event.PaymentID,
+	)
+
+	if err := sendEmail(event.MemberEmail, event.PaymentID, subject, text); err != nil {
+		return err
+	}
+	log.Printf("email sent for payment %s", event.PaymentID)
+	return nil
+}
+
+func handleRefunded(body []byte) error {
+	var event events.PaymentRefunded
+	if _, err := events.Decode(body, events.TypePaymentRefunded, &event); err != nil {
+		return fmt.Errorf("%w: %v", errMalformed, err)
+	}
+	if event.MemberEmail == "" {
+		log.Printf("no email address for member %s, skipping notice for refund %s", event.MemberID, event.RefundID)
+		return nil
+	}
+
+	log.Printf("sending notice for refund %s to %s", event.RefundID, event.MemberEmail)
+
+	what := "Part of your payment"
+	if event.FullyRefunded {
+		what = "Your payment"
+	}
+	reason := ""
+	if event.Reason != "" {
+		reason = fmt.Sprintf("Reason: %s\n", event.Reason)
+	}
+
+	subject := fmt.Sprintf("Refund - %s", event.BookingID)
+	text := fmt.Sprintf(
+		"Hi,\n\n"+
+			"%s for booking %s has been refunded to your wallet.\n\n"+
+			"Refund ID: %s\n"+
+			"Refunded: %s %s\n"+
+			"%s"+
+			"Balance: %s %s",
+		what,
+		event.BookingID,
+		event.RefundID,
+		event.Amount,
+		event.Amount.Currency,
+		reason,
+		event.BalanceAfter,
+		event.BalanceAfter.Currency,
+	)
+
+	if err := sendEmail(event.MemberEmail, event.RefundID, subject, text); err != nil {
+		return err
+	}
+	log.Printf("email sent for refund %s", event.RefundID)
+	return nil
+}
+
+func handleLowBalance(body []byte) error {
+	var event events.WalletLowBalance
+	envelope, err := events.Decode(body, events.TypeWalletLowBalance, &event)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errMalformed, err)
+	}
+	if event.MemberEmail == "" {
+		log.Printf("no email address for member %s, skipping low balance warning", event.MemberID)
+		return nil
+	}
+
+	log.Printf("sending low balance warning to %s", event.MemberEmail)
+
+	subject := "Your wallet balance is low"
+	text := fmt.Sprintf(
+		"Hi,\n\n"+
+			"Your wallet balance is down to %s %s, below %s %s.\n\n"+
+			"Top up to keep booking without interruptions.",
+		event.Balance,
+		event.Balance.Currency,
+		event.Threshold,
+		event.Threshold.Currency,
+	)
+
+	if err := sendEmail(event.MemberEmail, envelope.ID, subject, text); err != nil {
+		return err
+	}
+	log.Printf("email sent for low balance warning %s", envelope.ID)
+	return nil
+}
+
+func sendEmail(to, reference, subject, text string) error {
+	smtpHost := os.Getenv("SMTP_HOST")
+	if smtpHost == "" {
+		smtpHost = "smtp.gmail.com"
+	}
+	smtpPort := os.Getenv("SMTP_PORT")
+	if smtpPort == "" {
+		smtpPort = "587"
+	}
+	senderEmail := os.Getenv("SMTP_EMAIL")
+	senderPassword := os.Getenv("SMTP_PASSWORD")
+
+	if senderEmail == "" || senderPassword == "" {
+		log.Printf("[MOCK] would send email to %s for %s", to, reference)
+		return nil
+	}
+
+	auth := smtp.PlainAuth("", senderEmail, senderPassword, smtpHost)
+
 	msg := fmt.Sprintf(
 		"From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=\"UTF-8\"\r\n\r\n%s",
 		senderEmail,
-		event.MemberEmail,
+		to,
 		subject,
-		body,
+		text,
 	)
 
 	addr := fmt.Sprintf("%s:%s", smtpHost, smtpPort)
-	return smtp.SendMail(addr, auth, senderEmail, []string{event.MemberEmail}, []byte(msg))
+	return smtp.SendMail(addr, auth, senderEmail, []string{to}, []byte(msg))
 }
@@ -4,22 +4,52 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/gofiber/fiber/v3"
+	"github.com/gofiber/fiber/v3/middleware/recover"
+	"github.com/zensos/microservice-project/internal/auth"
 	"github.com/zensos/microservice-project/internal/common"
 	"github.com/zensos/microservice-project/internal/database"
 	"github.com/zensos/microservice-project/internal/middleware"
 	"gorm.io/gorm"
 )
 
-var db *gorm.DB
+var (
+	db        *gorm.DB
+	passwords *Passwords
+	keys      *KeyStore
+	tokenCfg  tokenConfig
+)
 
 func main() {
+	var err error
+	passwords, err = NewPasswordsFromEnv()
+	if err != nil {
+		log.Fatalf("failed to configure password hashing: %v", err)
+	}
+
 	db = database.Connect()
-	db.AutoMigrate(&Member{})
+	db.AutoMigrate(&Member{}, &SigningKey{}, &RefreshToken{})
+	db.Model(&Member{}).Where("role IS NULL OR role = ''").Update("role", auth.RoleMember)
+
+	if emails := os.Getenv("ADMIN_EMAILS"); emails != "" {
+		db.Model(&Member{}).Where("email IN ?", strings.Split(emails, ",")).Update("role", auth.RoleAdmin)
+	}
+
+	tokenCfg = tokenConfigFromEnv()
+	keys, err = NewKeyStore(db, tokenCfg)
+	if err != nil {
+		log.Fatalf("failed to load signing keys: %v", err)
+	}
+	go keys.RunRotation(time.Hour)
+
+	authn := middleware.Authenticate(auth.NewVerifier(keys))
 
 	app := fiber.New()
+	app.Use(recover.New())
 
 	app.Use(middleware.RateLimiter(middleware.RateLimiterConfig{
 		Max:        100,
@@ -57,11 +87,17 @@ func main() {
 		}
 	}()
 
-	app.Get("/members/:id", getMemberProfile)
-	app.Patch("/members/:id", updateMemberProfile)
-	app.Post("/members/:id/change-password", changePassword)
+	app.Get("/.well-known/jwks.json", jwks)
+
+	app.Get("/members/:id", authn, middleware.BindParam("id", auth.PermMembersReadAny), getMemberProfile)
+	app.Patch("/members/:id", authn, middleware.BindParam("id", auth.PermMembersManage), updateMemberProfile)
+	app.Patch("/members/:id/role", authn, middleware.Authorize(auth.PermMembersManageRoles), updateMemberRole)
+	app.Post("/members/:id/change-password", authn, middleware.BindParam("id"), changePassword)
 	app.Post("/auth/signup", signup)
 	app.Post("/auth/signin", signin)
+	app.Post("/auth/refresh", refresh)
+	app.Post("/auth/signout", signout)
+	app.Post("/auth/service-token", serviceToken)
 
 	log.Fatal(app.Listen(":3003"))
 }
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"os"
 	"strconv"
 
 	"github.com/gofiber/fiber/v3"
+	"github.com/zensos/microservice-project/internal/auth"
+	"gorm.io/gorm"
 )
 
 func getMemberProfile(c fiber.Ctx) error {
@@ -95,17 +101,48 @@ func changePassword(c fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
 	}
 
-	if member.PasswordHash != req.CurrentPassword {
+	if ok, _ := passwords.Verify(req.CurrentPassword, member.PasswordHash); !ok {
 		return c.Status(fiber.StatusBadRequest).SendString("Current password is incorrect")
 	}
 	if req.NewPassword != req.ConfirmPassword {
 		return c.Status(fiber.StatusBadRequest).SendString("New password and confirm password do not match")
 	}
 
-	db.Model(&member).Update("password_hash", req.NewPassword)
+	hash, err := passwords.Hash(req.NewPassword)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to change password")
+	}
+
+	db.Model(&member).Update("password_hash", hash)
+	if err := revokeAllRefreshTokens(member.ID); err != nil {
+		log.Printf("couldn't revoke refresh tokens for member %d: %v", member.ID, err)
+	}
 	return c.JSON(fiber.Map{"message": "Password changed successfully"})
 }
 
+func updateMemberRole(c fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	var member Member
+	if err := db.First(&member, id).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("Member with ID " + c.Params("id") + " not found")
+	}
+
+	var req UpdateRoleRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+	}
+	if !req.Role.Valid() || req.Role == auth.RoleService {
+		return c.Status(fiber.StatusBadRequest).SendString("role must be one of: admin, organizer, member")
+	}
+
+	db.Model(&member).Update("role", req.Role)
+	return c.JSON(member)
+}
+
 func signup(c fiber.Ctx) error {
 	var req SignUpRequest
 	if err := c.Bind().JSON(&req); err != nil {
@@ -121,11 +158,17 @@ func signup(c fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).SendString("Email already exists")
 	}
 
+	hash, err := passwords.Hash(req.Password)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to create member")
+	}
+
 	member := Member{
 		FirstName:    req.FirstName,
 		LastName:     req.LastName,
 		Email:        req.Email,
-		PasswordHash: req.Password,
+		PasswordHash: hash,
+		Role:         auth.RoleMember,
 	}
 	if err := db.Create(&member).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).SendString("Failed to create member")
@@ -141,12 +184,111 @@ func signin(c fiber.Ctx) error {
 	}
 
 	var member Member
-	if err := db.Where("email = ? AND password_hash = ?", req.Email, req.Password).First(&member).Error; err != nil {
+	if err := db.Where("email = ?", req.Email).First(&member).Error; err != nil {
+		return c.Status(fiber.StatusUnauthorized).SendString("Invalid email or password")
+	}
+
+	ok, rehash := passwords.Verify(req.Password, member.PasswordHash)
+	if !ok {
 		return c.Status(fiber.StatusUnauthorized).SendString("Invalid email or password")
 	}
 
+	if rehash {
+		if hash, err := passwords.Hash(req.Password); err == nil {
+			if err := db.Model(&member).Update("password_hash", hash).Error; err != nil {
+				log.Printf("couldn't upgrade password hash for member %d: %v", member.ID, err)
+			}
+		}
+	}
+
+	var pair TokenPair
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		pair, err = issueTokens(tx, member)
+		return err
+	}); err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to issue tokens")
+	}
+
 	return c.JSON(fiber.Map{
-		"message": "Sign in successful",
-		"member":  member,
+		"message":       "Sign in successful",
+		"member":        member,
+		"access_token":  pair.AccessToken,
+		"refresh_token": pair.RefreshToken,
+		"token_type":    pair.TokenType,
+		"expires_in":    pair.ExpiresIn,
 	})
-}
\ No newline at end of file
+}
+
+func refresh(c fiber.Ctx) error {
+	var req RefreshRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+	}
+	if req.RefreshToken == "" {
+		return c.Status(fiber.StatusBadRequest).SendString("refresh_token is required")
+	}
+
+	pair, err := rotateRefreshToken(req.RefreshToken)
+	if errors.Is(err, errInvalidRefreshToken) || errors.Is(err, errRefreshTokenReused) {
+		return c.Status(fiber.StatusUnauthorized).SendString("Invalid or expired refresh token")
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to refresh tokens")
+	}
+
+	return c.JSON(pair)
+}
+
+func signout(c fiber.Ctx) error {
+	var req SignOutRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+	}
+	if req.RefreshToken == "" {
+		return c.Status(fiber.StatusBadRequest).SendString("refresh_token is required")
+	}
+
+	token, err := revokeRefreshToken(req.RefreshToken)
+	if errors.Is(err, errInvalidRefreshToken) {
+		return c.Status(fiber.StatusUnauthorized).SendString("Invalid refresh token")
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to sign out")
+	}
+
+	if req.All {
+		if err := revokeAllRefreshTokens(token.MemberID); err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString("Failed to sign out")
+		}
+	}
+
+	return c.JSON(fiber.Map{"message": "Signed out"})
+}
+
+func serviceToken(c fiber.Ctx) error {
+	secret := os.Getenv("SERVICE_CLIENT_SECRET")
+	if secret == "" {
+		return c.Status(fiber.StatusServiceUnavailable).SendString("Service tokens are not enabled")
+	}
+
+	var req auth.ServiceTokenRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+	}
+	if req.Service == "" || subtle.ConstantTimeCompare([]byte(req.Secret), []byte(secret)) != 1 {
+		return c.Status(fiber.StatusUnauthorized).SendString("Invalid service credentials")
+	}
+
+	token, err := issueServiceToken(req.Service)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to issue token")
+	}
+
+	return c.JSON(token)
+}
+
+func jwks(c fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.JSON(keys.JWKS())
+}
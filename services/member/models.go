@@ -3,6 +3,7 @@ package main
 import (
 	"time"
 
+	"github.com/zensos/microservice-project/internal/auth"
 	"gorm.io/gorm"
 )
 
@@ -40,6 +41,7 @@ type Member struct {
 	AddressDistrict string         `json:"address_district,omitempty"`
 	PostalCode      string         `json:"postal_code,omitempty"`
 	IdentityType    IdentityType   `json:"identity_type,omitempty"`
+	Role            auth.Role      `json:"role" gorm:"default:member;index"`
 	CreatedAt       time.Time      `json:"created_at"`
 	UpdatedAt       time.Time      `json:"updated_at"`
 	DeletedAt       gorm.DeletedAt `json:"-" gorm:"index"`
@@ -77,3 +79,40 @@ type SignInRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
 }
+
+type SigningKey struct {
+	ID         uint       `gorm:"primaryKey"`
+	KID        string     `gorm:"uniqueIndex"`
+	PrivateKey string     `gorm:"type:text"`
+	CreatedAt  time.Time  `gorm:"index"`
+	RetiredAt  *time.Time `gorm:"index"`
+}
+
+type RefreshToken struct {
+	ID        uint       `gorm:"primaryKey"`
+	TokenHash string     `gorm:"uniqueIndex"`
+	MemberID  uint       `gorm:"index"`
+	ExpiresAt time.Time  `gorm:"index"`
+	RevokedAt *time.Time `gorm:"index"`
+	CreatedAt time.Time  `gorm:"index"`
+}
+
+type UpdateRoleRequest struct {
+	Role auth.Role `json:"role"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type SignOutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+	All          bool   `json:"all"`
+}
+
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
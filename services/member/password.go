@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var errMalformedHash = errors.New("malformed password hash")
+
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(password, encoded string) (bool, error)
+	NeedsRehash(encoded string) bool
+	Supports(encoded string) bool
+}
+
+type Argon2idHasher struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+type argon2idParams struct {
+	version     int
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("couldn't generate salt: %w", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.Memory,
+		h.Iterations,
+		h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h Argon2idHasher) Verify(password, encoded string) (bool, error) {
+	p, err := parseArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	key := argon2.IDKey([]byte(password), p.salt, p.iterations, p.memory, p.parallelism, uint32(len(p.key)))
+	return subtle.ConstantTimeCompare(key, p.key) == 1, nil
+}
+
+func (h Argon2idHasher) NeedsRehash(encoded string) bool {
+	p, err := parseArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+
+	return p.version != argon2.Version ||
+		p.memory != h.Memory ||
+		p.iterations != h.Iterations ||
+		p.parallelism != h.Parallelism ||
+		uint32(len(p.salt)) != h.SaltLength ||
+		uint32(len(p.key)) != h.KeyLength
+}
+
+func (h Argon2idHasher) Supports(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func parseArgon2id(encoded string) (argon2idParams, error) {
+	var p argon2idParams
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, errMalformedHash
+	}
+
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &p.version); err != nil {
+		return p, errMalformedHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.iterations, &p.parallelism); err != nil {
+		return p, errMalformedHash
+	}
+	// argon2 panics on zero iterations or lanes.
+	if p.iterations < 1 || p.parallelism < 1 {
+		return p, errMalformedHash
+	}
+
+	var err error
+	if p.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return p, errMalformedHash
+	}
+	if p.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return p, errMalformedHash
+	}
+
+	return p, nil
+}
+
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (h BcryptHasher) Verify(password, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (h BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	if err != nil {
+		return true
+	}
+	return cost != h.Cost
+}
+
+func (h BcryptHasher) Supports(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") ||
+		strings.HasPrefix(encoded, "$2b$") ||
+		strings.HasPrefix(encoded, "$2y$")
+}
+
+type Passwords struct {
+	current PasswordHasher
+	hashers []PasswordHasher
+}
+
+func NewPasswords(current PasswordHasher, others ...PasswordHasher) *Passwords {
+	return &Passwords{
+		current: current,
+		hashers: append([]PasswordHasher{current}, others...),
+	}
+}
+
+func (p *Passwords) Hash(password string) (string, error) {
+	return p.current.Hash(password)
+}
+
+// Verify reports whether password matches the stored hash, and whether the
+// stored value should be replaced with a fresh hash from the current hasher.
+// Values that don't look like a hash at all are legacy plaintext rows.
+func (p *Passwords) Verify(password, encoded string) (ok bool, rehash bool) {
+	if !strings.HasPrefix(encoded, "$") {
+		ok = subtle.ConstantTimeCompare([]byte(password), []byte(encoded)) == 1
+		return ok, ok
+	}
+
+	for _, h := range p.hashers {
+		if !h.Supports(encoded) {
+			continue
+		}
+
+		ok, err := h.Verify(password, encoded)
+		if err != nil || !ok {
+			return false, false
+		}
+		return true, h != p.current || p.current.NeedsRehash(encoded)
+	}
+
+	return false, false
+}
+
+// NewPasswordsFromEnv refuses hashing parameters out of the range argon2
+// and bcrypt accept, so a bad setting fails at startup instead of on the
+// first login. argon2 needs at least 8KB of memory per lane.
+func NewPasswordsFromEnv() (*Passwords, error) {
+	parallelism, err := envIntRange("ARGON2_PARALLELISM", 2, 1, 255)
+	if err != nil {
+		return nil, err
+	}
+	iterations, err := envIntRange("ARGON2_ITERATIONS", 3, 1, 100)
+	if err != nil {
+		return nil, err
+	}
+	memory, err := envIntRange("ARGON2_MEMORY_KB", 64*1024, 8*parallelism, 4*1024*1024)
+	if err != nil {
+		return nil, err
+	}
+	cost, err := envIntRange("BCRYPT_COST", bcrypt.DefaultCost, bcrypt.MinCost, bcrypt.MaxCost)
+	if err != nil {
+		return nil, err
+	}
+
+	argon := Argon2idHasher{
+		Memory:      uint32(memory),
+		Iterations:  uint32(iterations),
+		Parallelism: uint8(parallelism),
+		SaltLength:  16,
+		KeyLength:   32,
+	}
+	bcryptHasher := BcryptHasher{Cost: cost}
+
+	switch algo := os.Getenv("PASSWORD_HASHER"); algo {
+	case "", "argon2id":
+		return NewPasswords(argon, bcryptHasher), nil
+	case "bcrypt":
+		return NewPasswords(bcryptHasher, argon), nil
+	default:
+		return nil, fmt.Errorf("unknown PASSWORD_HASHER %q", algo)
+	}
+}
+
+func envIntRange(key string, fallback, lo, hi int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < lo || n > hi {
+		return 0, fmt.Errorf("%s must be a number between %d and %d", key, lo, hi)
+	}
+	return n, nil
+}
+
+func envInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fallback
+	}
+	return n
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cheap parameters keep the tests fast; production values come from env.
+var (
+	testArgon  = Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	testBcrypt = BcryptHasher{Cost: bcrypt.MinCost}
+)
+
+func mustHash(t *testing.T, h PasswordHasher, password string) string {
+	t.Helper()
+	encoded, err := h.Hash(password)
+	if err != nil {
+		t.Fatalf("hash: %v", err)
+	}
+	return encoded
+}
+
+func TestPasswordsVerify(t *testing.T) {
+	stronger := testArgon
+	stronger.Iterations = 2
+
+	argonHash := mustHash(t, testArgon, "secret")
+	bcryptHash := mustHash(t, testBcrypt, "secret")
+
+	tests := []struct {
+		name       string
+		passwords  *Passwords
+		password   string
+		encoded    string
+		wantOK     bool
+		wantRehash bool
+	}{
+		{"argon2id match", NewPasswords(testArgon, testBcrypt), "secret", argonHash, true, false},
+		{"argon2id wrong password", NewPasswords(testArgon, testBcrypt), "wrong", argonHash, false, false},
+		{"bcrypt match", NewPasswords(testBcrypt, testArgon), "secret", bcryptHash, true, false},
+		{"bcrypt wrong password", NewPasswords(testBcrypt, testArgon), "wrong", bcryptHash, false, false},
+		{"bcrypt row under argon2id", NewPasswords(testArgon, testBcrypt), "secret", bcryptHash, true, true},
+		{"argon2id row under bcrypt", NewPasswords(testBcrypt, testArgon), "secret", argonHash, true, true},
+		{"argon2id parameters changed", NewPasswords(stronger, testBcrypt), "secret", argonHash, true, true},
+		{"bcrypt cost changed", NewPasswords(BcryptHasher{Cost: bcrypt.MinCost + 1}), "secret", bcryptHash, true, true},
+		{"bcrypt row without bcrypt hasher", NewPasswords(testArgon), "secret", bcryptHash, false, false},
+		{"legacy plaintext match", NewPasswords(testArgon), "secret", "secret", true, true},
+		{"legacy plaintext wrong password", NewPasswords(testArgon), "wrong", "secret", false, false},
+		{"malformed argon2id", NewPasswords(testArgon), "secret", "$argon2id$v=19$garbage", false, false},
+		{"zero argon2id lanes", NewPasswords(testArgon), "secret", "$argon2id$v=19$m=64,t=1,p=0$c2FsdHNhbHRzYWx0c2FsdA$aGFzaGhhc2hoYXNoaGFzaA", false, false},
+		{"zero argon2id iterations", NewPasswords(testArgon), "secret", "$argon2id$v=19$m=64,t=0,p=1$c2FsdHNhbHRzYWx0c2FsdA$aGFzaGhhc2hoYXNoaGFzaA", false, false},
+		{"unknown scheme", NewPasswords(testArgon, testBcrypt), "secret", "$md5$abc", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, rehash := tt.passwords.Verify(tt.password, tt.encoded)
+			if ok != tt.wantOK || rehash != tt.wantRehash {
+				t.Errorf("Verify() = (%v, %v), want (%v, %v)", ok, rehash, tt.wantOK, tt.wantRehash)
+			}
+		})
+	}
+}
+
+func TestPasswordsHashUsesCurrent(t *testing.T) {
+	tests := []struct {
+		name    string
+		current PasswordHasher
+	}{
+		{"argon2id", testArgon},
+		{"bcrypt", testBcrypt},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			passwords := NewPasswords(tt.current)
+			encoded, err := passwords.Hash("secret")
+			if err != nil {
+				t.Fatalf("hash: %v", err)
+			}
+			if !tt.current.Supports(encoded) {
+				t.Errorf("hash %q not produced by the current hasher", encoded)
+			}
+			if ok, rehash := passwords.Verify("secret", encoded); !ok || rehash {
+				t.Errorf("Verify() = (%v, %v), want (true, false)", ok, rehash)
+			}
+		})
+	}
+}
+
+func TestNewPasswordsFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{"defaults", nil, false},
+		{"bcrypt", map[string]string{"PASSWORD_HASHER": "bcrypt"}, false},
+		{"unknown hasher", map[string]string{"PASSWORD_HASHER": "md5"}, true},
+		{"zero parallelism", map[string]string{"ARGON2_PARALLELISM": "0"}, true},
+		{"too much parallelism", map[string]string{"ARGON2_PARALLELISM": "256"}, true},
+		{"zero iterations", map[string]string{"ARGON2_ITERATIONS": "0"}, true},
+		{"negative memory", map[string]string{"ARGON2_MEMORY_KB": "-1"}, true},
+		{"memory below 8KB per lane", map[string]string{"ARGON2_PARALLELISM": "4", "ARGON2_MEMORY_KB": "31"}, true},
+		{"memory at 8KB per lane", map[string]string{"ARGON2_PARALLELISM": "4", "ARGON2_MEMORY_KB": "32"}, false},
+		{"not a number", map[string]string{"ARGON2_ITERATIONS": "three"}, true},
+		{"bcrypt cost too low", map[string]string{"BCRYPT_COST": "3"}, true},
+		{"bcrypt cost too high", map[string]string{"BCRYPT_COST": "32"}, true},
+	}
+
+	keys := []string{"PASSWORD_HASHER", "ARGON2_MEMORY_KB", "ARGON2_ITERATIONS", "ARGON2_PARALLELISM", "BCRYPT_COST"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range keys {
+				t.Setenv(key, tt.env[key])
+			}
+			_, err := NewPasswordsFromEnv()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewPasswordsFromEnv() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/zensos/microservice-project/internal/auth"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	errInvalidRefreshToken = errors.New("invalid refresh token")
+	errRefreshTokenReused  = errors.New("refresh token reused")
+)
+
+type tokenConfig struct {
+	accessTTL   time.Duration
+	refreshTTL  time.Duration
+	keyRotation time.Duration
+	keyGrace    time.Duration
+}
+
+func tokenConfigFromEnv() tokenConfig {
+	return tokenConfig{
+		accessTTL:   time.Duration(envInt("JWT_ACCESS_TTL_MINUTES", 15)) * time.Minute,
+		refreshTTL:  time.Duration(envInt("JWT_REFRESH_TTL_HOURS", 720)) * time.Hour,
+		keyRotation: time.Duration(envInt("JWT_KEY_ROTATION_HOURS", 720)) * time.Hour,
+		keyGrace:    24 * time.Hour,
+	}
+}
+
+// Unknown kids reload the key set at most once per keyReloadInterval, and a
+// kid that still isn't known is refused without reloading for keyMissTTL, so
+// tokens with made-up kids can't hammer the database.
+const (
+	keyReloadInterval = 10 * time.Second
+	keyMissTTL        = time.Minute
+	maxKeyMisses      = 1024
+)
+
+type KeyStore struct {
+	db  *gorm.DB
+	cfg tokenConfig
+
+	mu        sync.RWMutex
+	activeKID string
+	active    *rsa.PrivateKey
+	public    map[string]*rsa.PublicKey
+
+	// reloadMu lets one caller reload for an unknown kid while the others
+	// wait and use its result.
+	reloadMu   sync.Mutex
+	lastReload time.Time
+	misses     map[string]time.Time
+}
+
+func NewKeyStore(db *gorm.DB, cfg tokenConfig) (*KeyStore, error) {
+	s := &KeyStore{db: db, cfg: cfg}
+	if err := s.Rotate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Rotate generates a new signing key when the active one is older than the
+// rotation interval, then reloads every key that is still published.
+func (s *KeyStore) Rotate() error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var current SigningKey
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("retired_at IS NULL").Order("created_at desc").First(&current).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		if err == nil && time.Since(current.CreatedAt) < s.cfg.keyRotation {
+			return nil
+		}
+
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return fmt.Errorf("couldn't generate signing key: %w", err)
+		}
+
+		now := time.Now()
+		if current.ID != 0 {
+			if err := tx.Model(&current).Update("retired_at", now).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Create(&SigningKey{
+			KID:        fmt.Sprintf("key_%d", now.UnixNano()),
+			PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.reload()
+}
+
+func (s *KeyStore) reload() error {
+	var keys []SigningKey
+	err := s.db.Where("retired_at IS NULL OR retired_at > ?", time.Now().Add(-s.cfg.keyGrace)).
+		Order("created_at desc").Find(&keys).Error
+	if err != nil {
+		return err
+	}
+
+	public := make(map[string]*rsa.PublicKey, len(keys))
+	var activeKID string
+	var active *rsa.PrivateKey
+
+	for _, k := range keys {
+		block, _ := pem.Decode([]byte(k.PrivateKey))
+		if block == nil {
+			log.Printf("skipping signing key %s: invalid pem", k.KID)
+			continue
+		}
+		priv, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			log.Printf("skipping signing key %s: %v", k.KID, err)
+			continue
+		}
+
+		public[k.KID] = &priv.PublicKey
+		if active == nil && k.RetiredAt == nil {
+			activeKID, active = k.KID, priv
+		}
+	}
+
+	if active == nil {
+		return errors.New("no active signing key")
+	}
+
+	s.mu.Lock()
+	s.activeKID, s.active, s.public = activeKID, active, public
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *KeyStore) PublicKey(kid string) (*rsa.PublicKey, error) {
+	if key, ok := s.lookup(kid); ok {
+		return key, nil
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	if missed, ok := s.misses[kid]; ok && time.Since(missed) < keyMissTTL {
+		return nil, auth.ErrUnknownKey
+	}
+
+	// Another replica may have rotated since we last loaded.
+	if time.Since(s.lastReload) >= keyReloadInterval {
+		if err := s.reload(); err != nil {
+			return nil, err
+		}
+		s.lastReload = time.Now()
+	}
+
+	if key, ok := s.lookup(kid); ok {
+		return key, nil
+	}
+
+	if s.misses == nil || len(s.misses) >= maxKeyMisses {
+		s.misses = map[string]time.Time{}
+	}
+	s.misses[kid] = time.Now()
+	return nil, auth.ErrUnknownKey
+}
+
+func (s *KeyStore) lookup(kid string) (*rsa.PublicKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.public[kid]
+	return key, ok
+}
+
+func (s *KeyStore) JWKS() auth.JWKS {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	set := auth.JWKS{Keys: make([]auth.JWK, 0, len(s.public))}
+	for kid, key := range s.public {
+		set.Keys = append(set.Keys, auth.NewJWK(kid, key))
+	}
+	return set
+}
+
+func (s *KeyStore) signer() (string, *rsa.PrivateKey) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.activeKID, s.active
+}
+
+func (s *KeyStore) RunRotation(every time.Duration) {
+	for {
+		time.Sleep(every)
+		if err := s.Rotate(); err != nil {
+			log.Printf("couldn't rotate signing keys: %v", err)
+		}
+	}
+}
+
+func issueTokens(tx *gorm.DB, member Member) (TokenPair, error) {
+	now := time.Now()
+	kid, key := keys.signer()
+
+	access, err := auth.Sign(kid, key, &auth.Claims{
+		Email: member.Email,
+		Role:  member.Role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    auth.Issuer,
+			Subject:   strconv.FormatUint(uint64(member.ID), 10),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(tokenCfg.accessTTL)),
+			ID:        fmt.Sprintf("at_%d", now.UnixNano()),
+		},
+	})
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return TokenPair{}, fmt.Errorf("couldn't generate refresh token: %w", err)
+	}
+	refresh := base64.RawURLEncoding.EncodeToString(raw)
+
+	err = tx.Create(&RefreshToken{
+		TokenHash: hashRefreshToken(refresh),
+		MemberID:  member.ID,
+		ExpiresAt: now.Add(tokenCfg.refreshTTL),
+	}).Error
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	return TokenPair{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(tokenCfg.accessTTL.Seconds()),
+	}, nil
+}
+
+func issueServiceToken(service string) (auth.ServiceTokenResponse, error) {
+	now := time.Now()
+	kid, key := keys.signer()
+
+	access, err := auth.Sign(kid, key, &auth.Claims{
+		Role: auth.RoleService,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    auth.Issuer,
+			Subject:   auth.ServiceSubjectPrefix + service,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(tokenCfg.accessTTL)),
+			ID:        fmt.Sprintf("st_%d", now.UnixNano()),
+		},
+	})
+	if err != nil {
+		return auth.ServiceTokenResponse{}, err
+	}
+
+	return auth.ServiceTokenResponse{
+		AccessToken: access,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(tokenCfg.accessTTL.Seconds()),
+	}, nil
+}
+
+// rotateRefreshToken exchanges a refresh token for a new pair. Presenting a
+// token that was already revoked revokes every token the member holds, since
+// it means the token leaked.
+func rotateRefreshToken(raw string) (TokenPair, error) {
+	var pair TokenPair
+	var reused bool
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var token RefreshToken
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ?", hashRefreshToken(raw)).First(&token).Error; err != nil {
+			return errInvalidRefreshToken
+		}
+
+		if token.RevokedAt != nil {
+			reused = true
+			return nil
+		}
+		if time.Now().After(token.ExpiresAt) {
+			return errInvalidRefreshToken
+		}
+
+		var member Member
+		if err := tx.First(&member, token.MemberID).Error; err != nil {
+			return errInvalidRefreshToken
+		}
+
+		if err := tx.Model(&token).Update("revoked_at", time.Now()).Error; err != nil {
+			return err
+		}
+
+		var err error
+		pair, err = issueTokens(tx, member)
+		return err
+	})
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	if reused {
+		var token RefreshToken
+		if err := db.Where("token_hash = ?", hashRefreshToken(raw)).First(&token).Error; err == nil {
+			revokeAllRefreshTokens(token.MemberID)
+		}
+		return TokenPair{}, errRefreshTokenReused
+	}
+
+	return pair, nil
+}
+
+func revokeRefreshToken(raw string) (RefreshToken, error) {
+	var token RefreshToken
+	if err := db.Where("token_hash = ?", hashRefreshToken(raw)).First(&token).Error; err != nil {
+		return token, errInvalidRefreshToken
+	}
+
+	if token.RevokedAt == nil {
+		if err := db.Model(&token).Update("revoked_at", time.Now()).Error; err != nil {
+			return token, err
+		}
+	}
+	return token, nil
+}
+
+func revokeAllRefreshTokens(memberID uint) error {
+	return db.Model(&RefreshToken{}).
+		Where("member_id = ? AND revoked_at IS NULL", memberID).
+		Update("revoked_at", time.Now()).Error
+}
+
+func hashRefreshToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/zensos/microservice-project/internal/events"
+	"github.com/zensos/microservice-project/internal/middleware"
+	"github.com/zensos/microservice-project/internal/money"
+	"github.com/zensos/microservice-project/internal/rabbitmq"
+	"gorm.io/gorm"
+)
+
+// publish queues a domain event in tx, so it goes out only if the change it
+// describes is committed.
+func publish(tx *gorm.DB, eventType string, data any) error {
+	body, err := events.Marshal(eventType, data)
+	if err != nil {
+		return err
+	}
+	return rabbitmq.Enqueue(tx, eventType, body)
+}
+
+// lowBalanceThreshold is the available balance below which members are
+// warned, in the currency of their wallet.
+func lowBalanceThreshold(currency string) (money.Money, bool) {
+	raw := os.Getenv("WALLET_LOW_BALANCE")
+	if raw == "" {
+		raw = "100"
+	}
+	threshold, err := money.Parse(raw, currency)
+	if err != nil {
+		log.Printf("WALLET_LOW_BALANCE is not a valid amount: %v", err)
+		return threshold, false
+	}
+	return threshold, true
+}
+
+// claimsEmail is the caller's email when members act on their own wallet.
+// Payment doesn't keep members' addresses, so requests made on a member's
+// behalf pass theirs along instead.
+func claimsEmail(c fiber.Ctx, memberID string) string {
+	if claims := middleware.Claims(c); claims != nil && claims.Subject == memberID {
+		return claims.Email
+	}
+	return ""
+}
+
+// checkLowBalance publishes wallet.low_balance when a debit took the
+// wallet's available balance from before to under the threshold. It only
+// fires on the crossing, so a member isn't warned on every payment.
+func checkLowBalance(tx *gorm.DB, memberID, email string, before money.Money) error {
+	var wallet Wallet
+	if err := tx.Where("member_id = ?", memberID).First(&wallet).Error; err != nil {
+		return err
+	}
+
+	threshold, ok := lowBalanceThreshold(wallet.Balance.Currency)
+	if !ok || !before.SameCurrency(wallet.Balance) {
+		return nil
+	}
+	if before.Cmp(threshold) < 0 || wallet.Balance.Cmp(threshold) >= 0 {
+		return nil
+	}
+
+	return publish(tx, events.TypeWalletLowBalance, events.WalletLowBalance{
+		MemberID:    memberID,
+		MemberEmail: email,
+		Balance:     wallet.Balance,
+		Threshold:   threshold,
+	})
+}
+
+func publishPaymentConfirmed(tx *gorm.DB, p Payment, email string) error {
+	return publish(tx, events.TypePaymentConfirmed, events.PaymentConfirmed{
+		PaymentID:   p.PaymentID,
+		BookingID:   p.BookingID,
+		MemberID:    p.MemberID,
+		MemberEmail: email,
+		Amount:      p.Amount,
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/zensos/microservice-project/internal/money"
+)
+
+var (
+	ErrUnknownIntent    = errors.New("provider doesn't know this intent")
+	ErrInvalidSignature = errors.New("webhook signature is invalid")
+)
+
+type ProviderStatus string
+
+const (
+	ProviderPending   ProviderStatus = "pending"
+	ProviderSucceeded ProviderStatus = "succeeded"
+	ProviderFailed    ProviderStatus = "failed"
+	ProviderExpired   ProviderStatus = "expired"
+)
+
+// ProviderIntent is what a provider hands back for a new intent: its own
+// reference and what the member has to do to pay, e.g. scan a QR code.
+type ProviderIntent struct {
+	Reference    string
+	Instructions map[string]string
+	ExpiresAt    time.Time
+}
+
+// ProviderResult is the provider's view of an intent, from a poll or a
+// webhook.
+type ProviderResult struct {
+	EventID   string
+	Reference string
+	Status    ProviderStatus
+	Amount    money.Money
+}
+
+// Gateway is a payment provider that collects top-ups for one method.
+type Gateway interface {
+	Name() string
+	CreateIntent(intent TopUpIntent) (ProviderIntent, error)
+	FetchStatus(reference string) (ProviderResult, error)
+	// VerifyWebhook checks the signature of a callback no older than maxAge,
+	// or of any age if maxAge is zero, and parses it.
+	VerifyWebhook(header http.Header, body []byte, maxAge time.Duration) (ProviderResult, error)
+}
+
+var topUpMethods = []TopUpMethod{TopUpPromptpay, TopUpBanking, TopUpTrueWallet}
+
+var (
+	gatewaysByMethod   = map[TopUpMethod]Gateway{}
+	gatewaysByProvider = map[string]Gateway{}
+)
+
+// setupGateways picks the provider of each top-up method from
+// TOPUP_GATEWAY_<METHOD>, falling back to TOPUP_GATEWAY. A method without a
+// usable provider is turned off rather than keeping the rest of the service
+// from starting; the built-in mock has to be enabled explicitly.
+func setupGateways() error {
+	fallback := os.Getenv("TOPUP_GATEWAY")
+
+	for _, method := range topUpMethods {
+		provider := os.Getenv("TOPUP_GATEWAY_" + strings.ToUpper(string(method)))
+		if provider == "" {
+			provider = fallback
+		}
+
+		var gateway Gateway
+		switch provider {
+		case "":
+			log.Printf("top-ups with %s are turned off, set TOPUP_GATEWAY or TOPUP_GATEWAY_%s to enable them",
+				method, strings.ToUpper(string(method)))
+			continue
+		case "mock":
+			if err := checkMockGateway(); err != nil {
+				log.Printf("top-ups with %s are turned off: %v", method, err)
+				continue
+			}
+			gateway = mockGatewayFor(method)
+		default:
+			return fmt.Errorf("unknown top-up gateway %q for %s", provider, method)
+		}
+
+		gatewaysByMethod[method] = gateway
+		gatewaysByProvider[gateway.Name()] = gateway
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"maps"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// resetGateways clears what setupGateways registered once the test is done.
+func resetGateways(t *testing.T) {
+	t.Cleanup(func() {
+		clear(gatewaysByMethod)
+		clear(gatewaysByProvider)
+	})
+}
+
+func TestSetupGateways(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want []TopUpMethod
+		err  bool
+	}{
+		{"nothing configured", nil, nil, false},
+		{"mock for everything", map[string]string{
+			"TOPUP_GATEWAY": "mock", "MOCK_GATEWAY_ENABLED": "true", "MOCK_GATEWAY_SECRET": "secret",
+		}, []TopUpMethod{TopUpBanking, TopUpPromptpay, TopUpTrueWallet}, false},
+		{"mock for one method", map[string]string{
+			"TOPUP_GATEWAY_BANKING": "mock", "MOCK_GATEWAY_ENABLED": "true", "MOCK_GATEWAY_SECRET": "secret",
+		}, []TopUpMethod{TopUpBanking}, false},
+		{"mock in production", map[string]string{
+			"TOPUP_GATEWAY": "mock", "MOCK_GATEWAY_ENABLED": "true", "MOCK_GATEWAY_SECRET": "secret", "APP_ENV": "production",
+		}, nil, false},
+		{"mock not enabled", map[string]string{"TOPUP_GATEWAY": "mock"}, nil, false},
+		{"unknown provider", map[string]string{"TOPUP_GATEWAY": "acme"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"TOPUP_GATEWAY", "TOPUP_GATEWAY_PROMPTPAY", "TOPUP_GATEWAY_BANKING",
+				"TOPUP_GATEWAY_TRUEWALLET", "MOCK_GATEWAY_ENABLED", "MOCK_GATEWAY_SECRET", "APP_ENV"} {
+				t.Setenv(key, tt.env[key])
+			}
+			resetGateways(t)
+
+			err := setupGateways()
+			if (err != nil) != tt.err {
+				t.Fatalf("setupGateways() = %v", err)
+			}
+			if err != nil {
+				return
+			}
+			got := slices.Sorted(maps.Keys(gatewaysByMethod))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("enabled %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateTopUpMethodOff(t *testing.T) {
+	resetGateways(t)
+	app := fiber.New()
+	app.Post("/wallets/top-up", createTopUp)
+
+	tests := []struct {
+		method string
+		want   int
+	}{
+		{"promptpay", 503},
+		{"cash", 400},
+	}
+	for _, tt := range tests {
+		body := `{"member_id":"m1","amount":"100","method":"` + tt.method + `"}`
+		req := httptest.NewRequest("POST", "/wallets/top-up", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.method, resp.StatusCode, tt.want)
+		}
+	}
+}
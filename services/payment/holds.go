@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/zensos/microservice-project/internal/money"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	errBookingAlreadyPaid = errors.New("booking_id is already paid")
+	errHoldNotFound       = errors.New("no authorized payment found for this booking")
+	errHoldState          = errors.New("payment is not in a state that allows this")
+)
+
+const maxHoldMinutes = 24 * 60
+
+// paymentHoldDuration is how long an authorized amount stays held before
+// it's given back, unless the request asks for a different time.
+func paymentHoldDuration(requested int) time.Duration {
+	if requested > 0 {
+		return time.Duration(min(requested, maxHoldMinutes)) * time.Minute
+	}
+	minutes, err := strconv.Atoi(os.Getenv("PAYMENT_HOLD_MINUTES"))
+	if err != nil || minutes < 1 {
+		minutes = 15
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// paymentLedger records a step of an authorized payment on the member's
+// ledger. Capturing only moves money from held to the platform, so its
+// amount is zero.
+func paymentLedger(tx *gorm.DB, p Payment, kind LedgerType, amount money.Money) (Ledger, error) {
+	var wallet Wallet
+	if err := tx.Where("member_id = ?", p.MemberID).First(&wallet).Error; err != nil {
+		return Ledger{}, err
+	}
+
+	ledger := Ledger{
+		MemberID:     p.MemberID,
+		Type:         kind,
+		Amount:       amount,
+		BalanceAfter: wallet.Balance,
+		ReferenceID:  p.PaymentID,
+	}
+	return ledger, tx.Create(&ledger).Error
+}
+
+// authorizePayment moves the amount from the wallet's available balance to
+// held. Nothing is charged until booking captures it.
+func authorizePayment(c fiber.Ctx) error {
+	var req AuthorizePaymentRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid request body"})
+	}
+
+	if req.MemberID == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "member_id is required"})
+	}
+	if req.BookingID == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "booking_id is required"})
+	}
+	if !req.Amount.IsPositive() {
+		return c.Status(400).JSON(fiber.Map{"error": "amount must be greater than 0"})
+	}
+
+	var payment Payment
+	var ledger Ledger
+
+	txErr := db.Transaction(func(tx *gorm.DB) error {
+		var existing Payment
+		if err := tx.Where("booking_id = ? AND status IN ?", req.BookingID,
+			[]string{PaymentAuthorized, PaymentConfirmed, PaymentPartiallyRefunded}).First(&existing).Error; err == nil {
+			return errBookingAlreadyPaid
+		}
+
+		var wallet Wallet
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("member_id = ?", req.MemberID).First(&wallet).Error; err != nil {
+			return errSenderWalletMissing
+		}
+		if !wallet.Balance.SameCurrency(req.Amount) {
+			return money.ErrCurrencyMismatch
+		}
+		if wallet.Balance.Cmp(req.Amount) < 0 {
+			return errInsufficientBalance
+		}
+
+		paymentID := fmt.Sprintf("pay_%d", time.Now().UnixNano())
+		if _, err := postJournal(tx, LedgerPaymentHold, paymentID,
+			debit(walletAccount(req.MemberID), req.Amount),
+			credit(walletHeldAccount(req.MemberID), req.Amount),
+		); err != nil {
+			return err
+		}
+
+		expiresAt := time.Now().Add(paymentHoldDuration(req.HoldMinutes))
+		payment = Payment{
+			PaymentID:      paymentID,
+			BookingID:      req.BookingID,
+			MemberID:       req.MemberID,
+			Amount:         req.Amount,
+			RefundedAmount: money.Zero(req.Amount.Currency),
+			Status:         PaymentAuthorized,
+			HoldExpiresAt:  &expiresAt,
+		}
+		if err := tx.Create(&payment).Error; err != nil {
+			return err
+		}
+
+		var err error
+		if ledger, err = paymentLedger(tx, payment, LedgerPaymentHold, req.Amount.Neg()); err != nil {
+			return err
+		}
+		return checkLowBalance(tx, req.MemberID, req.MemberEmail, wallet.Balance)
+	})
+
+	switch {
+	case errors.Is(txErr, money.ErrCurrencyMismatch):
+		return c.Status(400).JSON(fiber.Map{"error": "amount currency does not match the wallet currency"})
+	case errors.Is(txErr, errBookingAlreadyPaid):
+		return c.Status(409).JSON(fiber.Map{"error": txErr.Error()})
+	case errors.Is(txErr, errSenderWalletMissing):
+		return c.Status(404).JSON(fiber.Map{"error": txErr.Error()})
+	case errors.Is(txErr, errInsufficientBalance):
+		return c.Status(400).JSON(fiber.Map{"error": txErr.Error()})
+	case txErr != nil:
+		return c.Status(500).JSON(fiber.Map{"error": "failed to authorize payment"})
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"payment": payment,
+		"ledger":  ledger,
+	})
+}
+
+// settleHold locks the booking's latest payment and, if it's still
+// authorized, runs apply on it. done lists the statuses that mean the call
+// already happened, which are answered as success so retries are safe.
+func settleHold(c fiber.Ctx, done []string, apply func(tx *gorm.DB, p *Payment, req SettleHoldRequest) (Ledger, error)) error {
+	var req SettleHoldRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid request body"})
+	}
+	if req.BookingID == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "booking_id is required"})
+	}
+
+	var payment Payment
+	var ledger *Ledger
+
+	txErr := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("booking_id = ? AND member_id = ?", req.BookingID, req.MemberID).
+			Order("id DESC").First(&payment).Error; err != nil {
+			return errHoldNotFound
+		}
+		if slices.Contains(done, payment.Status) {
+			return nil
+		}
+		if payment.Status != PaymentAuthorized {
+			return errHoldState
+		}
+
+		entry, err := apply(tx, &payment, req)
+		if err != nil {
+			return err
+		}
+		ledger = &entry
+		return tx.Save(&payment).Error
+	})
+
+	switch {
+	case errors.Is(txErr, errHoldNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": txErr.Error()})
+	case errors.Is(txErr, errHoldState):
+		return c.Status(409).JSON(fiber.Map{"error": "payment is already " + payment.Status})
+	case txErr != nil:
+		return c.Status(500).JSON(fiber.Map{"error": "failed to update payment"})
+	}
+
+	return c.JSON(fiber.Map{
+		"payment": payment,
+		"ledger":  ledger,
+	})
+}
+
+// capturePayment charges an authorized amount, moving it from held to
+// revenue.
+func capturePayment(c fiber.Ctx) error {
+	done := []string{PaymentConfirmed, PaymentPartiallyRefunded, PaymentRefunded}
+	return settleHold(c, done, func(tx *gorm.DB, p *Payment, req SettleHoldRequest) (Ledger, error) {
+		if _, err := postJournal(tx, LedgerPayment, p.PaymentID,
+			debit(walletHeldAccount(p.MemberID), p.Amount),
+			credit(RevenueAccount, p.Amount),
+		); err != nil {
+			return Ledger{}, err
+		}
+		now := time.Now()
+		p.Status = PaymentConfirmed
+		p.CapturedAt = &now
+		if err := publishPaymentConfirmed(tx, *p, req.MemberEmail); err != nil {
+			return Ledger{}, err
+		}
+		return paymentLedger(tx, *p, LedgerPaymentCaptured, money.Zero(p.Amount.Currency))
+	})
+}
+
+// voidPayment gives an authorized amount back to the wallet. A captured
+// payment can't be voided and has to be refunded instead.
+func voidPayment(c fiber.Ctx) error {
+	done := []string{PaymentVoided, PaymentExpired}
+	return settleHold(c, done, func(tx *gorm.DB, p *Payment, _ SettleHoldRequest) (Ledger, error) {
+		return releaseHold(tx, p, PaymentVoided)
+	})
+}
+
+func releaseHold(tx *gorm.DB, p *Payment, status string) (Ledger, error) {
+	if _, err := postJournal(tx, LedgerPaymentReleased, p.PaymentID,
+		debit(walletHeldAccount(p.MemberID), p.Amount),
+		credit(walletAccount(p.MemberID), p.Amount),
+	); err != nil {
+		return Ledger{}, err
+	}
+	p.Status = status
+	return paymentLedger(tx, *p, LedgerPaymentReleased, p.Amount)
+}
+
+// expirePaymentHolds gives back holds that were never captured or voided,
+// e.g. because booking crashed between authorizing and confirming.
+func expirePaymentHolds(every time.Duration) {
+	for {
+		var stale []Payment
+		if err := db.Where("status = ? AND hold_expires_at < ?", PaymentAuthorized, time.Now()).
+			Order("id").Limit(100).Find(&stale).Error; err != nil {
+			log.Printf("couldn't load expired payment holds: %v", err)
+		}
+
+		for _, p := range stale {
+			err := db.Transaction(func(tx *gorm.DB) error {
+				var payment Payment
+				if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&payment, p.ID).Error; err != nil {
+					return err
+				}
+				if payment.Status != PaymentAuthorized {
+					return nil
+				}
+				if _, err := releaseHold(tx, &payment, PaymentExpired); err != nil {
+					return err
+				}
+				return tx.Save(&payment).Error
+			})
+			if err != nil {
+				log.Printf("couldn't expire payment hold %s: %v", p.PaymentID, err)
+			}
+		}
+
+		time.Sleep(every)
+	}
+}
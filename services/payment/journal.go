@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/zensos/microservice-project/internal/money"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	walletAccountPrefix     = "wallet:"
+	walletHeldAccountPrefix = "wallet_held:"
+
+	RevenueAccount        = "platform:revenue"
+	RefundClearingAccount = "platform:refund_clearing"
+	// FundingAccount is the counterpart of money entering or leaving the
+	// platform, e.g. top-ups.
+	FundingAccount = "platform:funding"
+	// PayoutClearingAccount holds approved withdrawals until they are paid
+	// out.
+	PayoutClearingAccount = "platform:payout_clearing"
+)
+
+var ErrUnbalanced = errors.New("journal postings don't balance")
+
+var platformAccounts = map[string]AccountKind{
+	RevenueAccount:        AccountRevenue,
+	RefundClearingAccount: AccountRefundClearing,
+	FundingAccount:        AccountFunding,
+	PayoutClearingAccount: AccountPayoutClearing,
+}
+
+type posting struct {
+	account string
+	amount  money.Money
+}
+
+func walletAccount(memberID string) string {
+	return walletAccountPrefix + memberID
+}
+
+// walletHeldAccount is the part of a wallet reserved for pending withdrawals.
+func walletHeldAccount(memberID string) string {
+	return walletHeldAccountPrefix + memberID
+}
+
+func credit(account string, amount money.Money) posting {
+	return posting{account: account, amount: amount}
+}
+
+func debit(account string, amount money.Money) posting {
+	return posting{account: account, amount: amount.Neg()}
+}
+
+func seedAccounts(db *gorm.DB) error {
+	for code, kind := range platformAccounts {
+		err := db.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&Account{Code: code, Kind: kind}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ensureAccount(tx *gorm.DB, code string) error {
+	account := Account{Code: code}
+	if memberID, ok := strings.CutPrefix(code, walletAccountPrefix); ok {
+		account.Kind = AccountWallet
+		account.MemberID = memberID
+	} else if memberID, ok := strings.CutPrefix(code, walletHeldAccountPrefix); ok {
+		account.Kind = AccountWalletHeld
+		account.MemberID = memberID
+	} else if kind, ok := platformAccounts[code]; ok {
+		account.Kind = kind
+	} else {
+		return fmt.Errorf("unknown account %q", code)
+	}
+
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&account).Error
+}
+
+// recordJournal writes a balanced journal transaction without touching
+// wallet balances.
+func recordJournal(tx *gorm.DB, kind LedgerType, reference string, postings ...posting) (JournalTransaction, error) {
+	if len(postings) < 2 {
+		return JournalTransaction{}, ErrUnbalanced
+	}
+
+	sum := money.Zero(postings[0].amount.Currency)
+	for _, p := range postings {
+		if !sum.SameCurrency(p.amount) {
+			return JournalTransaction{}, money.ErrCurrencyMismatch
+		}
+		sum = sum.Add(p.amount)
+	}
+	if !sum.IsZero() {
+		return JournalTransaction{}, ErrUnbalanced
+	}
+
+	journal := JournalTransaction{
+		TransactionID: fmt.Sprintf("jtx_%d", time.Now().UnixNano()),
+		Type:          kind,
+		ReferenceID:   reference,
+	}
+	for _, p := range postings {
+		if err := ensureAccount(tx, p.account); err != nil {
+			return journal, err
+		}
+		journal.Entries = append(journal.Entries, JournalEntry{
+			AccountCode: p.account,
+			Amount:      p.amount,
+		})
+	}
+
+	return journal, tx.Create(&journal).Error
+}
+
+// postJournal records a balanced transaction and applies its wallet and held
+// postings to the wallet balances, so a balance only ever moves together with the
+// journal entries that explain it. Wallets must already exist.
+func postJournal(tx *gorm.DB, kind LedgerType, reference string, postings ...posting) (JournalTransaction, error) {
+	journal, err := recordJournal(tx, kind, reference, postings...)
+	if err != nil {
+		return journal, err
+	}
+
+	for _, p := range postings {
+		column := "balance"
+		memberID, ok := strings.CutPrefix(p.account, walletAccountPrefix)
+		if !ok {
+			if memberID, ok = strings.CutPrefix(p.account, walletHeldAccountPrefix); !ok {
+				continue
+			}
+			column = "held"
+		}
+
+		result := tx.Model(&Wallet{}).
+			Where("member_id = ? AND "+column+"_currency = ?", memberID, p.amount.Currency).
+			Update(column+"_minor", gorm.Expr(column+"_minor + ?", p.amount.Minor))
+		if result.Error != nil {
+			return journal, result.Error
+		}
+		if result.RowsAffected != 1 {
+			return journal, fmt.Errorf("no %s wallet for member %s", p.amount.Currency, memberID)
+		}
+	}
+
+	return journal, nil
+}
+
+// backfillOpeningBalances gives wallets that predate the journal an opening
+// entry, so reconciliation starts from their current balance.
+func backfillOpeningBalances(db *gorm.DB) error {
+	var wallets []Wallet
+	err := db.Where("balance_minor <> 0 AND NOT EXISTS (?)",
+		db.Model(&JournalEntry{}).Select("1").Where("account_code = ? || wallets.member_id", walletAccountPrefix),
+	).Find(&wallets).Error
+	if err != nil {
+		return err
+	}
+
+	for _, wallet := range wallets {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			_, err := recordJournal(tx, LedgerOpeningBalance, fmt.Sprintf("opening_%d", wallet.ID),
+				debit(FundingAccount, wallet.Balance),
+				credit(walletAccount(wallet.MemberID), wallet.Balance),
+			)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(wallets) > 0 {
+		log.Printf("recorded opening balances for %d wallets", len(wallets))
+	}
+	return nil
+}
+
+type walletDiscrepancy struct {
+	MemberID       string      `json:"member_id"`
+	SubBalance     string      `json:"sub_balance"`
+	WalletBalance  money.Money `json:"wallet_balance"`
+	JournalBalance money.Money `json:"journal_balance"`
+	Difference     money.Money `json:"difference"`
+}
+
+func newWalletDiscrepancy(memberID, subBalance string, wallet, journal money.Money) walletDiscrepancy {
+	return walletDiscrepancy{
+		MemberID:       memberID,
+		SubBalance:     subBalance,
+		WalletBalance:  wallet,
+		JournalBalance: journal,
+		Difference:     wallet.Sub(journal),
+	}
+}
+
+type unbalancedTransaction struct {
+	TransactionID string      `json:"transaction_id"`
+	Imbalance     money.Money `json:"imbalance"`
+}
+
+type accountBalance struct {
+	Account string      `json:"account"`
+	Balance money.Money `json:"balance"`
+}
+
+// reconcile recomputes every wallet balance from the journal and reports
+// wallets that disagree, transactions whose entries don't sum to zero, and
+// the balances of the platform accounts.
+func reconcile(c fiber.Ctx) error {
+	var wallets []struct {
+		MemberID         string
+		BalanceMinor     int64
+		HeldMinor        int64
+		BalanceCurrency  string
+		HeldCurrency     string
+		JournalMinor     int64
+		JournalHeldMinor int64
+	}
+	err := db.Raw(`
+		SELECT w.member_id, w.balance_minor, w.held_minor, w.balance_currency, w.held_currency,
+			COALESCE((SELECT SUM(e.amount_minor) FROM journal_entries e
+				WHERE e.account_code = ? || w.member_id AND e.amount_currency = w.balance_currency), 0) AS journal_minor,
+			COALESCE((SELECT SUM(e.amount_minor) FROM journal_entries e
+				WHERE e.account_code = ? || w.member_id AND e.amount_currency = w.held_currency), 0) AS journal_held_minor
+		FROM wallets w
+		WHERE w.deleted_at IS NULL`, walletAccountPrefix, walletHeldAccountPrefix).
+		Scan(&wallets).Error
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to load wallet balances"})
+	}
+
+	discrepancies := []walletDiscrepancy{}
+	for _, w := range wallets {
+		if w.BalanceMinor != w.JournalMinor {
+			discrepancies = append(discrepancies, newWalletDiscrepancy(w.MemberID, "available",
+				money.New(w.BalanceMinor, w.BalanceCurrency), money.New(w.JournalMinor, w.BalanceCurrency)))
+		}
+		if w.HeldMinor != w.JournalHeldMinor {
+			discrepancies = append(discrepancies, newWalletDiscrepancy(w.MemberID, "held",
+				money.New(w.HeldMinor, w.HeldCurrency), money.New(w.JournalHeldMinor, w.HeldCurrency)))
+		}
+	}
+
+	var imbalances []struct {
+		TransactionID  string
+		AmountCurrency string
+		Total          int64
+	}
+	err = db.Raw(`
+		SELECT transaction_id, amount_currency, SUM(amount_minor) AS total
+		FROM journal_entries
+		GROUP BY transaction_id, amount_currency
+		HAVING SUM(amount_minor) <> 0`).
+		Scan(&imbalances).Error
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to check journal transactions"})
+	}
+
+	unbalanced := []unbalancedTransaction{}
+	for _, t := range imbalances {
+		unbalanced = append(unbalanced, unbalancedTransaction{
+			TransactionID: t.TransactionID,
+			Imbalance:     money.New(t.Total, t.AmountCurrency),
+		})
+	}
+
+	var totals []struct {
+		AccountCode    string
+		AmountCurrency string
+		Total          int64
+	}
+	err = db.Raw(`
+		SELECT account_code, amount_currency, SUM(amount_minor) AS total
+		FROM journal_entries
+		WHERE account_code NOT LIKE ? AND account_code NOT LIKE ?
+		GROUP BY account_code, amount_currency
+		ORDER BY account_code, amount_currency`, walletAccountPrefix+"%", walletHeldAccountPrefix+"%").
+		Scan(&totals).Error
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to load account balances"})
+	}
+
+	accounts := []accountBalance{}
+	for _, t := range totals {
+		accounts = append(accounts, accountBalance{
+			Account: t.AccountCode,
+			Balance: money.New(t.Total, t.AmountCurrency),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"ok":                      len(discrepancies) == 0 && len(unbalanced) == 0,
+		"checked_at":              time.Now(),
+		"wallets_checked":         len(wallets),
+		"discrepancies":           discrepancies,
+		"unbalanced_transactions": unbalanced,
+		"platform_accounts":       accounts,
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/zensos/microservice-project/internal/money"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testDB points the package's db at a fresh in-memory database with the
+// journal tables and the given wallets.
+func testDB(t *testing.T, wallets ...Wallet) *gorm.DB {
+	t.Helper()
+	conn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.AutoMigrate(&Wallet{}, &Account{}, &JournalTransaction{}, &JournalEntry{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := seedAccounts(conn); err != nil {
+		t.Fatal(err)
+	}
+	for i := range wallets {
+		if err := conn.Create(&wallets[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	previous := db
+	db = conn
+	t.Cleanup(func() { db = previous })
+	return conn
+}
+
+func thb(minor int64) money.Money {
+	return money.New(minor, "THB")
+}
+
+func TestPostJournal(t *testing.T) {
+	tests := []struct {
+		name          string
+		kind          LedgerType
+		postings      []posting
+		fails         bool
+		err           error
+		balance, held int64
+	}{
+		{"top-up", LedgerTopUp, []posting{
+			debit(FundingAccount, thb(500)),
+			credit(walletAccount("m1"), thb(500)),
+		}, false, nil, 1500, 0},
+		{"hold", LedgerPaymentHold, []posting{
+			debit(walletAccount("m1"), thb(300)),
+			credit(walletHeldAccount("m1"), thb(300)),
+		}, false, nil, 700, 300},
+		{"refund through clearing", LedgerRefund, []posting{
+			debit(RevenueAccount, thb(200)),
+			credit(RefundClearingAccount, thb(200)),
+			debit(RefundClearingAccount, thb(200)),
+			credit(walletAccount("m1"), thb(200)),
+		}, false, nil, 1200, 0},
+		{"unbalanced", LedgerPayment, []posting{
+			debit(walletAccount("m1"), thb(300)),
+			credit(RevenueAccount, thb(200)),
+		}, true, ErrUnbalanced, 1000, 0},
+		{"single posting", LedgerPayment, []posting{
+			credit(walletAccount("m1"), thb(0)),
+		}, true, ErrUnbalanced, 1000, 0},
+		{"mixed currencies", LedgerPayment, []posting{
+			debit(walletAccount("m1"), thb(300)),
+			credit(RevenueAccount, money.New(300, "USD")),
+		}, true, money.ErrCurrencyMismatch, 1000, 0},
+		{"unknown account", LedgerPayment, []posting{
+			debit(walletAccount("m1"), thb(300)),
+			credit("platform:nowhere", thb(300)),
+		}, true, nil, 1000, 0},
+		{"missing wallet", LedgerPayment, []posting{
+			debit(walletAccount("ghost"), thb(300)),
+			credit(RevenueAccount, thb(300)),
+		}, true, nil, 1000, 0},
+		{"wallet in another currency", LedgerPayment, []posting{
+			debit(walletAccount("m1"), money.New(300, "USD")),
+			credit(RevenueAccount, money.New(300, "USD")),
+		}, true, nil, 1000, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := testDB(t, Wallet{MemberID: "m1", Balance: thb(1000), Held: thb(0)})
+
+			err := conn.Transaction(func(tx *gorm.DB) error {
+				_, err := postJournal(tx, tt.kind, "ref_1", tt.postings...)
+				return err
+			})
+
+			if tt.fails && err == nil {
+				t.Fatal("expected an error")
+			}
+			if !tt.fails && err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+
+			var wallet Wallet
+			if err := conn.Where("member_id = ?", "m1").First(&wallet).Error; err != nil {
+				t.Fatal(err)
+			}
+			if wallet.Balance != thb(tt.balance) || wallet.Held != thb(tt.held) {
+				t.Errorf("wallet is %s available, %s held, want %s and %s",
+					wallet.Balance, wallet.Held, thb(tt.balance), thb(tt.held))
+			}
+
+			var entries []JournalEntry
+			if err := conn.Find(&entries).Error; err != nil {
+				t.Fatal(err)
+			}
+			if err != nil && len(entries) != 0 {
+				t.Errorf("a failed posting left %d journal entries behind", len(entries))
+			}
+			if err == nil {
+				if len(entries) != len(tt.postings) {
+					t.Errorf("got %d journal entries, want %d", len(entries), len(tt.postings))
+				}
+				sum := thb(0)
+				for _, entry := range entries {
+					sum = sum.Add(entry.Amount)
+				}
+				if !sum.IsZero() {
+					t.Errorf("journal entries add up to %s", sum)
+				}
+			}
+		})
+	}
+}
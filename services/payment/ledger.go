@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/zensos/microservice-project/internal/money"
+	"github.com/zensos/microservice-project/internal/pagination"
+	"gorm.io/gorm"
+)
+
+var ledgerSorts = pagination.Sorts{}.
+	Add("created_at", "created_at", pagination.KeyTime).
+	Add("amount", "amount_minor", pagination.KeyInt)
+
+func ledgerSortKey(sort string) func(Ledger) (any, uint) {
+	return func(l Ledger) (any, uint) {
+		if strings.TrimPrefix(sort, "-") == "amount" {
+			return l.Amount.Minor, l.ID
+		}
+		return l.CreatedAt, l.ID
+	}
+}
+
+type ledgerSummary struct {
+	Spent    money.Money `json:"total_spent"`
+	Refunded money.Money `json:"total_refunded"`
+	ToppedUp money.Money `json:"total_topped_up"`
+	Entries  int64       `json:"entries"`
+}
+
+func filterLedger(c fiber.Ctx, memberID string) (*gorm.DB, error) {
+	query := db.Model(&Ledger{}).Where("member_id = ?", memberID)
+
+	dates, err := pagination.ParseTimeRange(c)
+	if err != nil {
+		return nil, err
+	}
+	query = dates.Where(query, "created_at")
+
+	if raw := c.Query("type"); raw != "" {
+		types := strings.Split(raw, ",")
+		for _, t := range types {
+			switch LedgerType(t) {
+			case LedgerTopUp, LedgerPayment, LedgerRefund, LedgerTransferOut, LedgerTransferIn,
+				LedgerPaymentHold, LedgerPaymentCaptured, LedgerPaymentReleased,
+				LedgerWithdrawalHold, LedgerWithdrawalReleased, LedgerWithdrawalApproved, LedgerWithdrawalPaid,
+				LedgerOpeningBalance:
+			default:
+				return nil, errors.New("unknown ledger type: " + t)
+			}
+		}
+		query = query.Where("type IN ?", types)
+	}
+
+	// The same filters feed both the summary and the page.
+	return query.Session(&gorm.Session{}), nil
+}
+
+// summarizeLedger totals the filtered entries in the wallet currency.
+// Payments are stored as negative amounts, so spending is reported negated.
+// Holds count as spent from the moment they are placed, and released holds
+// give it back; capturing a hold doesn't change the balance.
+func summarizeLedger(query *gorm.DB, currency string) (ledgerSummary, error) {
+	var rows []struct {
+		Type  LedgerType
+		Total int64
+		Count int64
+	}
+	if err := query.Select("type, COALESCE(SUM(amount_minor), 0) AS total, COUNT(*) AS count").
+		Where("amount_currency = ?", currency).
+		Group("type").Scan(&rows).Error; err != nil {
+		return ledgerSummary{}, err
+	}
+
+	summary := ledgerSummary{
+		Spent:    money.Zero(currency),
+		Refunded: money.Zero(currency),
+		ToppedUp: money.Zero(currency),
+	}
+	var spent int64
+	for _, row := range rows {
+		summary.Entries += row.Count
+		switch row.Type {
+		case LedgerPayment, LedgerPaymentHold, LedgerPaymentReleased:
+			spent -= row.Total
+		case LedgerRefund:
+			summary.Refunded = money.New(row.Total, currency)
+		case LedgerTopUp:
+			summary.ToppedUp = money.New(row.Total, currency)
+		}
+	}
+	summary.Spent = money.New(spent, currency)
+	return summary, nil
+}
+
+func listLedger(c fiber.Ctx) error {
+	memberID := c.Params("member_id")
+
+	params, err := pagination.Parse(c, ledgerSorts, "-created_at")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	query, err := filterLedger(c, memberID)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	currency := money.DefaultCurrency
+	var wallet Wallet
+	if err := db.Where("member_id = ?", memberID).First(&wallet).Error; err == nil {
+		currency = wallet.Balance.Currency
+	}
+
+	summary, err := summarizeLedger(query, currency)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to summarize ledger"})
+	}
+
+	var ledgers []Ledger
+	if err := pagination.Apply(query, params).Find(&ledgers).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to load ledger"})
+	}
+	page := pagination.NewPage(ledgers, params, ledgerSortKey(params.Sort.Name))
+
+	return c.JSON(fiber.Map{
+		"member_id": memberID,
+		"data":      page.Data,
+		"page":      page.Page,
+		"summary":   summary,
+	})
+}
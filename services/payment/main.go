@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -9,9 +10,14 @@ import (
 	"time"
 
 	"github.com/gofiber/fiber/v3"
+	"github.com/gofiber/fiber/v3/middleware/recover"
+	"github.com/zensos/microservice-project/internal/auth"
 	"github.com/zensos/microservice-project/internal/common"
 	"github.com/zensos/microservice-project/internal/database"
+	"github.com/zensos/microservice-project/internal/events"
 	"github.com/zensos/microservice-project/internal/middleware"
+	"github.com/zensos/microservice-project/internal/money"
+	"github.com/zensos/microservice-project/internal/rabbitmq"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
@@ -20,9 +26,51 @@ var db *gorm.DB
 
 func main() {
 	db = database.Connect()
-	db.AutoMigrate(&Wallet{}, &Ledger{}, &Payment{})
+	db.AutoMigrate(&Wallet{}, &Ledger{}, &Payment{}, &Refund{}, &Withdrawal{}, &TopUpIntent{}, &WebhookEvent{}, &Account{}, &JournalTransaction{}, &JournalEntry{}, &rabbitmq.OutboxMessage{}, &middleware.IdempotencyRecord{})
+	for _, col := range []struct{ table, column string }{
+		{"wallets", "balance"},
+		{"ledgers", "amount"},
+		{"ledgers", "balance_after"},
+		{"payments", "amount"},
+	} {
+		if err := money.MigrateFloatColumn(db, col.table, col.column, money.DefaultCurrency); err != nil {
+			log.Fatalf("couldn't migrate %s.%s: %v", col.table, col.column, err)
+		}
+	}
+	// Payments refunded before partial refunds existed were refunded in full.
+	db.Model(&Payment{}).Where("status = ? AND refunded_amount_minor = 0", PaymentRefunded).
+		Updates(map[string]any{
+			"refunded_amount_minor":    gorm.Expr("amount_minor"),
+			"refunded_amount_currency": gorm.Expr("amount_currency"),
+		})
+	db.Model(&Payment{}).Where("refunded_amount_currency <> amount_currency").
+		Update("refunded_amount_currency", gorm.Expr("amount_currency"))
+	db.Model(&Wallet{}).Where("held_minor = 0 AND held_currency <> balance_currency").
+		Update("held_currency", gorm.Expr("balance_currency"))
+	if err := seedAccounts(db); err != nil {
+		log.Fatalf("couldn't create platform accounts: %v", err)
+	}
+	if err := backfillOpeningBalances(db); err != nil {
+		log.Fatalf("couldn't record opening balances: %v", err)
+	}
+	mqConn := rabbitmq.Connect()
+	defer mqConn.Close()
+	rabbitmq.StartRelay(db, mqConn, rabbitmq.RelayConfig{})
+
+	if err := setupGateways(); err != nil {
+		log.Fatal(err)
+	}
+	if _, ok := gatewaysByMethod[TopUpPromptpay]; ok {
+		if err := checkPromptPayID(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	go expireTopUps(time.Minute)
+	go retryWebhooks(time.Minute)
+	go expirePaymentHolds(time.Minute)
 
 	app := fiber.New()
+	app.Use(recover.New())
 
 	app.Use(middleware.RateLimiter(middleware.RateLimiterConfig{
 		Max:        100,
@@ -37,7 +85,18 @@ func main() {
 		return c.JSON(fiber.Map{"status": "ok", "service": "payment"})
 	})
 
-	app.Get("/wallets/:member_id", func(c fiber.Ctx) error {
+	consulClient, serviceID, err := common.RegisterService(common.ServiceConfig{
+		Name: "payment",
+		Port: 3004,
+	})
+	if err != nil {
+		log.Printf("couldn't register with consul: %v", err)
+	}
+
+	authn := middleware.Authenticate(auth.NewVerifier(auth.MemberJWKS(consulClient)))
+	idempotent := middleware.Idempotency(middleware.IdempotencyConfig{DB: db})
+
+	app.Get("/wallets/:member_id", authn, middleware.BindParam("member_id", auth.PermWalletsReadAny), func(c fiber.Ctx) error {
 		memberID := c.Params("member_id")
 
 		var wallet Wallet
@@ -48,69 +107,26 @@ func main() {
 		return c.JSON(wallet)
 	})
 
-	app.Post("/wallets/top-up", func(c fiber.Ctx) error {
-		var req TopUpRequest
-		if err := c.Bind().JSON(&req); err != nil {
-			return c.Status(400).JSON(fiber.Map{"error": "invalid request body"})
-		}
-
-		if req.MemberID == "" {
-			return c.Status(400).JSON(fiber.Map{"error": "member_id is required"})
-		}
-		if req.Amount <= 0 {
-			return c.Status(400).JSON(fiber.Map{"error": "amount must be greater than 0"})
-		}
-
-		switch req.Method {
-		case TopUpPromptpay, TopUpBanking, TopUpTrueWallet:
-		default:
-			return c.Status(400).JSON(fiber.Map{"error": "method must be one of: promptpay, banking, truewallet"})
-		}
-
-		var wallet Wallet
-		var ledger Ledger
-
-		txErr := db.Transaction(func(tx *gorm.DB) error {
-			result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
-				Where("member_id = ?", req.MemberID).First(&wallet)
-
-			if result.Error != nil {
-				wallet = Wallet{
-					MemberID: req.MemberID,
-					Balance:  0,
-				}
-				if err := tx.Create(&wallet).Error; err != nil {
-					return err
-				}
-			}
-
-			wallet.Balance += req.Amount
-			if err := tx.Save(&wallet).Error; err != nil {
-				return err
-			}
-
-			ledger = Ledger{
-				MemberID:     req.MemberID,
-				Type:         LedgerTopUp,
-				Method:       req.Method,
-				Amount:       req.Amount,
-				BalanceAfter: wallet.Balance,
-				ReferenceID:  fmt.Sprintf("topup_%d", time.Now().UnixNano()),
-			}
-			return tx.Create(&ledger).Error
-		})
+	app.Post("/wallets/top-up", authn, middleware.Authorize(auth.PermWalletsTopUp), middleware.BindBody("member_id"), idempotent, createTopUp)
+	app.Get("/wallets/top-up/:intent_id", authn, getTopUp)
+	app.Get("/wallets/top-up/:intent_id/qr", authn, getTopUpQR)
+	app.Post("/webhooks/:provider", receiveWebhook)
+	app.Get("/admin/webhooks", authn, middleware.Authorize(auth.PermWebhooksReplay), listWebhooks)
+	app.Post("/admin/webhooks/:id/replay", authn, middleware.Authorize(auth.PermWebhooksReplay), replayWebhookHandler)
+	if _, ok := gatewaysByProvider["mock"]; ok {
+		registerMockGateway(app)
+	}
 
-		if txErr != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "failed to top up"})
-		}
+	app.Post("/wallets/transfer", authn, middleware.Authorize(auth.PermWalletsTransfer), middleware.BindBody("member_id"), idempotent, transfer)
 
-		return c.Status(201).JSON(fiber.Map{
-			"wallet": wallet,
-			"ledger": ledger,
-		})
-	})
+	app.Post("/wallets/withdrawals", authn, middleware.Authorize(auth.PermWalletsWithdraw), middleware.BindBody("member_id"), idempotent, requestWithdrawal)
+	app.Get("/wallets/:member_id/withdrawals", authn, middleware.BindParam("member_id", auth.PermWalletsReadAny), listMemberWithdrawals)
+	app.Get("/admin/withdrawals", authn, middleware.Authorize(auth.PermWithdrawalsApprove), listAllWithdrawals)
+	app.Post("/admin/withdrawals/:withdrawal_id/approve", authn, middleware.Authorize(auth.PermWithdrawalsApprove), approveWithdrawal)
+	app.Post("/admin/withdrawals/:withdrawal_id/reject", authn, middleware.Authorize(auth.PermWithdrawalsApprove), rejectWithdrawal)
+	app.Post("/admin/withdrawals/:withdrawal_id/paid", authn, middleware.Authorize(auth.PermWithdrawalsApprove), markWithdrawalPaid)
 
-	app.Post("/payments", func(c fiber.Ctx) error {
+	app.Post("/payments", authn, middleware.Authorize(auth.PermPaymentsCreate), middleware.BindBody("member_id", auth.PermPaymentsActAny), idempotent, func(c fiber.Ctx) error {
 		var req PayBookingRequest
 		if err := c.Bind().JSON(&req); err != nil {
 			return c.Status(400).JSON(fiber.Map{"error": "invalid request body"})
@@ -122,7 +138,7 @@ func main() {
 		if req.BookingID == "" {
 			return c.Status(400).JSON(fiber.Map{"error": "booking_id is required"})
 		}
-		if req.Amount <= 0 {
+		if !req.Amount.IsPositive() {
 			return c.Status(400).JSON(fiber.Map{"error": "amount must be greater than 0"})
 		}
 
@@ -131,7 +147,7 @@ func main() {
 
 		txErr := db.Transaction(func(tx *gorm.DB) error {
 			var existingPayment Payment
-			if err := tx.Where("booking_id = ? AND status = ?", req.BookingID, "confirmed").First(&existingPayment).Error; err == nil {
+			if err := tx.Where("booking_id = ? AND status IN ?", req.BookingID, []string{PaymentAuthorized, PaymentConfirmed, PaymentPartiallyRefunded}).First(&existingPayment).Error; err == nil {
 				return fmt.Errorf("booking already paid")
 			}
 
@@ -141,23 +157,32 @@ func main() {
 				return fmt.Errorf("wallet not found")
 			}
 
-			if wallet.Balance < req.Amount {
+			if !wallet.Balance.SameCurrency(req.Amount) {
+				return money.ErrCurrencyMismatch
+			}
+			if wallet.Balance.Cmp(req.Amount) < 0 {
 				return fmt.Errorf("insufficient balance")
 			}
+			before := wallet.Balance
 
-			wallet.Balance -= req.Amount
-			if err := tx.Save(&wallet).Error; err != nil {
+			paymentID := fmt.Sprintf("pay_%d", time.Now().UnixNano())
+			if _, err := postJournal(tx, LedgerPayment, paymentID,
+				debit(walletAccount(req.MemberID), req.Amount),
+				credit(RevenueAccount, req.Amount),
+			); err != nil {
+				return err
+			}
+			if err := tx.First(&wallet, wallet.ID).Error; err != nil {
 				return err
 			}
-
-			paymentID := fmt.Sprintf("pay_%d", time.Now().UnixNano())
 
 			payment = Payment{
-				PaymentID: paymentID,
-				BookingID: req.BookingID,
-				MemberID:  req.MemberID,
-				Amount:    req.Amount,
-				Status:    "confirmed",
+				PaymentID:      paymentID,
+				BookingID:      req.BookingID,
+				MemberID:       req.MemberID,
+				Amount:         req.Amount,
+				RefundedAmount: money.Zero(req.Amount.Currency),
+				Status:         PaymentConfirmed,
 			}
 			if err := tx.Create(&payment).Error; err != nil {
 				return err
@@ -166,13 +191,23 @@ func main() {
 			ledger = Ledger{
 				MemberID:     req.MemberID,
 				Type:         LedgerPayment,
-				Amount:       -req.Amount,
+				Amount:       req.Amount.Neg(),
 				BalanceAfter: wallet.Balance,
 				ReferenceID:  paymentID,
 			}
-			return tx.Create(&ledger).Error
+			if err := tx.Create(&ledger).Error; err != nil {
+				return err
+			}
+
+			if err := publishPaymentConfirmed(tx, payment, req.MemberEmail); err != nil {
+				return err
+			}
+			return checkLowBalance(tx, req.MemberID, req.MemberEmail, before)
 		})
 
+		if errors.Is(txErr, money.ErrCurrencyMismatch) {
+			return c.Status(400).JSON(fiber.Map{"error": "amount currency does not match the wallet currency"})
+		}
 		if txErr != nil {
 			msg := txErr.Error()
 			if msg == "booking already paid" {
@@ -193,27 +228,25 @@ func main() {
 		})
 	})
 
-	app.Get("/payments/:id", func(c fiber.Ctx) error {
+	app.Post("/payments/authorize", authn, middleware.Authorize(auth.PermPaymentsCreate), middleware.BindBody("member_id", auth.PermPaymentsActAny), idempotent, authorizePayment)
+	app.Post("/payments/capture", authn, middleware.Authorize(auth.PermPaymentsCreate), middleware.BindBody("member_id", auth.PermPaymentsActAny), idempotent, capturePayment)
+	app.Post("/payments/void", authn, middleware.Authorize(auth.PermPaymentsCreate), middleware.BindBody("member_id", auth.PermPaymentsActAny), idempotent, voidPayment)
+
+	app.Get("/payments/:id", authn, func(c fiber.Ctx) error {
 		var payment Payment
 		if err := db.Where("payment_id = ?", c.Params("id")).First(&payment).Error; err != nil {
 			return c.Status(404).JSON(fiber.Map{"error": "payment not found"})
 		}
+		if payment.MemberID != middleware.Subject(c) && !middleware.Can(c, auth.PermPaymentsReadAny) {
+			return c.Status(403).JSON(fiber.Map{"error": "payment does not belong to the authenticated member"})
+		}
 		return c.JSON(payment)
 	})
 
-	app.Get("/wallets/:member_id/ledger", func(c fiber.Ctx) error {
-		memberID := c.Params("member_id")
-
-		var ledgers []Ledger
-		db.Where("member_id = ?", memberID).Order("created_at desc").Find(&ledgers)
+	app.Get("/wallets/:member_id/ledger", authn, middleware.BindParam("member_id", auth.PermWalletsReadAny), listLedger)
+	app.Get("/wallets/:member_id/statement", authn, middleware.BindParam("member_id", auth.PermWalletsReadAny), getStatement)
 
-		return c.JSON(fiber.Map{
-			"member_id": memberID,
-			"ledger":    ledgers,
-		})
-	})
-
-	app.Post("/payments/refund", func(c fiber.Ctx) error {
+	app.Post("/payments/refund", authn, middleware.Authorize(auth.PermPaymentsRefund), middleware.BindBody("member_id", auth.PermPaymentsActAny), idempotent, func(c fiber.Ctx) error {
 		var req RefundRequest
 		if err := c.Bind().JSON(&req); err != nil {
 			return c.Status(400).JSON(fiber.Map{"error": "invalid request body"})
@@ -225,20 +258,40 @@ func main() {
 		if req.BookingID == "" {
 			return c.Status(400).JSON(fiber.Map{"error": "booking_id is required"})
 		}
-		if req.Amount <= 0 {
+		if !req.Amount.IsPositive() {
 			return c.Status(400).JSON(fiber.Map{"error": "amount must be greater than 0"})
 		}
 
+		var payment Payment
+		var refund Refund
 		var ledger Ledger
 
 		txErr := db.Transaction(func(tx *gorm.DB) error {
-			var payment Payment
-			if err := tx.Where("booking_id = ? AND status = ?", req.BookingID, "confirmed").First(&payment).Error; err != nil {
+			query := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("booking_id = ?", req.BookingID)
+			if req.PaymentID != "" {
+				query = query.Where("payment_id = ?", req.PaymentID)
+			}
+			if err := query.Where("status IN ?", []string{PaymentConfirmed, PaymentPartiallyRefunded}).
+				Order("created_at desc").First(&payment).Error; err != nil {
+				return fmt.Errorf("payment not found")
+			}
+			if payment.MemberID != req.MemberID {
 				return fmt.Errorf("payment not found")
 			}
 
-			payment.Status = "refunded"
-			if err := tx.Save(&payment).Error; err != nil {
+			if !payment.Amount.SameCurrency(req.Amount) {
+				return money.ErrCurrencyMismatch
+			}
+			if req.Amount.Cmp(payment.Refundable()) > 0 {
+				return fmt.Errorf("refund exceeds payment")
+			}
+
+			payment.RefundedAmount = payment.RefundedAmount.Add(req.Amount)
+			payment.Status = PaymentPartiallyRefunded
+			if payment.Refundable().IsZero() {
+				payment.Status = PaymentRefunded
+			}
+			if err := tx.Omit("Refunds").Save(&payment).Error; err != nil {
 				return err
 			}
 
@@ -248,8 +301,32 @@ func main() {
 				return fmt.Errorf("wallet not found")
 			}
 
-			wallet.Balance += req.Amount
-			if err := tx.Save(&wallet).Error; err != nil {
+			if !wallet.Balance.SameCurrency(req.Amount) {
+				return money.ErrCurrencyMismatch
+			}
+
+			refund = Refund{
+				RefundID:  fmt.Sprintf("ref_%d", time.Now().UnixNano()),
+				PaymentID: payment.PaymentID,
+				BookingID: payment.BookingID,
+				MemberID:  payment.MemberID,
+				Amount:    req.Amount,
+				Reason:    req.Reason,
+				Status:    RefundCompleted,
+			}
+			if err := tx.Create(&refund).Error; err != nil {
+				return err
+			}
+
+			if _, err := postJournal(tx, LedgerRefund, refund.RefundID,
+				debit(RevenueAccount, req.Amount),
+				credit(RefundClearingAccount, req.Amount),
+				debit(RefundClearingAccount, req.Amount),
+				credit(walletAccount(req.MemberID), req.Amount),
+			); err != nil {
+				return err
+			}
+			if err := tx.First(&wallet, wallet.ID).Error; err != nil {
 				return err
 			}
 
@@ -258,15 +335,36 @@ func main() {
 				Type:         LedgerRefund,
 				Amount:       req.Amount,
 				BalanceAfter: wallet.Balance,
-				ReferenceID:  payment.PaymentID,
+				ReferenceID:  refund.RefundID,
 			}
-			return tx.Create(&ledger).Error
+			if err := tx.Create(&ledger).Error; err != nil {
+				return err
+			}
+
+			return publish(tx, events.TypePaymentRefunded, events.PaymentRefunded{
+				RefundID:      refund.RefundID,
+				PaymentID:     payment.PaymentID,
+				BookingID:     payment.BookingID,
+				MemberID:      payment.MemberID,
+				MemberEmail:   req.MemberEmail,
+				Amount:        refund.Amount,
+				TotalRefunded: payment.RefundedAmount,
+				FullyRefunded: payment.Status == PaymentRefunded,
+				Reason:        refund.Reason,
+				BalanceAfter:  wallet.Balance,
+			})
 		})
 
+		if errors.Is(txErr, money.ErrCurrencyMismatch) {
+			return c.Status(400).JSON(fiber.Map{"error": "amount currency does not match the payment currency"})
+		}
 		if txErr != nil {
 			msg := txErr.Error()
 			if msg == "payment not found" {
-				return c.Status(404).JSON(fiber.Map{"error": "no confirmed payment found for this booking"})
+				return c.Status(404).JSON(fiber.Map{"error": "no refundable payment found for this booking"})
+			}
+			if msg == "refund exceeds payment" {
+				return c.Status(422).JSON(fiber.Map{"error": "amount exceeds what is left to refund on this payment"})
 			}
 			if msg == "wallet not found" {
 				return c.Status(404).JSON(fiber.Map{"error": "wallet not found"})
@@ -276,17 +374,34 @@ func main() {
 
 		return c.JSON(fiber.Map{
 			"message": "refund processed",
+			"refund":  refund,
+			"payment": payment,
 			"ledger":  ledger,
 		})
 	})
 
-	consulClient, serviceID, err := common.RegisterService(common.ServiceConfig{
-		Name: "payment",
-		Port: 3004,
+	app.Get("/payments/:id/refunds", authn, func(c fiber.Ctx) error {
+		var payment Payment
+		if err := db.Preload("Refunds", func(tx *gorm.DB) *gorm.DB {
+			return tx.Order("created_at")
+		}).Where("payment_id = ?", c.Params("id")).First(&payment).Error; err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "payment not found"})
+		}
+		if payment.MemberID != middleware.Subject(c) && !middleware.Can(c, auth.PermPaymentsReadAny) {
+			return c.Status(403).JSON(fiber.Map{"error": "payment does not belong to the authenticated member"})
+		}
+
+		return c.JSON(fiber.Map{
+			"payment_id": payment.PaymentID,
+			"amount":     payment.Amount,
+			"refunded":   payment.RefundedAmount,
+			"refundable": payment.Refundable(),
+			"status":     payment.Status,
+			"refunds":    payment.Refunds,
+		})
 	})
-	if err != nil {
-		log.Printf("couldn't register with consul: %v", err)
-	}
+
+	app.Get("/admin/reconcile", authn, middleware.Authorize(auth.PermLedgerReconcile), reconcile)
 
 	go func() {
 		quit := make(chan os.Signal, 1)
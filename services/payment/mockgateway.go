@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/zensos/microservice-project/internal/money"
+)
+
+const mockIntentTTL = 15 * time.Minute
+
+// mockProvider stands in for the real providers when running locally. It
+// keeps intents in memory; /mock-gateway/:reference/complete and /fail play
+// the member paying or giving up and send the webhook a real provider would.
+type mockProvider struct {
+	mu      sync.Mutex
+	intents map[string]*mockIntent
+}
+
+type mockIntent struct {
+	Reference string         `json:"reference"`
+	Method    TopUpMethod    `json:"method"`
+	Amount    money.Money    `json:"amount"`
+	Status    ProviderStatus `json:"status"`
+	ExpiresAt time.Time      `json:"expires_at"`
+}
+
+type mockWebhook struct {
+	EventID   string         `json:"event_id"`
+	Reference string         `json:"reference"`
+	Status    ProviderStatus `json:"status"`
+	Amount    money.Money    `json:"amount"`
+}
+
+var mock = &mockProvider{intents: map[string]*mockIntent{}}
+
+// mockGateway is the mock provider as seen by one top-up method.
+type mockGateway struct {
+	method TopUpMethod
+}
+
+func mockGatewayFor(method TopUpMethod) Gateway {
+	return mockGateway{method: method}
+}
+
+func (g mockGateway) Name() string {
+	return "mock"
+}
+
+func (g mockGateway) CreateIntent(intent TopUpIntent) (ProviderIntent, error) {
+	reference := fmt.Sprintf("mock_%d", time.Now().UnixNano())
+	expiresAt := time.Now().Add(mockIntentTTL)
+
+	mock.mu.Lock()
+	mock.intents[reference] = &mockIntent{
+		Reference: reference,
+		Method:    g.method,
+		Amount:    intent.Amount,
+		Status:    ProviderPending,
+		ExpiresAt: expiresAt,
+	}
+	mock.mu.Unlock()
+
+	payURL := "/mock-gateway/" + reference
+	instructions := map[string]string{"pay_url": payURL}
+	switch g.method {
+	case TopUpPromptpay:
+		payload, err := promptPayPayload(promptPayID(), intent.Amount, intent.IntentID)
+		if err != nil {
+			return ProviderIntent{}, err
+		}
+		instructions["qr_payload"] = payload
+	case TopUpBanking:
+		instructions["redirect_url"] = payURL
+	case TopUpTrueWallet:
+		instructions["deeplink"] = "truemoney://mock/pay?ref=" + reference
+	}
+
+	return ProviderIntent{Reference: reference, Instructions: instructions, ExpiresAt: expiresAt}, nil
+}
+
+func (g mockGateway) FetchStatus(reference string) (ProviderResult, error) {
+	mock.mu.Lock()
+	defer mock.mu.Unlock()
+
+	intent, ok := mock.intents[reference]
+	if !ok {
+		return ProviderResult{}, ErrUnknownIntent
+	}
+	if intent.Status == ProviderPending && time.Now().After(intent.ExpiresAt) {
+		intent.Status = ProviderExpired
+	}
+	return ProviderResult{Reference: reference, Status: intent.Status, Amount: intent.Amount}, nil
+}
+
+func (g mockGateway) VerifyWebhook(header http.Header, body []byte, maxAge time.Duration) (ProviderResult, error) {
+	if err := verifyWebhookSignature(mockGatewaySecret(), header.Get("X-Mock-Signature"), body, maxAge); err != nil {
+		return ProviderResult{}, err
+	}
+
+	var event mockWebhook
+	if err := json.Unmarshal(body, &event); err != nil {
+		return ProviderResult{}, err
+	}
+	return ProviderResult{
+		EventID:   event.EventID,
+		Reference: event.Reference,
+		Status:    event.Status,
+		Amount:    event.Amount,
+	}, nil
+}
+
+// checkMockGateway refuses the mock unless MOCK_GATEWAY_ENABLED is true and
+// APP_ENV isn't production: anyone can complete a mock intent, which
+// credits the wallet for free.
+func checkMockGateway() error {
+	if os.Getenv("MOCK_GATEWAY_ENABLED") != "true" {
+		return errors.New("the mock top-up gateway is disabled, set MOCK_GATEWAY_ENABLED=true to use it")
+	}
+	if os.Getenv("APP_ENV") == "production" {
+		return errors.New("the mock top-up gateway can't be used in production")
+	}
+	if mockGatewaySecret() == "" {
+		return errors.New("MOCK_GATEWAY_SECRET is required by the mock top-up gateway")
+	}
+	return nil
+}
+
+func mockGatewaySecret() string {
+	return os.Getenv("MOCK_GATEWAY_SECRET")
+}
+
+func mockWebhookURL() string {
+	if url := os.Getenv("MOCK_GATEWAY_WEBHOOK_URL"); url != "" {
+		return url
+	}
+	return "http://localhost:3004/webhooks/mock"
+}
+
+func (p *mockProvider) settle(reference string, status ProviderStatus) (*mockIntent, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	intent, ok := p.intents[reference]
+	if !ok {
+		return nil, ErrUnknownIntent
+	}
+	if intent.Status != ProviderPending {
+		return nil, fmt.Errorf("intent is already %s", intent.Status)
+	}
+	if time.Now().After(intent.ExpiresAt) {
+		intent.Status = ProviderExpired
+		return nil, fmt.Errorf("intent is already %s", intent.Status)
+	}
+	intent.Status = status
+	copied := *intent
+	return &copied, nil
+}
+
+func (p *mockProvider) sendWebhook(intent mockIntent) {
+	body, _ := json.Marshal(mockWebhook{
+		EventID:   fmt.Sprintf("evt_%d", time.Now().UnixNano()),
+		Reference: intent.Reference,
+		Status:    intent.Status,
+		Amount:    intent.Amount,
+	})
+
+	req, _ := http.NewRequest("POST", mockWebhookURL(), bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Mock-Signature", signWebhook(mockGatewaySecret(), body, time.Now()))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("mock gateway couldn't deliver webhook for %s: %v", intent.Reference, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("mock gateway webhook for %s got status %d", intent.Reference, resp.StatusCode)
+	}
+}
+
+func registerMockGateway(app *fiber.App) {
+	app.Get("/mock-gateway/:reference", func(c fiber.Ctx) error {
+		mock.mu.Lock()
+		intent, ok := mock.intents[c.Params("reference")]
+		var copied mockIntent
+		if ok {
+			copied = *intent
+		}
+		mock.mu.Unlock()
+
+		if !ok {
+			return c.Status(404).JSON(fiber.Map{"error": ErrUnknownIntent.Error()})
+		}
+		return c.JSON(copied)
+	})
+
+	settle := func(status ProviderStatus) fiber.Handler {
+		return func(c fiber.Ctx) error {
+			intent, err := mock.settle(c.Params("reference"), status)
+			if errors.Is(err, ErrUnknownIntent) {
+				return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+			}
+			if err != nil {
+				return c.Status(409).JSON(fiber.Map{"error": err.Error()})
+			}
+
+			go mock.sendWebhook(*intent)
+			return c.JSON(intent)
+		}
+	}
+	app.Post("/mock-gateway/:reference/complete", settle(ProviderSucceeded))
+	app.Post("/mock-gateway/:reference/fail", settle(ProviderFailed))
+}
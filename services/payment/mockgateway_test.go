@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMockGatewayVerifyWebhook(t *testing.T) {
+	t.Setenv("MOCK_GATEWAY_SECRET", "secret")
+	body := []byte(`{"event_id":"evt_1","reference":"mock_1","status":"succeeded","amount":{"amount":"100.00","currency":"THB"}}`)
+
+	header := http.Header{}
+	header.Set("X-Mock-Signature", signWebhook("secret", body, time.Now()))
+	result, err := mockGateway{}.VerifyWebhook(header, body, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.EventID != "evt_1" || result.Reference != "mock_1" || result.Status != ProviderSucceeded || result.Amount.Minor != 10000 {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	header.Set("X-Mock-Signature", signWebhook("guessed", body, time.Now()))
+	if _, err := (mockGateway{}).VerifyWebhook(header, body, time.Minute); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("got %v, want ErrInvalidSignature", err)
+	}
+}
+
+func TestCheckMockGateway(t *testing.T) {
+	tests := []struct {
+		name                 string
+		enabled, env, secret string
+		ok                   bool
+	}{
+		{"enabled", "true", "", "secret", true},
+		{"not enabled", "", "", "secret", false},
+		{"production", "true", "production", "secret", false},
+		{"no secret", "true", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MOCK_GATEWAY_ENABLED", tt.enabled)
+			t.Setenv("APP_ENV", tt.env)
+			t.Setenv("MOCK_GATEWAY_SECRET", tt.secret)
+			if err := checkMockGateway(); (err == nil) != tt.ok {
+				t.Errorf("checkMockGateway() = %v", err)
+			}
+		})
+	}
+}
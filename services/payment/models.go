@@ -3,13 +3,15 @@ package main
 import (
 	"time"
 
+	"github.com/zensos/microservice-project/internal/money"
 	"gorm.io/gorm"
 )
 
 type Wallet struct {
 	ID        uint           `json:"id" gorm:"primaryKey"`
 	MemberID  string         `json:"member_id" gorm:"uniqueIndex"`
-	Balance   float64        `json:"balance"`
+	Balance   money.Money    `json:"balance" gorm:"embedded;embeddedPrefix:balance_"`
+	Held      money.Money    `json:"held" gorm:"embedded;embeddedPrefix:held_"`
 	CreatedAt time.Time      `json:"created_at"`
 	UpdatedAt time.Time      `json:"updated_at"`
 	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
@@ -21,6 +23,20 @@ const (
 	LedgerTopUp   LedgerType = "top_up"
 	LedgerPayment LedgerType = "payment"
 	LedgerRefund  LedgerType = "refund"
+
+	LedgerTransferOut LedgerType = "transfer_out"
+	LedgerTransferIn  LedgerType = "transfer_in"
+
+	LedgerPaymentHold     LedgerType = "payment_hold"
+	LedgerPaymentCaptured LedgerType = "payment_captured"
+	LedgerPaymentReleased LedgerType = "payment_released"
+
+	LedgerWithdrawalHold     LedgerType = "withdrawal_hold"
+	LedgerWithdrawalReleased LedgerType = "withdrawal_released"
+	LedgerWithdrawalApproved LedgerType = "withdrawal_approved"
+	LedgerWithdrawalPaid     LedgerType = "withdrawal_paid"
+
+	LedgerOpeningBalance LedgerType = "opening_balance"
 )
 
 type TopUpMethod string
@@ -31,44 +47,224 @@ const (
 	TopUpTrueWallet  TopUpMethod = "truewallet"
 )
 
+const (
+	IntentPending   = "pending"
+	IntentSucceeded = "succeeded"
+	IntentFailed    = "failed"
+	IntentExpired   = "expired"
+)
+
+// TopUpIntent is a top-up waiting for its provider. The wallet is only
+// credited once the provider confirms the payment.
+type TopUpIntent struct {
+	ID            uint              `json:"-" gorm:"primaryKey"`
+	IntentID      string            `json:"intent_id" gorm:"uniqueIndex"`
+	MemberID      string            `json:"member_id" gorm:"index"`
+	MemberEmail   string            `json:"-"`
+	Method        TopUpMethod       `json:"method"`
+	Amount        money.Money       `json:"amount" gorm:"embedded;embeddedPrefix:amount_"`
+	Provider      string            `json:"provider" gorm:"index:idx_top_up_provider_ref"`
+	ProviderRef   string            `json:"provider_reference" gorm:"index:idx_top_up_provider_ref"`
+	Instructions  map[string]string `json:"instructions,omitempty" gorm:"serializer:json"`
+	Status        string            `json:"status" gorm:"index"`
+	FailureReason string            `json:"failure_reason,omitempty"`
+	ExpiresAt     time.Time         `json:"expires_at"`
+	CreditedAt    *time.Time        `json:"credited_at,omitempty"`
+	CreatedAt     time.Time         `json:"created_at"`
+	UpdatedAt     time.Time         `json:"updated_at"`
+}
+
+// WebhookEvent is a provider callback as it was received, kept so it can be
+// replayed.
+type WebhookEvent struct {
+	ID          uint              `json:"id" gorm:"primaryKey"`
+	Provider    string            `json:"provider" gorm:"uniqueIndex:idx_webhook_provider_event"`
+	EventID     string            `json:"event_id" gorm:"uniqueIndex:idx_webhook_provider_event"`
+	Reference   string            `json:"reference" gorm:"index"`
+	Headers     map[string]string `json:"headers" gorm:"serializer:json"`
+	Payload     string            `json:"payload"`
+	Status      string            `json:"status" gorm:"index"`
+	Error       string            `json:"error,omitempty"`
+	Attempts    int               `json:"attempts"`
+	ProcessedAt *time.Time        `json:"processed_at,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
 type Ledger struct {
 	ID           uint           `json:"id" gorm:"primaryKey"`
 	MemberID     string         `json:"member_id" gorm:"index"`
 	Type         LedgerType     `json:"type"`
 	Method       TopUpMethod    `json:"method,omitempty"`
-	Amount       float64        `json:"amount"`
-	BalanceAfter float64        `json:"balance_after"`
+	Amount       money.Money    `json:"amount" gorm:"embedded;embeddedPrefix:amount_"`
+	BalanceAfter money.Money    `json:"balance_after" gorm:"embedded;embeddedPrefix:balance_after_"`
 	ReferenceID  string         `json:"reference_id"`
+	Counterparty string         `json:"counterparty_id,omitempty"`
 	CreatedAt    time.Time      `json:"created_at"`
 	DeletedAt    gorm.DeletedAt `json:"-" gorm:"index"`
 }
 
+type AccountKind string
+
+const (
+	AccountWallet         AccountKind = "wallet"
+	AccountRevenue        AccountKind = "revenue"
+	AccountRefundClearing AccountKind = "refund_clearing"
+	AccountFunding        AccountKind = "funding"
+	AccountWalletHeld     AccountKind = "wallet_held"
+	AccountPayoutClearing AccountKind = "payout_clearing"
+)
+
+type Account struct {
+	ID        uint        `json:"id" gorm:"primaryKey"`
+	Code      string      `json:"code" gorm:"uniqueIndex"`
+	Kind      AccountKind `json:"kind" gorm:"index"`
+	MemberID  string      `json:"member_id,omitempty" gorm:"index"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+type JournalTransaction struct {
+	ID            uint           `json:"-" gorm:"primaryKey"`
+	TransactionID string         `json:"transaction_id" gorm:"uniqueIndex"`
+	Type          LedgerType     `json:"type" gorm:"index"`
+	ReferenceID   string         `json:"reference_id" gorm:"index"`
+	Entries       []JournalEntry `json:"entries" gorm:"foreignKey:TransactionID;references:TransactionID"`
+	CreatedAt     time.Time      `json:"created_at"`
+}
+
+// JournalEntry amounts are signed: positive credits the account, negative
+// debits it. The entries of one transaction always sum to zero.
+type JournalEntry struct {
+	ID            uint        `json:"-" gorm:"primaryKey"`
+	TransactionID string      `json:"transaction_id" gorm:"index"`
+	AccountCode   string      `json:"account" gorm:"index"`
+	Amount        money.Money `json:"amount" gorm:"embedded;embeddedPrefix:amount_"`
+	CreatedAt     time.Time   `json:"created_at"`
+}
+
+const (
+	PaymentConfirmed         = "confirmed"
+	PaymentPartiallyRefunded = "partially_refunded"
+	PaymentRefunded          = "refunded"
+
+	// An authorized payment only holds the amount in the wallet until it is
+	// captured, voided or its hold expires.
+	PaymentAuthorized = "authorized"
+	PaymentVoided     = "voided"
+	PaymentExpired    = "expired"
+
+	RefundCompleted = "completed"
+)
+
 type Payment struct {
-	ID        uint           `json:"id" gorm:"primaryKey"`
-	PaymentID string         `json:"payment_id" gorm:"uniqueIndex"`
-	BookingID string         `json:"booking_id" gorm:"index"`
-	MemberID  string         `json:"member_id" gorm:"index"`
-	Amount    float64        `json:"amount"`
-	Status    string         `json:"status"`
-	CreatedAt time.Time      `json:"created_at"`
-	UpdatedAt time.Time      `json:"updated_at"`
-	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
+	ID             uint           `json:"id" gorm:"primaryKey"`
+	PaymentID      string         `json:"payment_id" gorm:"uniqueIndex"`
+	BookingID      string         `json:"booking_id" gorm:"index"`
+	MemberID       string         `json:"member_id" gorm:"index"`
+	Amount         money.Money    `json:"amount" gorm:"embedded;embeddedPrefix:amount_"`
+	RefundedAmount money.Money    `json:"refunded_amount" gorm:"embedded;embeddedPrefix:refunded_amount_"`
+	Status         string         `json:"status"`
+	HoldExpiresAt  *time.Time     `json:"hold_expires_at,omitempty" gorm:"index"`
+	CapturedAt     *time.Time     `json:"captured_at,omitempty"`
+	Refunds        []Refund       `json:"refunds,omitempty" gorm:"foreignKey:PaymentID;references:PaymentID"`
+	CreatedAt      time.Time      `json:"created_at"`
+	UpdatedAt      time.Time      `json:"updated_at"`
+	DeletedAt      gorm.DeletedAt `json:"-" gorm:"index"`
+}
+
+func (p Payment) Refundable() money.Money {
+	return p.Amount.Sub(p.RefundedAmount)
+}
+
+type Refund struct {
+	ID        uint        `json:"-" gorm:"primaryKey"`
+	RefundID  string      `json:"refund_id" gorm:"uniqueIndex"`
+	PaymentID string      `json:"payment_id" gorm:"index"`
+	BookingID string      `json:"booking_id" gorm:"index"`
+	MemberID  string      `json:"member_id" gorm:"index"`
+	Amount    money.Money `json:"amount" gorm:"embedded;embeddedPrefix:amount_"`
+	Reason    string      `json:"reason,omitempty"`
+	Status    string      `json:"status" gorm:"index"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
 }
 
 type TopUpRequest struct {
 	MemberID string      `json:"member_id"`
-	Amount   float64     `json:"amount"`
+	Amount   money.Money `json:"amount"`
 	Method   TopUpMethod `json:"method"`
 }
 
+// MemberEmail on the requests below is where to send the member's receipt
+// or notice, passed along by the service acting for them.
+
 type PayBookingRequest struct {
-	BookingID string  `json:"booking_id"`
-	MemberID  string  `json:"member_id"`
-	Amount    float64 `json:"amount"`
+	BookingID   string      `json:"booking_id"`
+	MemberID    string      `json:"member_id"`
+	MemberEmail string      `json:"member_email,omitempty"`
+	Amount      money.Money `json:"amount"`
+}
+
+const (
+	WithdrawalPending  = "pending"
+	WithdrawalApproved = "approved"
+	WithdrawalRejected = "rejected"
+	WithdrawalPaid     = "paid"
+)
+
+// Withdrawal moves money out of a wallet. While it waits for review the
+// amount sits in the wallet's held sub-balance.
+type Withdrawal struct {
+	ID              uint        `json:"-" gorm:"primaryKey"`
+	WithdrawalID    string      `json:"withdrawal_id" gorm:"uniqueIndex"`
+	MemberID        string      `json:"member_id" gorm:"index"`
+	Amount          money.Money `json:"amount" gorm:"embedded;embeddedPrefix:amount_"`
+	Destination     string      `json:"destination"`
+	Status          string      `json:"status" gorm:"index"`
+	Reason          string      `json:"reason,omitempty"`
+	PayoutReference string      `json:"payout_reference,omitempty"`
+	ReviewedBy      string      `json:"reviewed_by,omitempty"`
+	ReviewedAt      *time.Time  `json:"reviewed_at,omitempty"`
+	PaidAt          *time.Time  `json:"paid_at,omitempty"`
+	CreatedAt       time.Time   `json:"created_at"`
+	UpdatedAt       time.Time   `json:"updated_at"`
+}
+
+type WithdrawalRequest struct {
+	MemberID    string      `json:"member_id"`
+	Amount      money.Money `json:"amount"`
+	Destination string      `json:"destination"`
+}
+
+type ReviewWithdrawalRequest struct {
+	Reason          string `json:"reason,omitempty"`
+	PayoutReference string `json:"payout_reference,omitempty"`
+}
+
+type TransferRequest struct {
+	MemberID   string      `json:"member_id"`
+	ToMemberID string      `json:"to_member_id"`
+	Amount     money.Money `json:"amount"`
+}
+
+type AuthorizePaymentRequest struct {
+	BookingID   string      `json:"booking_id"`
+	MemberID    string      `json:"member_id"`
+	MemberEmail string      `json:"member_email,omitempty"`
+	Amount      money.Money `json:"amount"`
+	HoldMinutes int         `json:"hold_minutes,omitempty"`
+}
+
+type SettleHoldRequest struct {
+	BookingID   string `json:"booking_id"`
+	MemberID    string `json:"member_id"`
+	MemberEmail string `json:"member_email,omitempty"`
 }
 
 type RefundRequest struct {
-	BookingID string  `json:"booking_id"`
-	MemberID  string  `json:"member_id"`
-	Amount    float64 `json:"amount"`
+	BookingID   string      `json:"booking_id"`
+	PaymentID   string      `json:"payment_id,omitempty"`
+	MemberID    string      `json:"member_id"`
+	MemberEmail string      `json:"member_email,omitempty"`
+	Amount      money.Money `json:"amount"`
+	Reason      string      `json:"reason,omitempty"`
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/skip2/go-qrcode"
+	"github.com/zensos/microservice-project/internal/auth"
+	"github.com/zensos/microservice-project/internal/middleware"
+	"github.com/zensos/microservice-project/internal/money"
+)
+
+// PromptPay QR codes follow the EMVCo merchant-presented QR spec: a list of
+// ID/length/value fields ending in a CRC16 of everything before it.
+const (
+	promptPayAID          = "A000000677010111"
+	promptPayCurrencyTHB  = "764"
+	promptPayCountry      = "TH"
+	promptPayMaxReference = 25
+)
+
+var errInvalidPromptPayID = errors.New("PromptPay ID must be a phone number, a 13 digit tax ID or a 15 digit e-wallet ID")
+
+func emvField(id, value string) string {
+	return fmt.Sprintf("%s%02d%s", id, len(value), value)
+}
+
+// crc16 is CRC-16/CCITT-FALSE (polynomial 0x1021, initial value 0xFFFF),
+// the checksum EMVCo QR codes use.
+func crc16(data string) uint16 {
+	crc := uint16(0xFFFF)
+	for i := 0; i < len(data); i++ {
+		crc ^= uint16(data[i]) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// promptPayTarget encodes who gets paid: a phone number as 0066 plus the
+// number without its leading zero, or a tax or e-wallet ID as is.
+func promptPayTarget(id string) (string, error) {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, id)
+
+	switch {
+	case len(digits) == 15:
+		return emvField("03", digits), nil
+	case len(digits) == 13:
+		return emvField("02", digits), nil
+	case len(digits) == 10 && digits[0] == '0':
+		return emvField("01", "0066"+digits[1:]), nil
+	case len(digits) == 11 && strings.HasPrefix(digits, "66"):
+		return emvField("01", "00"+digits), nil
+	}
+	return "", errInvalidPromptPayID
+}
+
+// promptPayPayload builds the QR payload for paying amount to id. A zero
+// amount makes a static code where the payer types the amount in. The
+// reference is shown to the payer and must fit in 25 characters.
+func promptPayPayload(id string, amount money.Money, reference string) (string, error) {
+	target, err := promptPayTarget(id)
+	if err != nil {
+		return "", err
+	}
+	if amount.Currency != "THB" {
+		return "", fmt.Errorf("PromptPay only takes THB, not %s", amount.Currency)
+	}
+	if amount.IsNegative() {
+		return "", errors.New("amount can't be negative")
+	}
+	if len(reference) > promptPayMaxReference {
+		return "", fmt.Errorf("reference can't be longer than %d characters", promptPayMaxReference)
+	}
+
+	initiation := "11"
+	if amount.IsPositive() {
+		initiation = "12"
+	}
+
+	var b strings.Builder
+	b.WriteString(emvField("00", "01"))
+	b.WriteString(emvField("01", initiation))
+	b.WriteString(emvField("29", emvField("00", promptPayAID)+target))
+	b.WriteString(emvField("58", promptPayCountry))
+	b.WriteString(emvField("53", promptPayCurrencyTHB))
+	if amount.IsPositive() {
+		b.WriteString(emvField("54", amount.String()))
+	}
+	if reference != "" {
+		b.WriteString(emvField("62", emvField("05", reference)))
+	}
+	b.WriteString("6304")
+
+	payload := b.String()
+	return payload + fmt.Sprintf("%04X", crc16(payload)), nil
+}
+
+// promptPayID is the platform's own PromptPay account that top-ups are paid
+// into.
+func promptPayID() string {
+	return os.Getenv("PROMPTPAY_ID")
+}
+
+// checkPromptPayID fails unless PROMPTPAY_ID is set to an ID PromptPay
+// accepts, so a misconfigured service never hands out codes that pay a
+// placeholder account.
+func checkPromptPayID() error {
+	if promptPayID() == "" {
+		return errors.New("PROMPTPAY_ID is required")
+	}
+	if _, err := promptPayTarget(promptPayID()); err != nil {
+		return fmt.Errorf("PROMPTPAY_ID: %w", err)
+	}
+	return nil
+}
+
+// getTopUpQR returns the intent's PromptPay payload and a PNG of it, as JSON
+// or, with ?format=png, as the image itself.
+func getTopUpQR(c fiber.Ctx) error {
+	var intent TopUpIntent
+	if err := db.Where("intent_id = ?", c.Params("intent_id")).First(&intent).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": errIntentNotFound.Error()})
+	}
+	if intent.MemberID != middleware.Subject(c) && !middleware.Can(c, auth.PermWalletsReadAny) {
+		return c.Status(403).JSON(fiber.Map{"error": "top-up does not belong to the authenticated member"})
+	}
+	if intent.Method != TopUpPromptpay {
+		return c.Status(400).JSON(fiber.Map{"error": "top-up is not a PromptPay top-up"})
+	}
+	if intent.Status != IntentPending {
+		return c.Status(409).JSON(fiber.Map{"error": "top-up is already " + intent.Status})
+	}
+	if time.Now().After(intent.ExpiresAt) {
+		return c.Status(410).JSON(fiber.Map{"error": "QR code has expired, please start a new top-up"})
+	}
+
+	payload := intent.Instructions["qr_payload"]
+	if payload == "" {
+		var err error
+		if payload, err = promptPayPayload(promptPayID(), intent.Amount, intent.IntentID); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "couldn't build the QR payload: " + err.Error()})
+		}
+	}
+
+	png, err := qrcode.Encode(payload, qrcode.Medium, 512)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "couldn't render the QR code"})
+	}
+
+	if c.Query("format") == "png" {
+		c.Set("Content-Type", "image/png")
+		c.Set("Cache-Control", "no-store")
+		return c.Send(png)
+	}
+
+	return c.JSON(fiber.Map{
+		"intent_id":  intent.IntentID,
+		"amount":     intent.Amount,
+		"payload":    payload,
+		"png":        "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+		"expires_at": intent.ExpiresAt,
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/zensos/microservice-project/internal/money"
+)
+
+func TestCRC16(t *testing.T) {
+	// The standard check value of CRC-16/CCITT-FALSE.
+	if got := crc16("123456789"); got != 0x29B1 {
+		t.Errorf("crc16(123456789) = %04X, want 29B1", got)
+	}
+}
+
+func TestPromptPayPayload(t *testing.T) {
+	// Payloads published with the promptpay-qr reference implementation.
+	tests := []struct {
+		name   string
+		id     string
+		amount money.Money
+		want   string
+	}{
+		{"phone", "0801234567", money.Zero("THB"),
+			"00020101021129370016A000000677010111011300668012345675802TH530376463046197"},
+		{"phone with country code", "+66-80-123-4567", money.Zero("THB"),
+			"00020101021129370016A000000677010111011300668012345675802TH530376463046197"},
+		{"tax id", "1111111111111", money.Zero("THB"),
+			"00020101021129370016A000000677010111021311111111111115802TH530376463047B5A"},
+		{"e-wallet id", "012345678901234", money.Zero("THB"),
+			"00020101021129390016A00000067701011103150123456789012345802TH530376463049781"},
+		{"phone with amount", "000-000-0000", money.New(422, "THB"),
+			"00020101021229370016A000000677010111011300660000000005802TH530376454044.226304E469"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := promptPayPayload(tt.id, tt.amount, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPromptPayPayloadReference(t *testing.T) {
+	got, err := promptPayPayload("0801234567", money.New(10000, "THB"), "tu_123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(got, "5406100.00") || !strings.Contains(got, "62100506tu_123") {
+		t.Errorf("amount or reference missing from %s", got)
+	}
+
+	body, sum := got[:len(got)-4], got[len(got)-4:]
+	if !strings.HasSuffix(body, "6304") {
+		t.Fatalf("%s doesn't end in a CRC field", got)
+	}
+	if want := fmt.Sprintf("%04X", crc16(body)); sum != want {
+		t.Errorf("checksum %s, want %s", sum, want)
+	}
+}
+
+func TestPromptPayPayloadErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		id        string
+		amount    money.Money
+		reference string
+	}{
+		{"short id", "12345", money.Zero("THB"), ""},
+		{"phone without leading zero", "8012345678", money.Zero("THB"), ""},
+		{"not baht", "0801234567", money.New(100, "USD"), ""},
+		{"negative", "0801234567", money.New(-100, "THB"), ""},
+		{"long reference", "0801234567", money.Zero("THB"), strings.Repeat("x", promptPayMaxReference+1)},
+	}
+
+	for _, tt := range tests {
+		if _, err := promptPayPayload(tt.id, tt.amount, tt.reference); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+func TestCheckPromptPayID(t *testing.T) {
+	tests := []struct {
+		id string
+		ok bool
+	}{
+		{"0801234567", true},
+		{"1111111111111", true},
+		{"", false},
+		{"0000", false},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("PROMPTPAY_ID", tt.id)
+		if err := checkPromptPayID(); (err == nil) != tt.ok {
+			t.Errorf("checkPromptPayID() with %q = %v", tt.id, err)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+	"github.com/gofiber/fiber/v3"
+	"github.com/zensos/microservice-project/internal/money"
+	"github.com/zensos/microservice-project/internal/pagination"
+	"gorm.io/gorm"
+)
+
+const (
+	statementBatchSize = 500
+	// maxPDFStatementEntries caps PDF statements, which are built in memory;
+	// longer ranges have to be split up or fetched as CSV, which streams.
+	maxPDFStatementEntries = 5000
+)
+
+type statement struct {
+	MemberID string
+	From     time.Time
+	To       time.Time
+	Opening  money.Money
+}
+
+// eachEntry walks the statement's ledger entries in batches so a long range
+// is never held in memory at once, and returns the closing balance.
+func (s statement) eachEntry(fn func(Ledger) error) (money.Money, error) {
+	closing := s.Opening
+	var ledgers []Ledger
+	err := db.Where("member_id = ? AND created_at >= ? AND created_at < ?", s.MemberID, s.From, s.To).
+		FindInBatches(&ledgers, statementBatchSize, func(tx *gorm.DB, batch int) error {
+			for _, entry := range ledgers {
+				if err := fn(entry); err != nil {
+					return err
+				}
+				closing = entry.BalanceAfter
+			}
+			return nil
+		}).Error
+	return closing, err
+}
+
+// openingBalance is the balance after the last entry before the statement
+// starts.
+func openingBalance(memberID string, from time.Time) (money.Money, error) {
+	var last Ledger
+	err := db.Where("member_id = ? AND created_at < ?", memberID, from).Order("id desc").Limit(1).Find(&last).Error
+	if err != nil {
+		return money.Money{}, err
+	}
+	if last.ID != 0 {
+		return last.BalanceAfter, nil
+	}
+
+	currency := money.DefaultCurrency
+	var wallet Wallet
+	if err := db.Where("member_id = ?", memberID).First(&wallet).Error; err == nil {
+		currency = wallet.Balance.Currency
+	}
+	return money.Zero(currency), nil
+}
+
+func (s statement) countEntries() (int64, error) {
+	var count int64
+	err := db.Model(&Ledger{}).
+		Where("member_id = ? AND created_at >= ? AND created_at < ?", s.MemberID, s.From, s.To).
+		Count(&count).Error
+	return count, err
+}
+
+// getStatement renders a member's statement for ?from= to ?to=, the current
+// month so far by default. PDFs are limited to maxPDFStatementEntries.
+func getStatement(c fiber.Ctx) error {
+	memberID := c.Params("member_id")
+
+	format := c.Query("format", "csv")
+	if format != "csv" && format != "pdf" {
+		return c.Status(400).JSON(fiber.Map{"error": "format must be csv or pdf"})
+	}
+
+	dates, err := pagination.ParseTimeRange(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	now := time.Now()
+	s := statement{MemberID: memberID, To: now}
+	if dates.From != nil {
+		s.From = *dates.From
+	} else {
+		s.From = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	}
+	if dates.To != nil {
+		s.To = *dates.To
+	}
+	if !s.From.Before(s.To) {
+		return c.Status(400).JSON(fiber.Map{"error": "from must be before to"})
+	}
+
+	if format == "pdf" {
+		count, err := s.countEntries()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "failed to load statement"})
+		}
+		if count > maxPDFStatementEntries {
+			return c.Status(422).JSON(fiber.Map{"error": fmt.Sprintf(
+				"pdf statements can't have more than %d entries, pick a shorter range or use format=csv", maxPDFStatementEntries)})
+		}
+	}
+
+	s.Opening, err = openingBalance(memberID, s.From)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to load opening balance"})
+	}
+
+	filename := fmt.Sprintf("statement-%s-%s-%s.%s", memberID, s.From.Format(time.DateOnly), s.To.Format(time.DateOnly), format)
+	c.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	// Headers are already sent once the body streams, so failures past this
+	// point can only be logged.
+	if format == "pdf" {
+		c.Set("Content-Type", "application/pdf")
+		return c.SendStreamWriter(func(w *bufio.Writer) {
+			if err := s.writePDF(w); err != nil {
+				log.Printf("couldn't write pdf statement for %s: %v", memberID, err)
+			}
+		})
+	}
+
+	c.Set("Content-Type", "text/csv; charset=utf-8")
+	return c.SendStreamWriter(func(w *bufio.Writer) {
+		if err := s.writeCSV(w); err != nil {
+			log.Printf("couldn't write csv statement for %s: %v", memberID, err)
+		}
+	})
+}
+
+func (s statement) writeCSV(w *bufio.Writer) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"date", "type", "method", "reference_id", "amount", "balance_after", "currency"})
+	out.Write([]string{s.From.Format(time.RFC3339), "opening_balance", "", "", "", s.Opening.String(), s.Opening.Currency})
+
+	closing, err := s.eachEntry(func(entry Ledger) error {
+		return out.Write([]string{
+			entry.CreatedAt.Format(time.RFC3339),
+			string(entry.Type),
+			string(entry.Method),
+			entry.ReferenceID,
+			entry.Amount.String(),
+			entry.BalanceAfter.String(),
+			entry.Amount.Currency,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	out.Write([]string{s.To.Format(time.RFC3339), "closing_balance", "", "", "", closing.String(), closing.Currency})
+	out.Flush()
+	return out.Error()
+}
+
+var statementColumns = []struct {
+	title string
+	width float64
+	align string
+}{
+	{"Date", 38, "L"},
+	{"Type", 28, "L"},
+	{"Reference", 64, "L"},
+	{"Amount", 30, "R"},
+	{"Balance", 30, "R"},
+}
+
+// writePDF reads entries in batches like the CSV, but fpdf has to hold the
+// document until it is output, which is why getStatement caps its length.
+func (s statement) writePDF(w *bufio.Writer) error {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	header := func() {
+		pdf.SetFont("Helvetica", "B", 9)
+		for _, col := range statementColumns {
+			pdf.CellFormat(col.width, 7, col.title, "B", 0, col.align, false, 0, "")
+		}
+		pdf.Ln(-1)
+		pdf.SetFont("Helvetica", "", 9)
+	}
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-15)
+		pdf.SetFont("Helvetica", "I", 8)
+		pdf.CellFormat(0, 10, fmt.Sprintf("Page %d", pdf.PageNo()), "", 0, "C", false, 0, "")
+	})
+
+	pdf.AddPage()
+	pdf.SetFont("Helvetica", "B", 14)
+	pdf.CellFormat(0, 8, "Wallet statement", "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	pdf.CellFormat(0, 6, "Member: "+s.MemberID, "", 1, "L", false, 0, "")
+	pdf.CellFormat(0, 6, fmt.Sprintf("Period: %s to %s", s.From.Format(time.DateTime), s.To.Format(time.DateTime)), "", 1, "L", false, 0, "")
+	pdf.CellFormat(0, 6, fmt.Sprintf("Opening balance: %s %s", s.Opening.String(), s.Opening.Currency), "", 1, "L", false, 0, "")
+	pdf.Ln(4)
+
+	// The table header repeats on every page after the first.
+	header()
+	pdf.SetHeaderFunc(header)
+	closing, err := s.eachEntry(func(entry Ledger) error {
+		row := []string{
+			entry.CreatedAt.Format(time.DateTime),
+			string(entry.Type),
+			entry.ReferenceID,
+			entry.Amount.String(),
+			entry.BalanceAfter.String(),
+		}
+		for i, col := range statementColumns {
+			pdf.CellFormat(col.width, 6, row[i], "", 0, col.align, false, 0, "")
+		}
+		pdf.Ln(-1)
+		return pdf.Error()
+	})
+	if err != nil {
+		return err
+	}
+
+	pdf.Ln(4)
+	pdf.SetFont("Helvetica", "B", 10)
+	pdf.CellFormat(0, 6, fmt.Sprintf("Closing balance: %s %s", closing.String(), closing.Currency), "", 1, "L", false, 0, "")
+
+	return pdf.Output(w)
+}
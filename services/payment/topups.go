@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/zensos/microservice-project/internal/auth"
+	"github.com/zensos/microservice-project/internal/events"
+	"github.com/zensos/microservice-project/internal/middleware"
+	"github.com/zensos/microservice-project/internal/money"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var errIntentNotFound = errors.New("top-up intent not found")
+
+// createTopUp opens an intent with the method's provider and returns what
+// the member has to do to pay. Nothing is credited yet.
+func createTopUp(c fiber.Ctx) error {
+	var req TopUpRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid request body"})
+	}
+
+	if req.MemberID == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "member_id is required"})
+	}
+	if !req.Amount.IsPositive() {
+		return c.Status(400).JSON(fiber.Map{"error": "amount must be greater than 0"})
+	}
+
+	if !slices.Contains(topUpMethods, req.Method) {
+		return c.Status(400).JSON(fiber.Map{"error": "method must be one of: promptpay, banking, truewallet"})
+	}
+	gateway, ok := gatewaysByMethod[req.Method]
+	if !ok {
+		return c.Status(503).JSON(fiber.Map{"error": "top-ups with " + string(req.Method) + " are not available right now"})
+	}
+
+	var wallet Wallet
+	if err := db.Where("member_id = ?", req.MemberID).First(&wallet).Error; err == nil && !wallet.Balance.SameCurrency(req.Amount) {
+		return c.Status(400).JSON(fiber.Map{"error": "amount currency does not match the wallet currency"})
+	}
+
+	intent := TopUpIntent{
+		IntentID: fmt.Sprintf("tui_%d", time.Now().UnixNano()),
+		MemberID: req.MemberID,
+		Method:   req.Method,
+		Amount:   req.Amount,
+		Provider: gateway.Name(),
+		Status:   IntentPending,
+	}
+	intent.MemberEmail = claimsEmail(c, req.MemberID)
+
+	created, err := gateway.CreateIntent(intent)
+	if err != nil {
+		log.Printf("couldn't create %s intent with %s: %v", req.Method, gateway.Name(), err)
+		return c.Status(502).JSON(fiber.Map{"error": "payment provider is unavailable, please try again"})
+	}
+	intent.ProviderRef = created.Reference
+	intent.Instructions = created.Instructions
+	intent.ExpiresAt = created.ExpiresAt
+
+	if err := db.Create(&intent).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to create top-up"})
+	}
+
+	return c.Status(202).JSON(fiber.Map{"intent": intent})
+}
+
+// getTopUp returns an intent, asking the provider first while it's pending
+// in case a webhook went missing.
+func getTopUp(c fiber.Ctx) error {
+	var intent TopUpIntent
+	if err := db.Where("intent_id = ?", c.Params("intent_id")).First(&intent).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": errIntentNotFound.Error()})
+	}
+	if intent.MemberID != middleware.Subject(c) && !middleware.Can(c, auth.PermWalletsReadAny) {
+		return c.Status(403).JSON(fiber.Map{"error": "top-up does not belong to the authenticated member"})
+	}
+
+	if intent.Status == IntentPending {
+		if updated, err := pollTopUp(intent); err != nil {
+			log.Printf("couldn't poll top-up %s: %v", intent.IntentID, err)
+		} else {
+			intent = updated
+		}
+	}
+
+	return c.JSON(intent)
+}
+
+func pollTopUp(intent TopUpIntent) (TopUpIntent, error) {
+	gateway, ok := gatewaysByProvider[intent.Provider]
+	if !ok {
+		return intent, fmt.Errorf("no gateway for provider %q", intent.Provider)
+	}
+
+	result, err := gateway.FetchStatus(intent.ProviderRef)
+	if errors.Is(err, ErrUnknownIntent) && time.Now().After(intent.ExpiresAt) {
+		result = ProviderResult{Reference: intent.ProviderRef, Status: ProviderExpired}
+	} else if err != nil {
+		return intent, err
+	}
+	if result.Status == ProviderPending {
+		return intent, nil
+	}
+	return settleTopUp(intent.Provider, result)
+}
+
+// settleTopUp applies the provider's result to its intent. Callbacks can
+// arrive in any order: a credited intent never changes again, and a payment
+// the provider confirms after we gave up on it is still credited, since the
+// money did arrive. Failures and expiry only end a pending intent.
+func settleTopUp(provider string, result ProviderResult) (TopUpIntent, error) {
+	var intent TopUpIntent
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("provider = ? AND provider_ref = ?", provider, result.Reference).First(&intent).Error; err != nil {
+			return errIntentNotFound
+		}
+		if intent.Status == IntentSucceeded {
+			return nil
+		}
+		if intent.Status != IntentPending && result.Status != ProviderSucceeded {
+			return nil
+		}
+
+		switch result.Status {
+		case ProviderSucceeded:
+			if result.Amount != intent.Amount {
+				intent.Status = IntentFailed
+				intent.FailureReason = fmt.Sprintf("provider confirmed %s %s instead of %s %s",
+					result.Amount, result.Amount.Currency, intent.Amount, intent.Amount.Currency)
+				log.Printf("top-up %s: %s", intent.IntentID, intent.FailureReason)
+				break
+			}
+			if intent.Status != IntentPending {
+				log.Printf("top-up %s was %s but the provider confirmed it, crediting", intent.IntentID, intent.Status)
+				intent.FailureReason = ""
+			}
+			err := creditTopUp(tx, &intent)
+			if errors.Is(err, money.ErrCurrencyMismatch) {
+				intent.Status = IntentFailed
+				intent.FailureReason = "amount currency does not match the wallet currency"
+			} else if err != nil {
+				return err
+			}
+		case ProviderFailed:
+			intent.Status = IntentFailed
+			intent.FailureReason = "payment failed at the provider"
+		case ProviderExpired:
+			intent.Status = IntentExpired
+		default:
+			return nil
+		}
+
+		return tx.Save(&intent).Error
+	})
+
+	return intent, err
+}
+
+// creditTopUp credits the wallet for a confirmed intent, opening the wallet
+// on the member's first top-up. The receipt goes to the email recorded on
+// the intent when the member started it.
+func creditTopUp(tx *gorm.DB, intent *TopUpIntent) error {
+	var wallet Wallet
+	result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("member_id = ?", intent.MemberID).First(&wallet)
+
+	if result.Error != nil {
+		wallet = Wallet{
+			MemberID: intent.MemberID,
+			Balance:  money.Zero(intent.Amount.Currency),
+			Held:     money.Zero(intent.Amount.Currency),
+		}
+		if err := tx.Create(&wallet).Error; err != nil {
+			return err
+		}
+	}
+	if !wallet.Balance.SameCurrency(intent.Amount) {
+		return money.ErrCurrencyMismatch
+	}
+
+	if _, err := postJournal(tx, LedgerTopUp, intent.IntentID,
+		debit(FundingAccount, intent.Amount),
+		credit(walletAccount(intent.MemberID), intent.Amount),
+	); err != nil {
+		return err
+	}
+	if err := tx.First(&wallet, wallet.ID).Error; err != nil {
+		return err
+	}
+
+	ledger := Ledger{
+		MemberID:     intent.MemberID,
+		Type:         LedgerTopUp,
+		Method:       intent.Method,
+		Amount:       intent.Amount,
+		BalanceAfter: wallet.Balance,
+		ReferenceID:  intent.IntentID,
+	}
+	if err := tx.Create(&ledger).Error; err != nil {
+		return err
+	}
+
+	if err := publish(tx, events.TypeWalletToppedUp, events.WalletToppedUp{
+		IntentID:     intent.IntentID,
+		MemberID:     intent.MemberID,
+		MemberEmail:  intent.MemberEmail,
+		Method:       string(intent.Method),
+		Amount:       intent.Amount,
+		BalanceAfter: wallet.Balance,
+	}); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	intent.Status = IntentSucceeded
+	intent.CreditedAt = &now
+	return nil
+}
+
+// expireTopUps polls the provider for intents past their expiry, so intents
+// whose member walked away don't stay pending forever.
+func expireTopUps(every time.Duration) {
+	for {
+		var stale []TopUpIntent
+		if err := db.Where("status = ? AND expires_at < ?", IntentPending, time.Now()).
+			Order("id").Limit(100).Find(&stale).Error; err != nil {
+			log.Printf("couldn't load stale top-ups: %v", err)
+		}
+
+		for _, intent := range stale {
+			if _, err := pollTopUp(intent); err != nil {
+				log.Printf("couldn't poll top-up %s: %v", intent.IntentID, err)
+			}
+		}
+
+		time.Sleep(every)
+	}
+}
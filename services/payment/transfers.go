@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/zensos/microservice-project/internal/money"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	errSameWallet           = errors.New("can't transfer to your own wallet")
+	errSenderWalletMissing  = errors.New("wallet not found, please top up first")
+	errRecipientMissing     = errors.New("recipient has no wallet")
+	errInsufficientBalance  = errors.New("insufficient balance")
+	errDailyTransferLimit   = errors.New("daily transfer limit reached")
+	errDailyTransferCount   = errors.New("too many transfers today")
+	errRecipientCurrency    = errors.New("recipient wallet is in another currency")
+	errTransferLimitSetting = errors.New("TRANSFER_DAILY_LIMIT is not a valid amount")
+)
+
+// transferDailyLimit is how much a member can send per day, in the currency
+// of their wallet.
+func transferDailyLimit(currency string) (money.Money, error) {
+	raw := os.Getenv("TRANSFER_DAILY_LIMIT")
+	if raw == "" {
+		raw = "20000"
+	}
+	limit, err := money.Parse(raw, currency)
+	if err != nil {
+		return limit, errTransferLimitSetting
+	}
+	return limit, nil
+}
+
+func transferDailyCount() int64 {
+	n, err := strconv.ParseInt(os.Getenv("TRANSFER_DAILY_COUNT"), 10, 64)
+	if err != nil || n < 1 {
+		return 20
+	}
+	return n
+}
+
+// lockWallets locks both wallets in member_id order, so two members sending
+// to each other at the same time can't deadlock.
+func lockWallets(tx *gorm.DB, from, to string) (sender, recipient Wallet, err error) {
+	first, second := from, to
+	if second < first {
+		first, second = second, first
+	}
+
+	locked := map[string]*Wallet{from: &sender, to: &recipient}
+	for _, memberID := range []string{first, second} {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("member_id = ?", memberID).First(locked[memberID]).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			if memberID == from {
+				return sender, recipient, errSenderWalletMissing
+			}
+			return sender, recipient, errRecipientMissing
+		}
+		if err != nil {
+			return sender, recipient, err
+		}
+	}
+	return sender, recipient, nil
+}
+
+// checkTransferLimits must run with the sender's wallet locked, so concurrent
+// transfers can't both fit under the limit.
+func checkTransferLimits(tx *gorm.DB, memberID string, amount money.Money) error {
+	limit, err := transferDailyLimit(amount.Currency)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	var today struct {
+		Total int64
+		Count int64
+	}
+	if err := tx.Model(&Ledger{}).
+		Select("COALESCE(-SUM(amount_minor), 0) AS total, COUNT(*) AS count").
+		Where("member_id = ? AND type = ? AND amount_currency = ? AND created_at >= ?",
+			memberID, LedgerTransferOut, amount.Currency, dayStart).
+		Scan(&today).Error; err != nil {
+		return err
+	}
+
+	if today.Count >= transferDailyCount() {
+		return errDailyTransferCount
+	}
+	if money.New(today.Total, amount.Currency).Add(amount).Cmp(limit) > 0 {
+		return errDailyTransferLimit
+	}
+	return nil
+}
+
+func transfer(c fiber.Ctx) error {
+	var req TransferRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid request body"})
+	}
+
+	if req.MemberID == "" || req.ToMemberID == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "member_id and to_member_id are required"})
+	}
+	if req.MemberID == req.ToMemberID {
+		return c.Status(400).JSON(fiber.Map{"error": errSameWallet.Error()})
+	}
+	if !req.Amount.IsPositive() {
+		return c.Status(400).JSON(fiber.Map{"error": "amount must be greater than 0"})
+	}
+
+	var out, in Ledger
+	transferID := fmt.Sprintf("trf_%d", time.Now().UnixNano())
+
+	txErr := db.Transaction(func(tx *gorm.DB) error {
+		sender, recipient, err := lockWallets(tx, req.MemberID, req.ToMemberID)
+		if err != nil {
+			return err
+		}
+		if !sender.Balance.SameCurrency(req.Amount) {
+			return money.ErrCurrencyMismatch
+		}
+		if !recipient.Balance.SameCurrency(req.Amount) {
+			return errRecipientCurrency
+		}
+		if sender.Balance.Cmp(req.Amount) < 0 {
+			return errInsufficientBalance
+		}
+		if err := checkTransferLimits(tx, req.MemberID, req.Amount); err != nil {
+			return err
+		}
+		before := sender.Balance
+
+		if _, err := postJournal(tx, LedgerTransferOut, transferID,
+			debit(walletAccount(req.MemberID), req.Amount),
+			credit(walletAccount(req.ToMemberID), req.Amount),
+		); err != nil {
+			return err
+		}
+		if err := tx.First(&sender, sender.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.First(&recipient, recipient.ID).Error; err != nil {
+			return err
+		}
+
+		out = Ledger{
+			MemberID:     req.MemberID,
+			Type:         LedgerTransferOut,
+			Amount:       req.Amount.Neg(),
+			BalanceAfter: sender.Balance,
+			ReferenceID:  transferID,
+			Counterparty: req.ToMemberID,
+		}
+		in = Ledger{
+			MemberID:     req.ToMemberID,
+			Type:         LedgerTransferIn,
+			Amount:       req.Amount,
+			BalanceAfter: recipient.Balance,
+			ReferenceID:  transferID,
+			Counterparty: req.MemberID,
+		}
+		if err := tx.Create(&out).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&in).Error; err != nil {
+			return err
+		}
+		return checkLowBalance(tx, req.MemberID, claimsEmail(c, req.MemberID), before)
+	})
+
+	switch {
+	case errors.Is(txErr, money.ErrCurrencyMismatch):
+		return c.Status(400).JSON(fiber.Map{"error": "amount currency does not match the wallet currency"})
+	case errors.Is(txErr, errSenderWalletMissing), errors.Is(txErr, errRecipientMissing):
+		return c.Status(404).JSON(fiber.Map{"error": txErr.Error()})
+	case errors.Is(txErr, errInsufficientBalance), errors.Is(txErr, errRecipientCurrency):
+		return c.Status(400).JSON(fiber.Map{"error": txErr.Error()})
+	case errors.Is(txErr, errDailyTransferLimit), errors.Is(txErr, errDailyTransferCount):
+		return c.Status(422).JSON(fiber.Map{"error": txErr.Error()})
+	case txErr != nil:
+		return c.Status(500).JSON(fiber.Map{"error": "failed to transfer"})
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"transfer_id": transferID,
+		"ledger":      out,
+	})
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/zensos/microservice-project/internal/pagination"
+	"gorm.io/gorm/clause"
+)
+
+// webhookTolerance is how old a signature may be before a delivery is
+// treated as a replay attack. Replays from the admin tool skip the check.
+const webhookTolerance = 5 * time.Minute
+
+const (
+	WebhookReceived  = "received"
+	WebhookProcessed = "processed"
+	WebhookUnmatched = "unmatched"
+	WebhookFailed    = "failed"
+)
+
+// Webhooks that couldn't be applied are retried for a day, which covers a
+// provider calling back before the intent is stored. Received ones are
+// retried too, in case we stopped before applying them.
+const (
+	webhookRetryWindow = 24 * time.Hour
+	webhookMaxAttempts = 20
+)
+
+// signWebhook returns a signature header value of the form
+// t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">.
+func signWebhook(secret string, body []byte, at time.Time) string {
+	t := strconv.FormatInt(at.Unix(), 10)
+	return "t=" + t + ",v1=" + webhookMAC(secret, t, body)
+}
+
+func webhookMAC(secret, t string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyWebhookSignature checks a header made by signWebhook. A maxAge of
+// zero accepts signatures of any age.
+func verifyWebhookSignature(secret, header string, body []byte, maxAge time.Duration) error {
+	var t, sig string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			t = value
+		case "v1":
+			sig = value
+		}
+	}
+	if t == "" || sig == "" {
+		return ErrInvalidSignature
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(webhookMAC(secret, t, body))) {
+		return ErrInvalidSignature
+	}
+
+	if maxAge > 0 {
+		unix, err := strconv.ParseInt(t, 10, 64)
+		if err != nil {
+			return ErrInvalidSignature
+		}
+		if age := time.Since(time.Unix(unix, 0)); age > maxAge || age < -maxAge {
+			return fmt.Errorf("%w: signed %s ago", ErrInvalidSignature, age.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+// receiveWebhook stores every authentic delivery before applying it, so the
+// raw payload is kept for disputes and a redelivered event is only applied
+// once.
+func receiveWebhook(c fiber.Ctx) error {
+	gateway, ok := gatewaysByProvider[c.Params("provider")]
+	if !ok {
+		return c.Status(404).JSON(fiber.Map{"error": "unknown provider"})
+	}
+
+	header := http.Header{}
+	for key, values := range c.GetReqHeaders() {
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+	body := append([]byte(nil), c.Body()...)
+
+	result, err := gateway.VerifyWebhook(header, body, webhookTolerance)
+	if errors.Is(err, ErrInvalidSignature) {
+		return c.Status(401).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil || result.EventID == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid webhook payload"})
+	}
+
+	stored := map[string]string{}
+	for key := range header {
+		stored[key] = header.Get(key)
+	}
+	event := WebhookEvent{
+		Provider:  gateway.Name(),
+		EventID:   result.EventID,
+		Reference: result.Reference,
+		Headers:   stored,
+		Payload:   string(body),
+		Status:    WebhookReceived,
+	}
+	created := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&event)
+	if created.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to store webhook"})
+	}
+	if created.RowsAffected == 0 {
+		if err := db.Where("provider = ? AND event_id = ?", event.Provider, event.EventID).First(&event).Error; err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "failed to load webhook"})
+		}
+		if event.Status == WebhookProcessed {
+			return c.JSON(fiber.Map{"event_id": event.EventID, "status": event.Status, "duplicate": true})
+		}
+	}
+
+	applyWebhook(&event, result)
+
+	switch event.Status {
+	case WebhookProcessed:
+		return c.JSON(fiber.Map{"event_id": event.EventID, "status": event.Status})
+	case WebhookUnmatched:
+		// Most likely the intent isn't committed yet; we retry on our side.
+		return c.Status(202).JSON(fiber.Map{"event_id": event.EventID, "status": event.Status})
+	default:
+		return c.Status(500).JSON(fiber.Map{"error": "failed to process webhook"})
+	}
+}
+
+// applyWebhook settles the event's intent and records the outcome on the
+// stored event.
+func applyWebhook(event *WebhookEvent, result ProviderResult) {
+	event.Attempts++
+	event.Error = ""
+
+	_, err := settleTopUp(event.Provider, result)
+	switch {
+	case err == nil:
+		now := time.Now()
+		event.Status = WebhookProcessed
+		event.ProcessedAt = &now
+	case errors.Is(err, errIntentNotFound):
+		event.Status = WebhookUnmatched
+		event.Error = err.Error()
+	default:
+		event.Status = WebhookFailed
+		event.Error = err.Error()
+		log.Printf("couldn't apply webhook %s/%s: %v", event.Provider, event.EventID, err)
+	}
+
+	if err := db.Model(event).Select("Status", "Error", "Attempts", "ProcessedAt").Updates(event).Error; err != nil {
+		log.Printf("couldn't update webhook %s/%s: %v", event.Provider, event.EventID, err)
+	}
+}
+
+// replayWebhook runs a stored payload through verification and processing
+// again. Settling is idempotent, so replaying a processed event is safe.
+func replayWebhook(event *WebhookEvent) error {
+	gateway, ok := gatewaysByProvider[event.Provider]
+	if !ok {
+		return fmt.Errorf("no gateway for provider %q", event.Provider)
+	}
+
+	header := http.Header{}
+	for key, value := range event.Headers {
+		header.Set(key, value)
+	}
+	result, err := gateway.VerifyWebhook(header, []byte(event.Payload), 0)
+	if err != nil {
+		return err
+	}
+
+	applyWebhook(event, result)
+	return nil
+}
+
+func retryWebhooks(every time.Duration) {
+	for {
+		var pending []WebhookEvent
+		if err := db.Where("status IN ? AND attempts < ? AND created_at > ?",
+			[]string{WebhookReceived, WebhookUnmatched, WebhookFailed}, webhookMaxAttempts, time.Now().Add(-webhookRetryWindow)).
+			Order("id").Limit(100).Find(&pending).Error; err != nil {
+			log.Printf("couldn't load webhooks to retry: %v", err)
+		}
+
+		for i := range pending {
+			if err := replayWebhook(&pending[i]); err != nil {
+				log.Printf("couldn't retry webhook %s/%s: %v", pending[i].Provider, pending[i].EventID, err)
+			}
+		}
+
+		time.Sleep(every)
+	}
+}
+
+var webhookSorts = pagination.Sorts{}.
+	Add("created_at", "created_at", pagination.KeyTime)
+
+func listWebhooks(c fiber.Ctx) error {
+	params, err := pagination.Parse(c, webhookSorts, "-created_at")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	query := db.Model(&WebhookEvent{})
+	if provider := c.Query("provider"); provider != "" {
+		query = query.Where("provider = ?", provider)
+	}
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status IN ?", strings.Split(status, ","))
+	}
+	if reference := c.Query("reference"); reference != "" {
+		query = query.Where("reference = ?", reference)
+	}
+
+	var events []WebhookEvent
+	if err := pagination.Apply(query, params).Find(&events).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to load webhooks"})
+	}
+	return c.JSON(pagination.NewPage(events, params, func(e WebhookEvent) (any, uint) {
+		return e.CreatedAt, e.ID
+	}))
+}
+
+func replayWebhookHandler(c fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid webhook id"})
+	}
+
+	var event WebhookEvent
+	if err := db.First(&event, id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "webhook not found"})
+	}
+
+	if err := replayWebhook(&event); err != nil {
+		return c.Status(422).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(event)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	body := []byte(`{"event_id":"evt_1","reference":"mock_1","status":"succeeded"}`)
+	now := time.Now()
+	stale := now.Add(-10 * time.Minute)
+	ts := strconv.FormatInt(now.Unix(), 10)
+
+	tests := []struct {
+		name   string
+		secret string
+		header string
+		body   []byte
+		maxAge time.Duration
+		ok     bool
+	}{
+		{"valid", "secret", signWebhook("secret", body, now), body, 5 * time.Minute, true},
+		{"parts swapped and spaced", "secret", "v1=" + webhookMAC("secret", ts, body) + ", t=" + ts, body, 5 * time.Minute, true},
+		{"wrong secret", "other", signWebhook("secret", body, now), body, 5 * time.Minute, false},
+		{"tampered body", "secret", signWebhook("secret", body, now), []byte(`{"status":"failed"}`), 5 * time.Minute, false},
+		{"too old", "secret", signWebhook("secret", body, stale), body, 5 * time.Minute, false},
+		{"too far ahead", "secret", signWebhook("secret", body, now.Add(10*time.Minute)), body, 5 * time.Minute, false},
+		{"old but any age allowed", "secret", signWebhook("secret", body, stale), body, 0, true},
+		{"timestamp changed", "secret", "t=" + strconv.FormatInt(now.Unix()+1, 10) + ",v1=" + webhookMAC("secret", ts, body), body, 5 * time.Minute, false},
+		{"no signature", "secret", "t=" + ts, body, 5 * time.Minute, false},
+		{"no timestamp", "secret", "v1=" + webhookMAC("secret", "", body), body, 0, false},
+		{"empty header", "secret", "", body, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyWebhookSignature(tt.secret, tt.header, tt.body, tt.maxAge)
+			if tt.ok && err != nil {
+				t.Errorf("got %v, want a valid signature", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrInvalidSignature) {
+				t.Errorf("got %v, want ErrInvalidSignature", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/zensos/microservice-project/internal/middleware"
+	"github.com/zensos/microservice-project/internal/money"
+	"github.com/zensos/microservice-project/internal/pagination"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	errWithdrawalNotFound = errors.New("withdrawal not found")
+	errWithdrawalState    = errors.New("withdrawal is not in a state that allows this")
+)
+
+var withdrawalSorts = pagination.Sorts{}.
+	Add("created_at", "created_at", pagination.KeyTime)
+
+func withdrawalSortKey(w Withdrawal) (any, uint) {
+	return w.CreatedAt, w.ID
+}
+
+// withdrawalLedger records a withdrawal step on the member's ledger. Steps
+// that only move money between held and the platform leave the available
+// balance alone, so their amount is zero.
+func withdrawalLedger(tx *gorm.DB, w Withdrawal, kind LedgerType, amount money.Money) (Ledger, error) {
+	var wallet Wallet
+	if err := tx.Where("member_id = ?", w.MemberID).First(&wallet).Error; err != nil {
+		return Ledger{}, err
+	}
+
+	ledger := Ledger{
+		MemberID:     w.MemberID,
+		Type:         kind,
+		Amount:       amount,
+		BalanceAfter: wallet.Balance,
+		ReferenceID:  w.WithdrawalID,
+	}
+	return ledger, tx.Create(&ledger).Error
+}
+
+func requestWithdrawal(c fiber.Ctx) error {
+	var req WithdrawalRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid request body"})
+	}
+
+	if req.MemberID == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "member_id is required"})
+	}
+	if !req.Amount.IsPositive() {
+		return c.Status(400).JSON(fiber.Map{"error": "amount must be greater than 0"})
+	}
+	if strings.TrimSpace(req.Destination) == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "destination is required"})
+	}
+
+	withdrawal := Withdrawal{
+		WithdrawalID: fmt.Sprintf("wd_%d", time.Now().UnixNano()),
+		MemberID:     req.MemberID,
+		Amount:       req.Amount,
+		Destination:  req.Destination,
+		Status:       WithdrawalPending,
+	}
+	var ledger Ledger
+
+	txErr := db.Transaction(func(tx *gorm.DB) error {
+		var wallet Wallet
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("member_id = ?", req.MemberID).First(&wallet).Error; err != nil {
+			return errSenderWalletMissing
+		}
+		if !wallet.Balance.SameCurrency(req.Amount) {
+			return money.ErrCurrencyMismatch
+		}
+		if wallet.Balance.Cmp(req.Amount) < 0 {
+			return errInsufficientBalance
+		}
+
+		if _, err := postJournal(tx, LedgerWithdrawalHold, withdrawal.WithdrawalID,
+			debit(walletAccount(req.MemberID), req.Amount),
+			credit(walletHeldAccount(req.MemberID), req.Amount),
+		); err != nil {
+			return err
+		}
+		if err := tx.Create(&withdrawal).Error; err != nil {
+			return err
+		}
+
+		var err error
+		if ledger, err = withdrawalLedger(tx, withdrawal, LedgerWithdrawalHold, req.Amount.Neg()); err != nil {
+			return err
+		}
+		return checkLowBalance(tx, req.MemberID, claimsEmail(c, req.MemberID), wallet.Balance)
+	})
+
+	switch {
+	case errors.Is(txErr, money.ErrCurrencyMismatch):
+		return c.Status(400).JSON(fiber.Map{"error": "amount currency does not match the wallet currency"})
+	case errors.Is(txErr, errSenderWalletMissing):
+		return c.Status(404).JSON(fiber.Map{"error": txErr.Error()})
+	case errors.Is(txErr, errInsufficientBalance):
+		return c.Status(400).JSON(fiber.Map{"error": txErr.Error()})
+	case txErr != nil:
+		return c.Status(500).JSON(fiber.Map{"error": "failed to request withdrawal"})
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"withdrawal": withdrawal,
+		"ledger":     ledger,
+	})
+}
+
+// reviewWithdrawal moves a withdrawal from one status to the next. apply
+// posts the money movement for the step and returns its ledger entry.
+func reviewWithdrawal(c fiber.Ctx, from, to string, apply func(tx *gorm.DB, w *Withdrawal, req ReviewWithdrawalRequest) (Ledger, error)) error {
+	var req ReviewWithdrawalRequest
+	if len(c.Body()) > 0 {
+		if err := c.Bind().JSON(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "invalid request body"})
+		}
+	}
+
+	var withdrawal Withdrawal
+	var ledger Ledger
+
+	txErr := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("withdrawal_id = ?", c.Params("withdrawal_id")).First(&withdrawal).Error; err != nil {
+			return errWithdrawalNotFound
+		}
+		if withdrawal.Status != from {
+			return errWithdrawalState
+		}
+
+		var err error
+		if ledger, err = apply(tx, &withdrawal, req); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		withdrawal.Status = to
+		if from == WithdrawalPending {
+			withdrawal.ReviewedBy = middleware.Subject(c)
+			withdrawal.ReviewedAt = &now
+		}
+		return tx.Save(&withdrawal).Error
+	})
+
+	switch {
+	case errors.Is(txErr, errWithdrawalNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": txErr.Error()})
+	case errors.Is(txErr, errWithdrawalState):
+		return c.Status(409).JSON(fiber.Map{"error": "withdrawal is " + withdrawal.Status + ", expected " + from})
+	case txErr != nil:
+		return c.Status(500).JSON(fiber.Map{"error": "failed to update withdrawal"})
+	}
+
+	return c.JSON(fiber.Map{
+		"withdrawal": withdrawal,
+		"ledger":     ledger,
+	})
+}
+
+// approveWithdrawal takes the held amount out of the wallet into payout
+// clearing, where it waits for the bank transfer.
+func approveWithdrawal(c fiber.Ctx) error {
+	return reviewWithdrawal(c, WithdrawalPending, WithdrawalApproved, func(tx *gorm.DB, w *Withdrawal, _ ReviewWithdrawalRequest) (Ledger, error) {
+		if _, err := postJournal(tx, LedgerWithdrawalApproved, w.WithdrawalID,
+			debit(walletHeldAccount(w.MemberID), w.Amount),
+			credit(PayoutClearingAccount, w.Amount),
+		); err != nil {
+			return Ledger{}, err
+		}
+		return withdrawalLedger(tx, *w, LedgerWithdrawalApproved, money.Zero(w.Amount.Currency))
+	})
+}
+
+// rejectWithdrawal gives the held amount back to the wallet.
+func rejectWithdrawal(c fiber.Ctx) error {
+	return reviewWithdrawal(c, WithdrawalPending, WithdrawalRejected, func(tx *gorm.DB, w *Withdrawal, req ReviewWithdrawalRequest) (Ledger, error) {
+		if _, err := postJournal(tx, LedgerWithdrawalReleased, w.WithdrawalID,
+			debit(walletHeldAccount(w.MemberID), w.Amount),
+			credit(walletAccount(w.MemberID), w.Amount),
+		); err != nil {
+			return Ledger{}, err
+		}
+		w.Reason = req.Reason
+		return withdrawalLedger(tx, *w, LedgerWithdrawalReleased, w.Amount)
+	})
+}
+
+// markWithdrawalPaid records that the bank transfer went out.
+func markWithdrawalPaid(c fiber.Ctx) error {
+	return reviewWithdrawal(c, WithdrawalApproved, WithdrawalPaid, func(tx *gorm.DB, w *Withdrawal, req ReviewWithdrawalRequest) (Ledger, error) {
+		if _, err := postJournal(tx, LedgerWithdrawalPaid, w.WithdrawalID,
+			debit(PayoutClearingAccount, w.Amount),
+			credit(FundingAccount, w.Amount),
+		); err != nil {
+			return Ledger{}, err
+		}
+		now := time.Now()
+		w.PayoutReference = req.PayoutReference
+		w.PaidAt = &now
+		return withdrawalLedger(tx, *w, LedgerWithdrawalPaid, money.Zero(w.Amount.Currency))
+	})
+}
+
+func listWithdrawals(c fiber.Ctx, query *gorm.DB) error {
+	params, err := pagination.Parse(c, withdrawalSorts, "-created_at")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if raw := c.Query("status"); raw != "" {
+		statuses := strings.Split(raw, ",")
+		for _, status := range statuses {
+			switch status {
+			case WithdrawalPending, WithdrawalApproved, WithdrawalRejected, WithdrawalPaid:
+			default:
+				return c.Status(400).JSON(fiber.Map{"error": "unknown withdrawal status: " + status})
+			}
+		}
+		query = query.Where("status IN ?", statuses)
+	}
+
+	var withdrawals []Withdrawal
+	if err := pagination.Apply(query, params).Find(&withdrawals).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to load withdrawals"})
+	}
+	return c.JSON(pagination.NewPage(withdrawals, params, withdrawalSortKey))
+}
+
+func listMemberWithdrawals(c fiber.Ctx) error {
+	return listWithdrawals(c, db.Where("member_id = ?", c.Params("member_id")))
+}
+
+func listAllWithdrawals(c fiber.Ctx) error {
+	return listWithdrawals(c, db.Model(&Withdrawal{}))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+func TestListWithdrawalsStatus(t *testing.T) {
+	conn := testDB(t)
+	if err := conn.AutoMigrate(&Withdrawal{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range []string{WithdrawalPending, WithdrawalApproved, WithdrawalPaid} {
+		conn.Create(&Withdrawal{WithdrawalID: "w-" + status, MemberID: "m1", Amount: thb(100), Status: status})
+	}
+
+	app := fiber.New()
+	app.Get("/withdrawals", listAllWithdrawals)
+
+	tests := []struct {
+		query string
+		want  int
+		count int
+	}{
+		{"", 200, 3},
+		{"?status=pending", 200, 1},
+		{"?status=approved,paid", 200, 2},
+		{"?status=rejected", 200, 0},
+		{"?status=done", 400, 0},
+		{"?status=pending,PAID", 400, 0},
+		{"?status=pending,", 400, 0},
+	}
+	for _, tt := range tests {
+		resp, err := app.Test(httptest.NewRequest("GET", "/withdrawals"+tt.query, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.want {
+			t.Errorf("%q: got status %d, want %d", tt.query, resp.StatusCode, tt.want)
+			continue
+		}
+		if tt.want != 200 {
+			continue
+		}
+		var page struct{ Data []Withdrawal }
+		if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Data) != tt.count {
+			t.Errorf("%q: got %d withdrawals, want %d", tt.query, len(page.Data), tt.count)
+		}
+	}
+}